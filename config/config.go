@@ -11,6 +11,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+
+	"github.com/dmwm/das2go/utils"
 )
 
 // Configuration stores DAS configuration parameters
@@ -37,13 +39,54 @@ type Configuration struct {
 	Timeout               int      `json:"timeout"`               // query time out
 	Frontend              string   `json:"frontend"`              // frontend URI to use
 	RucioUrl              string   `json:"rucioUrl"`              // default RucioUrl
-	RucioTokenCurl        bool     `json:"rucioTokenCurl"`        // use curl method to obtain Rucio Token
+	RucioAuthMethod       string   `json:"rucioAuthMethod"`       // Rucio authentication method: x509 (default), x509_proxy, userpass or oidc
+	RucioUsername         string   `json:"rucioUsername"`         // Rucio username of userpass authentication
+	RucioPassword         string   `json:"rucioPassword"`         // Rucio password or file with it of userpass authentication
+	RucioTokenFile        string   `json:"rucioTokenFile"`        // file with OIDC token of oidc authentication, default token
+	RucioAuthInsecure     bool     `json:"rucioAuthInsecure"`     // do not verify certificate of Rucio auth server, for testing only
 	ProfileFile           string   `json:"profileFile"`           // send profile data to a given file
 	TLSCertsRenewInterval int      `json:"tlsCertsRenewInterval"` // renewal interval for TLS certs
 	LogFile               string   `json:"logFile"`               // log file name
 	UseDNSCache           bool     `json:"useDNSCache"`           // use DNS Cache
 	AuthDN                bool     `json:"authDN"`                // user user DN authentication
 	KeepAlive             bool     `json:"keepAlive"`             // use keep-alive HTTP header
+	RefreshTopN           int      `json:"refreshTopN"`           // number of popular queries to refresh in background, 0 disables it
+	RefreshConcurrency    int      `json:"refreshConcurrency"`    // number of concurrent background refreshes
+	RefreshLead           int      `json:"refreshLead"`           // refresh queries which expire within given number of seconds
+	RefreshInterval       int      `json:"refreshInterval"`       // interval in seconds to look-up queries to refresh
+	StaleWhileRevalidate  bool     `json:"staleWhileRevalidate"`  // serve expired records while they are refreshed
+	MaxStaleness          int      `json:"maxStaleness"`          // max time in seconds to keep expired records
+	AdminDNs              []string `json:"adminDNs"`              // list of user DNs allowed to use admin API
+	Backend               string   `json:"backend"`               // DAS storage backend: mongo (default), memory or bolt
+	BoltFile              string   `json:"boltFile"`              // location of database file used by bolt backend
+	MongoPoolLimit        int      `json:"mongoPoolLimit"`        // max number of connections to MongoDB server, default 4096
+	MongoTimeout          int      `json:"mongoTimeout"`          // MongoDB dial, socket and write timeout in seconds
+	MongoWriteConcern     string   `json:"mongoWriteConcern"`     // MongoDB write concern: number of nodes or mode, e.g. majority
+	MongoJournal          bool     `json:"mongoJournal"`          // wait for MongoDB journal commit on writes
+	RetryBudgetRate       float64  `json:"retryBudgetRate"`       // max number of retries per second of all upstream calls, default 5, negative value means no limit
+	RetryBudgetBurst      int      `json:"retryBudgetBurst"`      // max number of retries at once, default 10
+	BreakerThreshold      int      `json:"breakerThreshold"`      // number of consecutive failures which opens service circuit breaker, default 5, negative value disables breakers
+	BreakerCooldown       int      `json:"breakerCooldown"`       // cool-down period of open circuit breaker in seconds, default 60
+	MaxResponseSize       int64    `json:"maxResponseSize"`       // max size of upstream response in bytes, 0 means no limit
+	ResponseCacheSize     int64    `json:"responseCacheSize"`     // max size of cache of upstream responses in bytes, 0 (default) disables the cache
+	FixtureMode           string   `json:"fixtureMode"`           // fixtures of upstream calls: record, replay or empty
+	FixtureDir            string   `json:"fixtureDir"`            // location of fixtures of upstream calls, default fixtures
+	Token                 string   `json:"token"`                 // bearer token or file with token used in upstream calls
+	CredentialsInterval   int      `json:"credentialsInterval"`   // interval in seconds to check credential files for changes, default 60
+	TokenRefreshAhead     int      `json:"tokenRefreshAhead"`     // refresh tokens given number of seconds before they expire, default 60
+	CredentialsWarnPeriod int      `json:"credentialsWarnPeriod"` // warn about X509 credentials which expire within given number of seconds, default 86400
+
+	// retry policies of services, the key is service name (e.g. dbs or rucio) or default
+	RetryPolicies map[string]utils.RetryPolicy `json:"retryPolicies"`
+
+	// max number of concurrent calls of services, the key is service name or default
+	ServiceLimits map[string]int `json:"serviceLimits"`
+
+	// TTL in seconds of cached responses of services, the key is service name or default
+	ResponseCacheTTL map[string]int `json:"responseCacheTTL"`
+
+	// rewrites of upstream URLs (e.g. to use mock server), the key is URL pattern to replace
+	UrlRewrites map[string]string `json:"urlRewrites"`
 }
 
 // Config variable represents configuration object
@@ -73,8 +116,53 @@ func ParseConfig(configFile string) error {
 	if Config.TLSCertsRenewInterval == 0 {
 		Config.TLSCertsRenewInterval = 600
 	}
+	if Config.CredentialsInterval == 0 {
+		Config.CredentialsInterval = 60
+	}
+	if Config.TokenRefreshAhead == 0 {
+		Config.TokenRefreshAhead = 60
+	}
+	if Config.CredentialsWarnPeriod == 0 {
+		Config.CredentialsWarnPeriod = 86400
+	}
+	if Config.RucioAuthMethod == "" {
+		Config.RucioAuthMethod = "x509"
+	}
 	if Config.RucioUrl == "" {
 		Config.RucioUrl = "https://cms-rucio.cern.ch"
 	}
+	if Config.RefreshConcurrency == 0 {
+		Config.RefreshConcurrency = 2
+	}
+	if Config.RefreshLead == 0 {
+		Config.RefreshLead = 120
+	}
+	if Config.RefreshInterval == 0 {
+		Config.RefreshInterval = 30
+	}
+	if Config.MaxStaleness == 0 {
+		Config.MaxStaleness = 3600
+	}
+	if Config.RetryBudgetRate == 0 {
+		Config.RetryBudgetRate = 5
+	}
+	if Config.RetryBudgetBurst == 0 {
+		Config.RetryBudgetBurst = 10
+	}
+	if Config.BreakerThreshold == 0 {
+		Config.BreakerThreshold = 5
+	}
+	if Config.BreakerCooldown == 0 {
+		Config.BreakerCooldown = 60
+	}
+	if Config.FixtureMode != "" && Config.FixtureMode != utils.FixtureRecord && Config.FixtureMode != utils.FixtureReplay {
+		return fmt.Errorf("invalid fixtureMode %s, should be record or replay", Config.FixtureMode)
+	}
+	if Config.FixtureDir == "" {
+		Config.FixtureDir = "fixtures"
+	}
+	if Config.BoltFile == "" {
+		Config.BoltFile = "das.db"
+	}
 	return nil
 }
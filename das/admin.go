@@ -0,0 +1,132 @@
+package das
+
+// DAS cache administration functions
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/storage"
+	"github.com/dmwm/das2go/utils"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CachedQueries returns list of DAS queries stored in DAS cache along with
+// their qhash, status, number of records, their size, expire timestamp and age
+func CachedQueries() ([]mongo.DASRecord, error) {
+	var out []mongo.DASRecord
+	spec := bson.M{"das.record": 0}
+	now := time.Now().Unix()
+	recs, err := storage.DB.Get(storage.Cache, spec, 0, -1)
+	if err != nil {
+		return out, err
+	}
+	for _, rec := range recs {
+		pid, _ := rec["qhash"].(string)
+		if pid == "" {
+			continue
+		}
+		status, _ := mongo.GetStringValue(rec, "das.status")
+		expire, _ := mongo.GetInt64Value(rec, "das.expire")
+		minExpire, _ := mongo.GetInt64Value(rec, "das.min_expire")
+		maxExpire, _ := mongo.GetInt64Value(rec, "das.max_expire")
+		ts, err := mongo.GetInt64Value(rec, "das.ts")
+		var age int64
+		if err == nil {
+			age = now - ts
+		}
+		nrec := Count(pid)
+		size := 0
+		if nrec > 0 {
+			size = Bytes(pid)
+		}
+		row := mongo.DASRecord{
+			"qhash":      pid,
+			"query":      rec["query"],
+			"status":     status,
+			"nrecords":   nrec,
+			"bytes":      size,
+			"expire":     expire,
+			"min_expire": minExpire,
+			"max_expire": maxExpire,
+			"age":        age,
+		}
+		out = append(out, row)
+	}
+	return out, nil
+}
+
+// InvalidateQuery removes all records of given DAS query (qhash) from DAS cache
+func InvalidateQuery(pid string) error {
+	pids := []string{pid}
+	if dpid := dataPid(pid); dpid != pid {
+		pids = append(pids, dpid)
+	}
+	for _, qhash := range pids {
+		spec := bson.M{"qhash": qhash}
+		for _, coll := range []string{storage.Cache, storage.Merge} {
+			if err := storage.DB.Remove(coll, spec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// helper function to invalidate all queries matching given spec of DAS records
+func invalidate(spec bson.M) ([]string, error) {
+	var pids []string
+	spec["das.record"] = 0
+	recs, err := storage.DB.Get(storage.Cache, spec, 0, -1)
+	if err != nil {
+		return pids, err
+	}
+	for _, rec := range recs {
+		if pid, ok := rec["qhash"].(string); ok && pid != "" {
+			pids = append(pids, pid)
+		}
+	}
+	pids = utils.List2Set(pids)
+	for idx, pid := range pids {
+		if err := InvalidateQuery(pid); err != nil {
+			return pids[:idx], err
+		}
+	}
+	return pids, nil
+}
+
+// InvalidatePattern removes all DAS queries matching given regular expression
+// pattern, e.g. dataset name, and returns list of their qhashes
+func InvalidatePattern(pattern string) ([]string, error) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		return []string{}, err
+	}
+	spec := bson.M{"query": bson.RegEx{Pattern: pattern}}
+	return invalidate(spec)
+}
+
+// PurgeSystem removes all DAS queries which used given system, e.g. dbs3,
+// and returns list of their qhashes
+func PurgeSystem(system string) ([]string, error) {
+	pattern := fmt.Sprintf("^%s:", regexp.QuoteMeta(system))
+	spec := bson.M{"das.services": bson.RegEx{Pattern: pattern}}
+	return invalidate(spec)
+}
+
+// Audit writes audit record of administrative action into DAS audit collection and log
+func Audit(user, action string, params map[string]string, pids []string) {
+	rec := mongo.DASRecord{
+		"ts":      time.Now().Unix(),
+		"user":    user,
+		"action":  action,
+		"params":  params,
+		"qhashes": pids,
+	}
+	if err := storage.DB.Insert(storage.Audit, []mongo.DASRecord{rec}); err != nil {
+		log.Printf("ERROR: unable to write audit record %v, error %v\n", rec, err)
+	}
+	log.Printf("AUDIT user=\"%s\" action=%s params=%v nqueries=%d qhashes=%v\n", user, action, params, len(pids), pids)
+}
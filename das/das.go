@@ -13,12 +13,14 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dmwm/das2go/dasmaps"
 	"github.com/dmwm/das2go/dasql"
 	"github.com/dmwm/das2go/mongo"
 	"github.com/dmwm/das2go/services"
+	"github.com/dmwm/das2go/storage"
 	"github.com/dmwm/das2go/utils"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -402,8 +404,26 @@ func FormRESTUrl(dasquery dasql.DASQuery, dasmap mongo.DASRecord) string {
 // DASRecords holds list of DAS records
 type DASRecords []mongo.DASRecord
 
+// helper function to store data records of given DAS query. Records of single
+// field look-ups are merged into DAS merge collection as they arrive, otherwise
+// they are kept in DAS cache collection until all services are done.
+// It returns size of stored records in bytes.
+func storeRecords(dasquery dasql.DASQuery, srv string, records []mongo.DASRecord, pkeys, diffKeys []string) (int64, error) {
+	nbytes := services.SetBytes(records)
+	var err error
+	if len(pkeys) > 0 && services.IncrementalMerge(dasquery.Fields, pkeys[0]) {
+		err = services.UpsertRecords(dasquery.Qhash, pkeys[0], records, diffKeys)
+	} else {
+		err = storage.DB.Insert(storage.Cache, records)
+	}
+	if err == nil {
+		addServiceBytes(srv, nbytes)
+	}
+	return nbytes, err
+}
+
 // helper function to process given set of URLs associted with dasquery
-func processLocalApis(dasquery dasql.DASQuery, dmaps []mongo.DASRecord, pkeys []string) {
+func processLocalApis(dasquery dasql.DASQuery, dmaps []mongo.DASRecord, pkeys, diffKeys []string) {
 	if utils.WEBSERVER > 0 && utils.VERBOSE > 0 {
 		log.Println("processLocalApis", dmaps)
 	}
@@ -429,8 +449,10 @@ func processLocalApis(dasquery dasql.DASQuery, dmaps []mongo.DASRecord, pkeys []
 		t := reflect.ValueOf(services.LocalAPIs{})         // type of LocalAPIs struct
 		m := t.MethodByName(apiFunc)                       // associative function name for given api
 		args := []reflect.Value{reflect.ValueOf(dasquery)} // list of function arguments
-		vals := m.Call(args)[0]                            // return value
-		records := vals.Interface().([]mongo.DASRecord)    // cast reflect value to its type
+		startTime := time.Now()
+		vals := m.Call(args)[0]                         // return value
+		records := vals.Interface().([]mongo.DASRecord) // cast reflect value to its type
+		outcome := services.ServiceOutcome(system, utils.ResponseType{Time: time.Since(startTime)}, records)
 		if utils.VERBOSE > 1 {
 			log.Printf("local apis, urn %v, system %v, expire %v, dmap %v, api %v, func %v, method %v, records %v\n", urn, system, expire, dmap, api, apiFunc, m, len(records))
 		}
@@ -449,16 +471,27 @@ func processLocalApis(dasquery dasql.DASQuery, dmaps []mongo.DASRecord, pkeys []
 			}
 		}
 		das := dasrecord["das"].(mongo.DASRecord)
-		das["expire"] = dasexpire
+		services.SetExpire(das, dasexpire)
+		if len(records) != 0 {
+			services.UpdateExpireRange(das, dasexpire)
+		}
 		das["status"] = dasstatus
 		dasrecord["das"] = das
-		services.UpdateDASRecord(dasquery.Qhash, dasrecord)
 
 		// fix all records expire values based on lowest one
 		records = services.UpdateExpire(dasquery.Qhash, records, dasexpire)
 
-		// insert records into DAS cache collection
-		mongo.Insert("das", "cache", records)
+		// insert records into DAS cache or merge collection
+		srv := fmt.Sprintf("%s:%s", system, urn)
+		nbytes, err := storeRecords(dasquery, srv, records, pkeys, diffKeys)
+		outcome["bytes"] = nbytes
+		if err != nil {
+			services.SetStorageError(outcome, err)
+		}
+
+		// report service state only when its records are in DAS cache
+		services.SetServiceOutcome(dasrecord, srv, outcome)
+		services.UpdateDASRecord(dasquery.Qhash, dasrecord)
 	}
 	// initial expire timestamp is 1h
 	//     expire := utils.Expire(3600)
@@ -470,14 +503,79 @@ func processLocalApis(dasquery dasql.DASQuery, dmaps []mongo.DASRecord, pkeys []
 		dasexpire = expire
 	}
 	das := dasrecord["das"].(mongo.DASRecord)
-	das["expire"] = dasexpire
+	services.SetExpire(das, dasexpire)
 	das["status"] = "ok"
 	dasrecord["das"] = das
 	services.UpdateDASRecord(dasquery.Qhash, dasrecord)
 }
 
+// helper function to process response of given system and urn. Records are
+// decoded, adjusted and stored in batches if possible, see services.StreamUnmarshal
+func processResponse(dasquery dasql.DASQuery, r utils.ResponseType, system, urn string, expire int, dmaps dasmaps.DASMaps, pkeys, diffKeys []string) {
+	srv := fmt.Sprintf("%s:%s", system, urn)
+
+	// get DAS record and adjust its settings
+	dasrecord := services.GetDASRecord(dasquery)
+	dasexpire := services.GetExpire(dasrecord)
+	das := dasrecord["das"].(mongo.DASRecord)
+	das["status"] = fmt.Sprintf("process %s", srv)
+
+	// outcome of the service is based on its error records and number of data records
+	var errRecords []mongo.DASRecord
+	var nrec int
+	var nbytes int64
+	store := func(records []mongo.DASRecord) error {
+		for _, rec := range records {
+			if _, ok := rec["error"]; ok {
+				errRecords = append(errRecords, rec)
+			} else if rec != nil {
+				nrec++
+			}
+		}
+		records = services.AdjustRecords(dasquery, system, urn, records, expire, pkeys)
+		if len(records) == 0 {
+			return nil
+		}
+		if recexpire := services.GetExpire(records[0]); dasexpire < recexpire {
+			dasexpire = recexpire
+		}
+		services.UpdateExpireRange(das, dasexpire)
+
+		// fix all records expire values based on lowest one
+		records = services.UpdateExpire(dasquery.Qhash, records, dasexpire)
+
+		// insert records into DAS cache or merge collection
+		size, err := storeRecords(dasquery, srv, records, pkeys, diffKeys)
+		nbytes += size
+		return err
+	}
+	notations := dmaps.FindNotations(system)
+	if r.Body != nil {
+		defer r.Body.Close()
+	}
+	ok, err := services.StreamUnmarshal(dasquery, system, urn, r, notations, store)
+	if !ok {
+		r.ReadBody()
+		err = store(services.Unmarshal(dasquery, system, urn, r, notations, pkeys))
+	} else if r.Body != nil && r.Body.Err() != nil {
+		r.Error = r.Body.Err()
+	}
+	outcome := services.ServiceOutcome(system, r, errRecords)
+	outcome["nrecords"] = nrec
+	outcome["bytes"] = nbytes
+	if err != nil {
+		services.SetStorageError(outcome, err)
+	}
+	services.SetExpire(das, dasexpire)
+	dasrecord["das"] = das
+
+	// report service state only when its records are in DAS cache
+	services.SetServiceOutcome(dasrecord, srv, outcome)
+	services.UpdateDASRecord(dasquery.Qhash, dasrecord)
+}
+
 // helper function to process given set of URLs associted with dasquery
-func processURLs(dasquery dasql.DASQuery, urls map[string]string, maps []mongo.DASRecord, dmaps dasmaps.DASMaps, pkeys []string) {
+func processURLs(dasquery dasql.DASQuery, urls map[string]string, maps []mongo.DASRecord, dmaps dasmaps.DASMaps, pkeys, diffKeys []string) {
 	if utils.WEBSERVER > 0 && utils.VERBOSE > 0 {
 		log.Println("processURLs", urls)
 	}
@@ -493,7 +591,7 @@ func processURLs(dasquery dasql.DASQuery, urls map[string]string, maps []mongo.D
 	client := utils.HttpClient()
 	for furl, args := range urls {
 		umap[furl] = 1 // keep track of processed urls below
-		go utils.Fetch(client, furl, args, out)
+		go utils.FetchStream(client, furl, args, out, dasquery.Qhash, dasquery.Priority)
 	}
 
 	// collect all results from out channel
@@ -522,33 +620,7 @@ func processURLs(dasquery dasql.DASQuery, urls map[string]string, maps []mongo.D
 					expire = dasmaps.GetInt(dmap, "expire")
 				}
 			}
-			// process data records
-			notations := dmaps.FindNotations(system)
-			records := services.Unmarshal(dasquery, system, urn, r, notations, pkeys)
-			records = services.AdjustRecords(dasquery, system, urn, records, expire, pkeys)
-
-			// get DAS record and adjust its settings
-			dasrecord := services.GetDASRecord(dasquery)
-			dasstatus := fmt.Sprintf("process %s:%s", system, urn)
-			dasexpire := services.GetExpire(dasrecord)
-			if len(records) != 0 {
-				rec := records[0]
-				recexpire := services.GetExpire(rec)
-				if dasexpire < recexpire {
-					dasexpire = recexpire
-				}
-			}
-			das := dasrecord["das"].(mongo.DASRecord)
-			das["expire"] = dasexpire
-			das["status"] = dasstatus
-			dasrecord["das"] = das
-			services.UpdateDASRecord(dasquery.Qhash, dasrecord)
-
-			// fix all records expire values based on lowest one
-			records = services.UpdateExpire(dasquery.Qhash, records, dasexpire)
-
-			// insert records into DAS cache collection
-			mongo.Insert("das", "cache", records)
+			processResponse(dasquery, r, system, urn, expire, dmaps, pkeys, diffKeys)
 			// remove from umap, indicate that we processed it
 			delete(umap, r.Url) // remove Url from map
 		default:
@@ -561,7 +633,7 @@ func processURLs(dasquery dasql.DASQuery, urls map[string]string, maps []mongo.D
 					dasexpire = expire
 				}
 				das := dasrecord["das"].(mongo.DASRecord)
-				das["expire"] = dasexpire
+				services.SetExpire(das, dasexpire)
 				das["status"] = "ok"
 				dasrecord["das"] = das
 				services.UpdateDASRecord(dasquery.Qhash, dasrecord)
@@ -727,8 +799,9 @@ func Process(dasquery dasql.DASQuery, dmaps dasmaps.DASMaps) {
 		dasrecord := services.CreateDASErrorRecord(dasquery, pkeys)
 		var records []mongo.DASRecord
 		records = append(records, dasrecord)
-		mongo.Insert("das", "cache", records)
-		mongo.Insert("das", "merge", records)
+		if err := storage.DB.Insert(storage.Cache, records); err == nil {
+			storage.DB.Insert(storage.Merge, records)
+		}
 		return
 	}
 	dasrecord := services.CreateDASRecord(dasquery, srvs, pkeys)
@@ -737,26 +810,69 @@ func Process(dasquery dasql.DASQuery, dmaps dasmaps.DASMaps) {
 	}
 	var records []mongo.DASRecord
 	records = append(records, dasrecord)
-	mongo.Insert("das", "cache", records)
+	if err := storage.DB.Insert(storage.Cache, records); err != nil {
+		log.Printf("ERROR: unable to create DAS record, query %v, error %v\n", dasquery, err)
+		return
+	}
+
+	// keys we use to compare values of the same records provided by different services
+	var diffKeys []string
+	if len(dasquery.Fields) == 1 {
+		diffKeys = dmaps.DiffKeys(dasquery.Fields[0])
+	}
 
 	// process local_api calls, we use GoDeferFunc to run processLocalApis as goroutine in defer/silent mode
 	// errors will be captured in GoDeferFunc and passed again into this local function
 	if len(localApis) > 0 {
-		utils.GoDeferFunc("go processLocalApis", func() { processLocalApis(dasquery, localApis, pkeys) })
+		utils.GoDeferFunc("go processLocalApis", func() { processLocalApis(dasquery, localApis, pkeys, diffKeys) })
 	}
 	// process URLs which will insert records into das cache and merge them into das merge collection
 	if urls != nil {
-		utils.GoDeferFunc("go processURLs", func() { processURLs(dasquery, urls, maps, dmaps, pkeys) })
+		utils.GoDeferFunc("go processURLs", func() { processURLs(dasquery, urls, maps, dmaps, pkeys, diffKeys) })
 	}
 
-	// merge DAS cache records
-	records, _ = services.MergeDASRecords(dasquery)
-	mongo.Insert("das", "merge", records)
+	// all services are done, mark those which did not report back
+	dasrecord = services.GetDASRecord(dasquery)
+	services.FinalizeServiceStatus(dasrecord)
+	services.UpdateDASRecord(dasquery.Qhash, dasrecord)
+
+	// merge DAS cache records which were not merged during processing
+	if len(pkeys) == 0 || !services.IncrementalMerge(dasquery.Fields, pkeys[0]) {
+		var err error
+		records, _, err = services.MergeDASRecords(dasquery)
+		if err == nil {
+			// compare values of the same records provided by different services
+			if len(records) > 0 && len(dasquery.Fields) == 1 {
+				if ndiff := services.CheckConsistency(records, dasquery.Fields[0], diffKeys); ndiff > 0 {
+					log.Printf("%v found %d records with inconsistent values among services\n", dasquery, ndiff)
+				}
+			}
+			services.SetBytes(records)
+			err = storage.DB.Insert(storage.Merge, records)
+		}
+		if err != nil {
+			// remove records of the query such that it will be processed again by next request
+			log.Printf("ERROR: unable to merge records, query %v, error %v\n", dasquery, err)
+			spec := bson.M{"qhash": dasquery.Qhash}
+			storage.DB.Remove(storage.Cache, spec)
+			storage.DB.Remove(storage.Merge, spec)
+			return
+		}
+
+		// merged records replace raw data records
+		spec := bson.M{"qhash": dasquery.Qhash, "das.record": 1}
+		storage.DB.Remove(storage.Cache, spec)
+	}
 
 	// insert das.record=0 into DAS Merge collection to indicate that we done with request
 	spec := bson.M{"das.record": 0, "qhash": dasquery.Qhash}
-	recs := mongo.Get("das", "cache", spec, 0, 1)
-	mongo.Insert("das", "merge", recs)
+	recs, err := storage.DB.Get(storage.Cache, spec, 0, 1)
+	if err == nil {
+		err = storage.DB.Insert(storage.Merge, recs)
+	}
+	if err != nil {
+		log.Printf("ERROR: unable to finalize DAS record, query %v, error %v\n", dasquery, err)
+	}
 }
 
 // helper function to modify spec with given filter
@@ -800,66 +916,229 @@ func modSpec(spec bson.M, filter string) {
 	spec[key] = cond
 }
 
-// GetData for given pid (DAS Query qhash)
-func GetData(dasquery dasql.DASQuery, coll string, idx, limit int) (string, []mongo.DASRecord) {
-
-	// defer function profiler
-	defer utils.MeasureTime("das/GetData")()
-
-	var emptyData, data []mongo.DASRecord
+// helper function to pass data records for given DAS query from given collection
+// to given function. Records are ordered by sort filter keys and _id, the idx
+// and limit define range of records and cursor token defines position of
+// previous page, see storage.Cursor
+func iterateRecords(dasquery dasql.DASQuery, coll, cursor string, idx, limit int, fn func(rec mongo.DASRecord) error) error {
 	pid := dasquery.Qhash
+	if coll == storage.Merge {
+		pid = dataPid(pid)
+	}
 	filters := dasquery.Filters
 	aggrs := dasquery.Aggregators
-	if len(aggrs) > 0 { // if we need to aggregate we should ignore pagination
-		idx = 0
-		limit = -1
-	}
 	spec := bson.M{"qhash": pid, "das.record": 1}
 	skeys := filters["sort"]
-	if len(filters) > 0 {
-		var afilters []string
-		for key, vals := range filters {
-			if key == "grep" {
-				for _, val := range vals {
-					if strings.Index(val, "<") > 0 || strings.Index(val, "<") > 0 || strings.Index(val, "!") > 0 || strings.Index(val, "=") > 0 {
-						modSpec(spec, val)
-					} else {
-						afilters = append(afilters, val)
-					}
-				}
+	var afilters []string
+	for _, val := range filters["grep"] {
+		if strings.Index(val, "<") > 0 || strings.Index(val, "<") > 0 || strings.Index(val, "!") > 0 || strings.Index(val, "=") > 0 {
+			modSpec(spec, val)
+		} else {
+			afilters = append(afilters, val)
+		}
+	}
+	var fields []string
+	if len(afilters) > 0 {
+		fields = append(fields, afilters...)
+		// keep sort keys to be able to create cursor of next page
+		for _, skey := range skeys {
+			fields = append(fields, strings.TrimLeft(skey, "+-"))
+		}
+		fields = append(fields, "das") // always extract das part of the record
+	}
+	if len(aggrs) > 0 { // if we need to aggregate we should ignore pagination
+		var data []mongo.DASRecord
+		err := storage.DB.Iterate(coll, spec, fields, skeys, 0, -1, func(rec mongo.DASRecord) error {
+			data = append(data, rec)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, rec := range aggregateAll(data, aggrs) {
+			if err := fn(rec); err != nil {
+				return err
 			}
 		}
-		if len(afilters) > 0 {
-			data = mongo.GetFilteredSorted("das", coll, spec, afilters, skeys, idx, limit)
-		} else {
-			data = mongo.Get("das", coll, spec, idx, limit)
+		return nil
+	}
+	if cursor != "" {
+		c, err := storage.DecodeCursor(cursor)
+		if err != nil {
+			return err
 		}
-	} else {
-		data = mongo.Get("das", coll, spec, idx, limit)
+		cspec, err := c.Spec(skeys)
+		if err != nil {
+			return err
+		}
+		spec = bson.M{"$and": []interface{}{spec, cspec}}
+		idx = 0
+		if c.Prev {
+			// records before the cursor are read in reversed order
+			var data []mongo.DASRecord
+			err := storage.DB.Iterate(coll, spec, fields, storage.ReverseKeys(skeys), 0, limit, func(rec mongo.DASRecord) error {
+				data = append(data, rec)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for i := len(data) - 1; i >= 0; i-- {
+				if err := fn(data[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return storage.DB.Iterate(coll, spec, fields, skeys, idx, limit, fn)
+}
+
+// helper function to get data records for given DAS query from given collection
+func getRecords(dasquery dasql.DASQuery, coll, cursor string, idx, limit int) ([]mongo.DASRecord, error) {
+	var data []mongo.DASRecord
+	err := iterateRecords(dasquery, coll, cursor, idx, limit, func(rec mongo.DASRecord) error {
+		data = append(data, rec)
+		return nil
+	})
+	return data, err
+}
+
+// helper function to get status of DAS query from its DAS record in given collection
+func queryStatus(pid, coll string) (string, error) {
+	spec := bson.M{"qhash": pid, "das.record": 0}
+	dasData, err := storage.DB.Get(coll, spec, 0, 1)
+	if err != nil {
+		return "", err
 	}
-	if len(aggrs) > 0 {
-		data = aggregateAll(data, aggrs)
+	if len(dasData) == 0 {
+		return "", fmt.Errorf("no DAS record found in das.%s collection", coll)
+	}
+	return mongo.GetStringValue(dasData[0], "das.status")
+}
+
+// GetData for given pid (DAS Query qhash), the records are selected either
+// by idx and limit or by cursor token of previous page and limit
+func GetData(dasquery dasql.DASQuery, coll, cursor string, idx, limit int) (string, []mongo.DASRecord) {
+
+	// defer function profiler
+	defer utils.MeasureTime("das/GetData")()
+
+	var emptyData []mongo.DASRecord
+	data, err := getRecords(dasquery, coll, cursor, idx, limit)
+	if err != nil {
+		return fmt.Sprintf("ERROR failed to get data from DAS cache: %s\n", err), emptyData
 	}
 
 	// perform post-processing of DAS records
 	//     data = PostProcessing(dasquery, data)
 
 	// Get DAS status from merge collection
-	spec = bson.M{"qhash": pid, "das.record": 0}
-	dasData := mongo.Get("das", "merge", spec, 0, 1)
+	status, err := queryStatus(dasquery.Qhash, storage.Merge)
+	if err != nil {
+		return fmt.Sprintf("ERROR failed to get data from DAS cache: %s\n", err), emptyData
+	}
+	if len(data) == 0 {
+		return status, emptyData
+	}
+	return status, data
+}
+
+// GetStatus returns status of given DAS query from its DAS record in merge collection
+func GetStatus(dasquery dasql.DASQuery) string {
+	status, err := queryStatus(dasquery.Qhash, storage.Merge)
+	if err != nil {
+		return fmt.Sprintf("ERROR failed to get data from DAS cache: %s\n", err)
+	}
+	return status
+}
+
+// StreamData passes all records of given DAS query to given function as they
+// are read from DAS cache, i.e. records are not kept in memory
+func StreamData(dasquery dasql.DASQuery, fn func(rec mongo.DASRecord) error) error {
+
+	// defer function profiler
+	defer utils.MeasureTime("das/StreamData")()
+
+	return iterateRecords(dasquery, storage.Merge, "", 0, -1, fn)
+}
+
+// NextCursor returns cursor token of the page which follows given page of
+// records of DAS query, it returns empty string if there is no next page
+func NextCursor(dasquery dasql.DASQuery, data []mongo.DASRecord, limit int) string {
+	if limit <= 0 || len(data) < limit || len(dasquery.Aggregators) > 0 {
+		return ""
+	}
+	return storage.NewCursor(data[len(data)-1], dasquery.Filters["sort"]).Encode()
+}
+
+// PrevCursor returns cursor token of the page which precedes given page of
+// records of DAS query, it returns empty string if there is no such page
+func PrevCursor(dasquery dasql.DASQuery, data []mongo.DASRecord) string {
+	if len(data) == 0 || len(dasquery.Aggregators) > 0 {
+		return ""
+	}
+	// cursor values follow reversed order used to read previous page
+	skeys := storage.ReverseKeys(dasquery.Filters["sort"])
+	c := storage.NewCursor(data[0], skeys[:len(skeys)-1])
+	c.Prev = true
+	return c.Encode()
+}
+
+// LastCursor returns cursor token of the last page of records of DAS query
+func LastCursor(dasquery dasql.DASQuery) string {
+	if len(dasquery.Aggregators) > 0 {
+		return ""
+	}
+	return storage.EndCursor().Encode()
+}
+
+// GetPartialData returns records of DAS query which are already available in
+// DAS cache, i.e. records from services which finished their processing.
+// Records of multi-field look-ups are not merged yet, the merge step is done
+// once all services are finished.
+func GetPartialData(dasquery dasql.DASQuery, cursor string, idx, limit int) (string, []mongo.DASRecord) {
+
+	// defer function profiler
+	defer utils.MeasureTime("das/GetPartialData")()
+
+	var emptyData []mongo.DASRecord
+	spec := bson.M{"qhash": dasquery.Qhash, "das.record": 0}
+	dasData, err := storage.DB.Get(storage.Cache, spec, 0, 1)
+	if err != nil {
+		return fmt.Sprintf("ERROR failed to get data from DAS cache: %s\n", err), emptyData
+	}
 	if len(dasData) == 0 {
-		return fmt.Sprintf("ERROR no DAS record found in das.merge collection\n"), emptyData
+		return fmt.Sprintf("ERROR no DAS record found in das.cache collection\n"), emptyData
 	}
 	status, err := mongo.GetStringValue(dasData[0], "das.status")
 	if err != nil {
 		return fmt.Sprintf("ERROR failed to get data from DAS cache: %s\n", err), emptyData
 	}
+	coll := storage.Cache
+	if pkey, err := mongo.GetStringValue(dasData[0], "das.primary_key"); err == nil && services.IncrementalMerge(dasquery.Fields, pkey) {
+		coll = storage.Merge
+	}
+	data, err := getRecords(dasquery, coll, cursor, idx, limit)
+	if err != nil {
+		return fmt.Sprintf("ERROR failed to get data from DAS cache: %s\n", err), emptyData
+	}
 	if len(data) == 0 {
 		return status, emptyData
 	}
 	return status, data
 }
 
+// ServiceStates returns processing states of individual services for given DAS query qhash
+func ServiceStates(pid string) []mongo.DASRecord {
+	spec := bson.M{"qhash": pid, "das.record": 0}
+	recs, err := storage.DB.Get(storage.Cache, spec, 0, 1)
+	if err != nil || len(recs) == 0 {
+		return []mongo.DASRecord{}
+	}
+	return services.ServiceStates(recs[0])
+}
+
 // helper function to perform post-processing of DAS data, e.g.
 // when we call site query we need to distinguish the case when
 // to show original site
@@ -989,20 +1268,67 @@ func Aggregate(data []mongo.DASRecord, agg, key string) mongo.DASRecord {
 
 // Count gets number of records for given DAS query qhash
 func Count(pid string) int {
+	spec := bson.M{"qhash": dataPid(pid), "das.record": 1}
+	nrec, _ := storage.DB.Count(storage.Merge, spec)
+	return nrec
+}
+
+// CountPartial gets number of records available so far in DAS cache for given DAS query qhash
+func CountPartial(pid string) int {
 	spec := bson.M{"qhash": pid, "das.record": 1}
-	return mongo.Count("das", "merge", spec)
+	nrec := 0
+	for _, coll := range []string{storage.Cache, storage.Merge} {
+		n, _ := storage.DB.Count(coll, spec)
+		nrec += n
+	}
+	return nrec
 }
 
 // Bytes gets size of records for given DAS query
 func Bytes(pid string) int {
-	spec := bson.M{"qhash": pid, "das.record": 1}
-	return mongo.Bytes("das", "merge", spec)
+	spec := bson.M{"qhash": dataPid(pid), "das.record": 1}
+	size, _ := storage.DB.Bytes(storage.Merge, spec)
+	return size
+}
+
+// TotalBytes gets size of all data records in DAS cache
+func TotalBytes() int {
+	spec := bson.M{"das.record": 1}
+	size, _ := storage.DB.Bytes(storage.Merge, spec)
+	return size
+}
+
+// global tracker of number of bytes stored in DAS cache by every service since server start
+var _serviceBytes = struct {
+	sync.Mutex
+	bytes map[string]int64
+}{bytes: make(map[string]int64)}
+
+// helper function to account bytes stored by given service
+func addServiceBytes(srv string, nbytes int64) {
+	_serviceBytes.Lock()
+	defer _serviceBytes.Unlock()
+	_serviceBytes.bytes[srv] += nbytes
+}
+
+// ServiceBytes returns number of bytes stored in DAS cache by every service (system:urn) since server start
+func ServiceBytes() map[string]int64 {
+	_serviceBytes.Lock()
+	defer _serviceBytes.Unlock()
+	out := make(map[string]int64)
+	for srv, nbytes := range _serviceBytes.bytes {
+		out[srv] = nbytes
+	}
+	return out
 }
 
 // GetTimestamp gets initial timestamp of DAS query request
 func GetTimestamp(pid string) int64 {
 	spec := bson.M{"qhash": pid, "das.record": 0}
-	data := mongo.Get("das", "cache", spec, 0, 1)
+	data, err := storage.DB.Get(storage.Cache, spec, 0, 1)
+	if err != nil || len(data) == 0 {
+		return time.Now().Unix()
+	}
 	ts, err := mongo.GetInt64Value(data[0], "das.ts")
 	if err != nil {
 		return time.Now().Unix()
@@ -1015,7 +1341,7 @@ func GetTimestamp(pid string) int64 {
 func CheckDataReadiness(pid string) bool {
 	espec := bson.M{"$gt": time.Now().Unix()}
 	spec := bson.M{"qhash": pid, "das.expire": espec, "das.record": 0, "das.status": "ok"}
-	nrec := mongo.Count("das", "merge", spec)
+	nrec, _ := storage.DB.Count(storage.Merge, spec)
 	if nrec == 1 {
 		return true
 	}
@@ -1026,7 +1352,7 @@ func CheckDataReadiness(pid string) bool {
 func CheckData(pid string) bool {
 	espec := bson.M{"$gt": time.Now().Unix()}
 	spec := bson.M{"qhash": pid, "das.expire": espec}
-	nrec := mongo.Count("das", "cache", spec)
+	nrec, _ := storage.DB.Count(storage.Cache, spec)
 	if nrec > 0 {
 		return true
 	}
@@ -1035,16 +1361,23 @@ func CheckData(pid string) bool {
 
 // RemoveExpired remove expired records
 func RemoveExpired(pid string) {
-	espec := bson.M{"$lt": time.Now().Unix()}
+	// keep expired records up to max staleness if we serve stale records
+	espec := bson.M{"$lt": expireThreshold()}
+	// data records of refreshed queries are stored under different qhash
+	if dpid := dataPid(pid); dpid != pid {
+		spec := bson.M{"qhash": dpid, "das.expire": espec}
+		storage.DB.Remove(storage.Cache, spec)
+		storage.DB.Remove(storage.Merge, spec)
+	}
 	spec := bson.M{"qhash": pid, "das.expire": espec}
-	mongo.Remove("das", "cache", spec) // remove from cache collection
-	mongo.Remove("das", "merge", spec) // remove from merge collection
+	storage.DB.Remove(storage.Cache, spec) // remove from cache collection
+	storage.DB.Remove(storage.Merge, spec) // remove from merge collection
 }
 
 // TimeStamp returns list of DAS queries which are currently processing by the server
 func TimeStamp(dasquery dasql.DASQuery) int64 {
 	spec := bson.M{"das.record": 0, "qhash": dasquery.Qhash}
-	recs := mongo.Get("das", "cache", spec, 0, 1)
+	recs, _ := storage.DB.Get(storage.Cache, spec, 0, 1)
 	if len(recs) == 0 {
 		log.Printf("ERROR: unable to find das record, query: %s, spec %#v\n", dasquery.String(), spec)
 		return 0
@@ -1060,15 +1393,13 @@ func TimeStamp(dasquery dasql.DASQuery) int64 {
 // ProcessingQueries returns list of DAS queries which are currently processing by the server
 func ProcessingQueries() []string {
 	var out []string
-	spec := bson.M{"das.record": 0, "das.status": "processing"}
-	for _, r := range mongo.Get("das", "cache", spec, 0, 0) {
-		q := r["query"].(string)
-		out = append(out, q)
-	}
-	spec = bson.M{"das.record": 0, "das.status": "requested"}
-	for _, r := range mongo.Get("das", "cache", spec, 0, 0) {
-		q := r["query"].(string)
-		out = append(out, q)
+	for _, status := range []string{"processing", "requested"} {
+		spec := bson.M{"das.record": 0, "das.status": status}
+		recs, _ := storage.DB.Get(storage.Cache, spec, 0, 0)
+		for _, r := range recs {
+			q := r["query"].(string)
+			out = append(out, q)
+		}
 	}
 	return utils.List2Set(out)
 }
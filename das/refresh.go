@@ -0,0 +1,342 @@
+package das
+
+// DAS background refresh of popular queries
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dmwm/das2go/dasmaps"
+	"github.com/dmwm/das2go/dasql"
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/services"
+	"github.com/dmwm/das2go/storage"
+	"github.com/dmwm/das2go/utils"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// PopularityHalfLife defines half-life of query popularity score
+var PopularityHalfLife = 24 * time.Hour
+
+// QueryPopularity keeps track of how often DAS query is requested
+type QueryPopularity struct {
+	Query   dasql.DASQuery // DAS query
+	Score   float64        // popularity score, i.e. number of hits decayed over time
+	LastHit time.Time      // time of last hit
+}
+
+// helper function to decay popularity score to given time
+func (p *QueryPopularity) decay(now time.Time) float64 {
+	dt := now.Sub(p.LastHit).Seconds()
+	return p.Score * math.Pow(0.5, dt/PopularityHalfLife.Seconds())
+}
+
+// global popularity tracker of DAS queries
+var _popularity = struct {
+	sync.Mutex
+	queries map[string]*QueryPopularity
+}{queries: make(map[string]*QueryPopularity)}
+
+// Hit records a hit of given DAS query
+func Hit(dasquery dasql.DASQuery) {
+	_popularity.Lock()
+	defer _popularity.Unlock()
+	now := time.Now()
+	if p, ok := _popularity.queries[dasquery.Qhash]; ok {
+		p.Score = p.decay(now) + 1
+		p.LastHit = now
+		return
+	}
+	_popularity.queries[dasquery.Qhash] = &QueryPopularity{Query: dasquery, Score: 1, LastHit: now}
+}
+
+// PopularQueries returns top N DAS queries sorted by their popularity,
+// queries which popularity faded away are discarded
+func PopularQueries(n int) []QueryPopularity {
+	_popularity.Lock()
+	defer _popularity.Unlock()
+	var out []QueryPopularity
+	now := time.Now()
+	for qhash, p := range _popularity.queries {
+		score := p.decay(now)
+		if score < 0.01 {
+			delete(_popularity.queries, qhash)
+			continue
+		}
+		out = append(out, QueryPopularity{Query: p.Query, Score: score, LastHit: p.LastHit})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Score > out[j].Score })
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// global set of DAS queries which are currently refreshed
+var _refreshing = struct {
+	sync.Mutex
+	queries map[string]bool
+}{queries: make(map[string]bool)}
+
+// helper function to mark query as refreshing, it returns false if query is already refreshing
+func startRefresh(qhash string) bool {
+	_refreshing.Lock()
+	defer _refreshing.Unlock()
+	if _refreshing.queries[qhash] {
+		return false
+	}
+	_refreshing.queries[qhash] = true
+	return true
+}
+
+// StaleWhileRevalidate controls if DAS serves expired records while they are refreshed
+var StaleWhileRevalidate bool
+
+// MaxStaleness defines how long we keep expired records when StaleWhileRevalidate is set
+var MaxStaleness = time.Hour
+
+// RefreshRetryInterval defines time we wait before retrying failed refresh of stale query
+var RefreshRetryInterval = time.Minute
+
+// global map of failed refreshes of stale queries
+var _failedRefresh = struct {
+	sync.Mutex
+	queries map[string]time.Time
+}{queries: make(map[string]time.Time)}
+
+// Retention returns time we keep DAS records in DAS cache after their expiration
+func Retention() time.Duration {
+	if StaleWhileRevalidate {
+		return MaxStaleness
+	}
+	return 0
+}
+
+// helper function to get expiration threshold of DAS records, i.e. records
+// which expire before this timestamp should be removed from DAS cache
+func expireThreshold() int64 {
+	return time.Now().Add(-Retention()).Unix()
+}
+
+// CheckStaleData checks if expired (but not older than MaxStaleness) records
+// of given DAS query are available in DAS cache
+func CheckStaleData(pid string) bool {
+	if !StaleWhileRevalidate {
+		return false
+	}
+	espec := bson.M{"$gt": expireThreshold()}
+	spec := bson.M{"qhash": pid, "das.expire": espec, "das.record": 0, "das.status": "ok"}
+	nrec, err := storage.DB.Count(storage.Merge, spec)
+	return err == nil && nrec == 1
+}
+
+// DataAge returns age (in seconds) of records of given DAS query, i.e. time since they were fetched
+func DataAge(pid string) int64 {
+	spec := bson.M{"qhash": pid, "das.record": 0}
+	recs, err := storage.DB.Get(storage.Merge, spec, 0, 1)
+	if err != nil || len(recs) == 0 {
+		return 0
+	}
+	ts, err := mongo.GetInt64Value(recs[0], "das.ts")
+	if err != nil {
+		return 0
+	}
+	return time.Now().Unix() - ts
+}
+
+// Revalidate triggers background refresh of stale DAS query unless it is
+// already refreshing or its previous refresh failed recently
+func Revalidate(dasquery dasql.DASQuery, dmaps dasmaps.DASMaps) {
+	pid := dasquery.Qhash
+	_failedRefresh.Lock()
+	if t, ok := _failedRefresh.queries[pid]; ok && time.Since(t) < RefreshRetryInterval {
+		_failedRefresh.Unlock()
+		return
+	}
+	delete(_failedRefresh.queries, pid)
+	_failedRefresh.Unlock()
+	if !startRefresh(pid) {
+		return
+	}
+	go func() {
+		defer stopRefresh(pid)
+		if err := refresh(dasquery, dmaps); err != nil {
+			log.Printf("ERROR: unable to revalidate %v, error %v\n", dasquery, err)
+			_failedRefresh.Lock()
+			_failedRefresh.queries[pid] = time.Now()
+			_failedRefresh.Unlock()
+		}
+	}()
+}
+
+// IsRefreshing checks if given DAS query (qhash) is currently refreshing
+func IsRefreshing(qhash string) bool {
+	_refreshing.Lock()
+	defer _refreshing.Unlock()
+	return _refreshing.queries[qhash]
+}
+
+// helper function to mark query refresh as done
+func stopRefresh(qhash string) {
+	_refreshing.Lock()
+	defer _refreshing.Unlock()
+	delete(_refreshing.queries, qhash)
+}
+
+// helper function to get qhash of data records of given DAS query, after refresh
+// data records are stored under qhash of refresh request, see RefreshQuery
+func dataPid(pid string) string {
+	spec := bson.M{"qhash": pid, "das.record": 0}
+	recs, err := storage.DB.Get(storage.Merge, spec, 0, 1)
+	if err != nil || len(recs) == 0 {
+		return pid
+	}
+	if dpid, err := mongo.GetStringValue(recs[0], "das.data_qhash"); err == nil && dpid != "" {
+		return dpid
+	}
+	return pid
+}
+
+// helper function to create a copy of DAS query with new qhash
+func refreshQuery(dasquery dasql.DASQuery) dasql.DASQuery {
+	query := dasquery
+	spec := make(bson.M)
+	for k, v := range dasquery.Spec {
+		spec[k] = v
+	}
+	query.Spec = spec
+	data := []byte(fmt.Sprintf("%s-%d", dasquery.Qhash, time.Now().UnixNano()))
+	arr := md5.Sum(data)
+	query.Qhash = hex.EncodeToString(arr[:])
+	query.Priority = utils.FetchBackground
+	return query
+}
+
+// RefreshGracePeriod defines time we wait before removing old records after refresh
+var RefreshGracePeriod = 5 * time.Second
+
+// RefreshQuery re-processes given DAS query in background and swaps its
+// records once processing is done. New records are stored under new qhash
+// and DAS record of original query is updated to point to them (single
+// document update), therefore users never see empty cache.
+// It returns an error if refresh did not succeed, the old records are kept intact.
+func RefreshQuery(dasquery dasql.DASQuery, dmaps dasmaps.DASMaps) error {
+	// defer function profiler
+	defer utils.MeasureTime("das/RefreshQuery")()
+
+	pid := dasquery.Qhash
+	if !startRefresh(pid) {
+		return fmt.Errorf("query %s is already refreshing", pid)
+	}
+	defer stopRefresh(pid)
+	return refresh(dasquery, dmaps)
+}
+
+// helper function to refresh given DAS query, see RefreshQuery
+func refresh(dasquery dasql.DASQuery, dmaps dasmaps.DASMaps) error {
+	pid := dasquery.Qhash
+	query := refreshQuery(dasquery)
+	Process(query, dmaps)
+
+	// clean-up records of refresh request
+	cleanup := func(qhash string) {
+		spec := bson.M{"qhash": qhash}
+		storage.DB.Remove(storage.Cache, spec)
+		storage.DB.Remove(storage.Merge, spec)
+	}
+	spec := bson.M{"qhash": query.Qhash, "das.record": 0}
+	recs, err := storage.DB.Get(storage.Merge, spec, 0, 1)
+	if err != nil {
+		cleanup(query.Qhash)
+		return fmt.Errorf("unable to get DAS record for refresh of query %s, error %v", pid, err)
+	}
+	if len(recs) == 0 {
+		cleanup(query.Qhash)
+		return fmt.Errorf("no DAS record found for refresh of query %s", pid)
+	}
+	das, ok := recs[0]["das"].(mongo.DASRecord)
+	if !ok || das["status"] != "ok" {
+		cleanup(query.Qhash)
+		return fmt.Errorf("refresh of query %s did not succeed", pid)
+	}
+	// do not replace existing records with results of failed services
+	if errs := services.ServiceErrors(services.ServiceStates(recs[0])); len(errs) > 0 {
+		cleanup(query.Qhash)
+		var srvs []string
+		for _, rec := range errs {
+			srvs = append(srvs, fmt.Sprintf("%v", rec["service"]))
+		}
+		return fmt.Errorf("refresh of query %s failed, services %v", pid, srvs)
+	}
+
+	// swap records: point DAS record of original query to new data records
+	odpid := dataPid(pid)
+	das["data_qhash"] = query.Qhash
+	newdata := bson.M{"$set": bson.M{"das": das}}
+	spec = bson.M{"qhash": pid, "das.record": 0}
+	for _, coll := range []string{storage.Merge, storage.Cache} {
+		if err := storage.DB.Update(coll, spec, newdata); err != nil {
+			cleanup(query.Qhash)
+			return fmt.Errorf("unable to swap records of query %s, error %v", pid, err)
+		}
+	}
+
+	// remove DAS records of refresh request and old data records, we give
+	// some time to requests which may still read old data records
+	spec = bson.M{"qhash": query.Qhash, "das.record": 0}
+	storage.DB.Remove(storage.Cache, spec)
+	storage.DB.Remove(storage.Merge, spec)
+	time.Sleep(RefreshGracePeriod)
+	if odpid == pid {
+		// old data records are stored together with DAS record of original query
+		spec = bson.M{"qhash": pid, "das.record": 1}
+		storage.DB.Remove(storage.Cache, spec)
+		storage.DB.Remove(storage.Merge, spec)
+	} else {
+		cleanup(odpid)
+	}
+	return nil
+}
+
+// RefreshWorker periodically refreshes top N popular DAS queries shortly
+// (lead time) before their expiration using given number of concurrent refreshes
+func RefreshWorker(dmaps dasmaps.DASMaps, topN, concurrency int, lead, interval time.Duration) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	for {
+		time.Sleep(interval)
+		for _, p := range PopularQueries(topN) {
+			pid := p.Query.Qhash
+			if IsRefreshing(pid) {
+				continue
+			}
+			spec := bson.M{"qhash": pid, "das.record": 0, "das.status": "ok"}
+			recs, err := storage.DB.Get(storage.Merge, spec, 0, 1)
+			if err != nil || len(recs) == 0 {
+				continue
+			}
+			expire, err := mongo.GetInt64Value(recs[0], "das.expire")
+			if err != nil || time.Until(time.Unix(expire, 0)) > lead {
+				continue
+			}
+			sem <- struct{}{}
+			go func(dasquery dasql.DASQuery) {
+				defer func() { <-sem }()
+				if utils.VERBOSE > 0 {
+					log.Printf("refresh %v\n", dasquery)
+				}
+				if err := RefreshQuery(dasquery, dmaps); err != nil {
+					log.Printf("ERROR: unable to refresh %v, error %v\n", dasquery, err)
+				}
+			}(p.Query)
+		}
+	}
+}
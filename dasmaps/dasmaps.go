@@ -17,6 +17,7 @@ import (
 
 	"github.com/dmwm/das2go/dasql"
 	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/storage"
 	"github.com/dmwm/das2go/utils"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -213,6 +214,30 @@ func (m *DASMaps) PresentationMap() mongo.DASRecord {
 	return m.presentations
 }
 
+// DiffKeys provides list of keys (from presentation map "diff" lists) which
+// should be compared among services for given DAS entity, e.g. dataset
+func (m *DASMaps) DiffKeys(entity string) []string {
+	var out []string
+	rows, ok := m.PresentationMap()[entity].([]interface{})
+	if !ok {
+		return out
+	}
+	for _, row := range rows {
+		rec, ok := row.(mongo.DASRecord)
+		if !ok {
+			continue
+		}
+		if keys, ok := rec["diff"].([]interface{}); ok {
+			for _, key := range keys {
+				if k, ok := key.(string); ok {
+					out = append(out, k)
+				}
+			}
+		}
+	}
+	return out
+}
+
 // DASKeysMaps provides presentation map of DAS maps
 func (m *DASMaps) DASKeysMaps() []DASKeysMap {
 	if len(m.daskeysMaps) != 0 {
@@ -507,9 +532,14 @@ func (m *DASMaps) FindServices(dasquery dasql.DASQuery) []mongo.DASRecord {
 	return out
 }
 
-// LoadMaps loads DAS maps from given database collection
-func (m *DASMaps) LoadMaps(dbname, dbcoll string) {
-	m.records = mongo.Get(dbname, dbcoll, bson.M{}, 0, -1) // index=0, limit=-1
+// LoadMaps loads DAS maps from DAS storage
+func (m *DASMaps) LoadMaps() error {
+	records, err := storage.DB.Get(storage.Maps, bson.M{}, 0, -1) // index=0, limit=-1
+	if err != nil {
+		return err
+	}
+	m.records = records
+	return nil
 }
 
 // LoadMapsFromFile loads DAS maps from github or local file
@@ -619,13 +649,13 @@ func (m *DASMaps) ChangeUrl(old, pat string) {
 					continue
 				}
 				services := dmap["services"].(map[string]interface{})
-				newServices := make(map[string]string)
+				newServices := make(map[string]interface{})
 				for key, val := range services {
 					url := val.(string)
 					url = strings.Replace(url, old, pat, -1)
 					newServices[key] = url
 				}
-				dmap["services"] = services
+				dmap["services"] = newServices
 			}
 			records = append(records, dmap)
 		}
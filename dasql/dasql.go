@@ -36,6 +36,7 @@ type DASQuery struct {
 	Aggregators  [][]string          `json:"aggregators"`
 	Error        string              `json:"error"`
 	Time         int64               `json:"tstamp"`
+	Priority     utils.FetchPriority `json:"-"` // priority class of upstream calls of the query
 }
 
 // String method implements own formatter using DASQuery rather then *DASQuery, since
@@ -0,0 +1,234 @@
+package mock
+
+// DAS mock module, synthetic catalogue of CMS data
+// The catalogue consists of few datasets (RAW datasets and their AOD
+// children), their blocks, files, runs, lumis and block replicas at sites.
+// All CMS data-services emulated by mock server are served from it, which
+// keeps their answers consistent with each other.
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash/adler32"
+	"strings"
+)
+
+// catalogTime is creation time (2024-01-01) of all catalogue entries
+const catalogTime = 1704067200
+
+// EventsPerLumi defines number of events in every lumi section of the catalogue
+const EventsPerLumi = 100
+
+// Dataset represents dataset of the catalogue
+type Dataset struct {
+	Name         string
+	PrimaryDS    string
+	ProcessedDS  string
+	Tier         string
+	Era          string
+	ProcVersion  int
+	Type         string // data or mc
+	Release      string
+	GlobalTag    string
+	PhysicsGroup string
+	AccessType   string
+	PrepID       string
+	Parent       string
+	ID           int64
+}
+
+// Block represents block of the catalogue
+type Block struct {
+	Name    string
+	Dataset string
+	Parent  string
+	Sites   []string // sites which hold block replicas, first one is origin site
+	ID      int64
+}
+
+// File represents file of the catalogue
+type File struct {
+	Name    string
+	Block   string
+	Dataset string
+	Parent  string
+	Run     int64
+	Lumis   []int64
+	Size    int64
+	ID      int64
+}
+
+// Events returns number of events in a file
+func (f File) Events() int64 {
+	return int64(len(f.Lumis)) * EventsPerLumi
+}
+
+// Adler32 returns (synthetic) adler32 checksum of a file
+func (f File) Adler32() string {
+	return fmt.Sprintf("%08x", adler32.Checksum([]byte(f.Name)))
+}
+
+// Run represents run of the catalogue
+type Run struct {
+	Number        int64
+	Start         int64 // unix time
+	Stop          int64 // unix time
+	Lumis         int64
+	DeliveredLumi float64
+}
+
+// Catalog represents synthetic catalogue of CMS data
+type Catalog struct {
+	Sites    []string
+	Datasets []Dataset
+	Blocks   []Block
+	Files    []File
+	Runs     []Run
+}
+
+// NewCatalog creates catalogue with two primary datasets, every primary
+// dataset has RAW dataset and its AOD child, every dataset has two blocks
+// (one per run) with three files of ten lumis each
+func NewCatalog() *Catalog {
+	c := &Catalog{Sites: []string{"T1_US_FNAL_Disk", "T2_CH_CERN", "T2_DE_DESY"}}
+	var id int64
+	for p := 1; p <= 2; p++ {
+		primary := fmt.Sprintf("MockPrimary%d", p)
+		raw := Dataset{
+			Name:        fmt.Sprintf("/%s/MockEra2024-v1/RAW", primary),
+			PrimaryDS:   primary,
+			ProcessedDS: "MockEra2024-v1",
+			Tier:        "RAW",
+			Release:     "CMSSW_13_0_0",
+			GlobalTag:   "130X_dataRun3_HLT_v1",
+		}
+		aod := Dataset{
+			Name:        fmt.Sprintf("/%s/MockEra2024-PromptReco-v1/AOD", primary),
+			PrimaryDS:   primary,
+			ProcessedDS: "MockEra2024-PromptReco-v1",
+			Tier:        "AOD",
+			Release:     "CMSSW_13_0_3",
+			GlobalTag:   "130X_dataRun3_Prompt_v1",
+			PrepID:      fmt.Sprintf("MOCK-MockEra2024-%05d", p),
+			Parent:      raw.Name,
+		}
+		for _, d := range []Dataset{raw, aod} {
+			id++
+			d.Era = "MockEra2024"
+			d.ProcVersion = 1
+			d.Type = "data"
+			d.PhysicsGroup = "NoGroup"
+			d.AccessType = "VALID"
+			d.ID = id
+			c.Datasets = append(c.Datasets, d)
+			for b := 0; b < 2; b++ {
+				run := int64(370000 + 100*p + b)
+				blk := Block{Name: fmt.Sprintf("%s#%08d-0000-4000-8000-%012d", d.Name, p, b), Dataset: d.Name, ID: d.ID*10 + int64(b)}
+				if d.Parent != "" {
+					blk.Parent = fmt.Sprintf("%s#%08d-0000-4000-8000-%012d", d.Parent, p, b)
+				}
+				blk.Sites = c.blockSites(d.Tier, b)
+				c.Blocks = append(c.Blocks, blk)
+				for f := 0; f < 3; f++ {
+					file := File{Block: blk.Name, Dataset: d.Name, Run: run, ID: blk.ID*10 + int64(f)}
+					file.Name = lfn(d, run, f)
+					if d.Parent != "" {
+						file.Parent = lfn(c.Datasets[len(c.Datasets)-2], run, f)
+					}
+					for l := 1; l <= 10; l++ {
+						file.Lumis = append(file.Lumis, int64(10*f+l))
+					}
+					file.Size = file.Events() * 1000 * int64(len(d.Tier))
+					c.Files = append(c.Files, file)
+				}
+			}
+		}
+	}
+	// runs are shared by datasets of the same primary dataset
+	for p := 1; p <= 2; p++ {
+		for b := 0; b < 2; b++ {
+			c.Runs = append(c.Runs, newRun(int64(370000+100*p+b)))
+		}
+	}
+	return c
+}
+
+// helper function to define sites of block replicas
+func (c *Catalog) blockSites(tier string, idx int) []string {
+	if tier == "RAW" {
+		return []string{c.Sites[0]}
+	}
+	if idx == 0 {
+		return []string{c.Sites[1], c.Sites[0]}
+	}
+	return []string{c.Sites[2]}
+}
+
+// helper function to construct name of a file
+func lfn(d Dataset, run int64, idx int) string {
+	return fmt.Sprintf("/store/data/%s/%s/%s/v%d/000/%03d/%03d/00000/%s.root", d.Era, d.PrimaryDS, d.Tier, d.ProcVersion, run/1000, run%1000, uuid(fmt.Sprintf("%s-%d-%d", d.Name, run, idx)))
+}
+
+// helper function to create (deterministic) uuid from given string
+func uuid(s string) string {
+	h := md5.Sum([]byte(s))
+	v := strings.ToUpper(hex.EncodeToString(h[:]))
+	return fmt.Sprintf("%s-%s-%s-%s-%s", v[0:8], v[8:12], v[12:16], v[16:20], v[20:32])
+}
+
+// helper function to create run with given number
+func newRun(num int64) Run {
+	start := catalogTime + (num%1000)*3600
+	return Run{Number: num, Start: start, Stop: start + 1800, Lumis: 30, DeliveredLumi: float64(num%1000) * 1.5}
+}
+
+// Dataset returns dataset with given name
+func (c *Catalog) Dataset(name string) (Dataset, bool) {
+	for _, d := range c.Datasets {
+		if d.Name == name {
+			return d, true
+		}
+	}
+	return Dataset{}, false
+}
+
+// Block returns block with given name
+func (c *Catalog) Block(name string) (Block, bool) {
+	for _, b := range c.Blocks {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return Block{}, false
+}
+
+// BlockFiles returns files of given block
+func (c *Catalog) BlockFiles(name string) []File {
+	var out []File
+	for _, f := range c.Files {
+		if f.Block == name {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// BlockSize returns size of given block
+func (c *Catalog) BlockSize(name string) int64 {
+	var size int64
+	for _, f := range c.BlockFiles(name) {
+		size += f.Size
+	}
+	return size
+}
+
+// Run returns run with given number
+func (c *Catalog) Run(num int64) (Run, bool) {
+	for _, r := range c.Runs {
+		if r.Number == num {
+			return r, true
+		}
+	}
+	return Run{}, false
+}
@@ -0,0 +1,48 @@
+package main
+
+// das2go_mock runs mock server of CMS data-services used by DAS, see mock
+// package. To use it with DAS server point urlRewrites of DAS configuration
+// to mock server, e.g.
+//
+//	das2go_mock -port 8300
+//
+// Rucio x509 authentication requires TLS, i.e. server certificate and key
+// given by -cert and -key options, clients present their X509 certificates.
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/dmwm/das2go/mock"
+)
+
+func main() {
+	var port int
+	flag.IntVar(&port, "port", 8300, "port number of mock server")
+	var verbose int
+	flag.IntVar(&verbose, "verbose", 0, "verbosity level")
+	var cert string
+	flag.StringVar(&cert, "cert", "", "server certificate, mock server uses TLS if it is set")
+	var key string
+	flag.StringVar(&key, "key", "", "server key")
+	flag.Parse()
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	mock.VERBOSE = verbose
+
+	catalog := mock.NewCatalog()
+	log.Printf("mock catalogue: %d datasets, %d blocks, %d files, %d runs, sites %v\n", len(catalog.Datasets), len(catalog.Blocks), len(catalog.Files), len(catalog.Runs), catalog.Sites)
+	for _, d := range catalog.Datasets {
+		log.Println("dataset", d.Name)
+	}
+	addr := fmt.Sprintf(":%d", port)
+	log.Printf("start mock server on %s\n", addr)
+	if cert != "" {
+		// client certificates are requested (but not verified) for Rucio x509 authentication
+		server := &http.Server{Addr: addr, Handler: mock.Handler(catalog), TLSConfig: &tls.Config{ClientAuth: tls.RequestClientCert}}
+		log.Fatal(server.ListenAndServeTLS(cert, key))
+	}
+	log.Fatal(http.ListenAndServe(addr, mock.Handler(catalog)))
+}
@@ -0,0 +1,424 @@
+package mock
+
+// DAS mock module, DBS emulation
+// DBS APIs are served from flat view of the catalogue (one row per file with
+// attributes of its dataset, block and run). DBS-style filters, i.e. query or
+// POST parameters which match attributes of the view (with * patterns, run
+// ranges and lumi lists), select rows of the view and every API projects
+// selected rows to its own (distinct) records.
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dmwm/das2go/utils"
+)
+
+// row represents row of DBS view of the catalogue
+type row map[string]interface{}
+
+// dbsView defines how DBS API projects rows of DBS view
+type dbsView struct {
+	fields []string          // fields of API records
+	from   map[string]string // field of DBS view of API record field, by default the same
+	brief  []string          // fields of API records without detail flag
+	params map[string]string // field of DBS view of API parameter, by default the same
+	needs  string            // field of DBS view which must be set, e.g. parent of a dataset
+}
+
+var datasetFields = []string{"dataset", "primary_ds_name", "processed_ds_name", "data_tier_name", "primary_ds_type", "acquisition_era_name", "processing_version", "physics_group_name", "dataset_access_type", "prep_id", "xtcrosssection", "dataset_id", "creation_date", "create_by", "last_modification_date", "last_modified_by"}
+var blockFields = []string{"block_name", "dataset", "origin_site_name", "open_for_writing", "block_size", "file_count", "block_id", "creation_date", "create_by", "last_modification_date", "last_modified_by"}
+var fileFields = []string{"logical_file_name", "block_name", "dataset", "file_size", "event_count", "file_type", "is_file_valid", "check_sum", "adler32", "md5", "file_id", "branch_hash_id", "auto_cross_section", "creation_date", "create_by", "last_modification_date", "last_modified_by"}
+
+// dbsViews defines projections of DBS APIs
+var dbsViews = map[string]dbsView{
+	"datasets":        {fields: datasetFields, brief: []string{"dataset"}},
+	"datasetlist":     {fields: datasetFields, brief: []string{"dataset"}},
+	"blocks":          {fields: blockFields, brief: []string{"block_name"}},
+	"files":           {fields: fileFields, brief: []string{"logical_file_name"}},
+	"runs":            {fields: []string{"run_num"}},
+	"blockorigin":     {fields: []string{"block_name", "dataset", "origin_site_name", "create_by", "creation_date"}},
+	"outputconfigs":   {fields: []string{"app_name", "release_version", "pset_hash", "global_tag", "output_module_label", "create_by", "creation_date"}},
+	"datatiers":       {fields: []string{"data_tier_name", "creation_date", "create_by"}},
+	"datatypes":       {fields: []string{"data_type"}, from: map[string]string{"data_type": "primary_ds_type"}},
+	"primarydatasets": {fields: []string{"primary_ds_name", "primary_ds_type", "primary_ds_id", "creation_date", "create_by"}},
+	"physicsgroups":   {fields: []string{"physics_group_name"}},
+	"acquisitioneras": {fields: []string{"acquisition_era_name", "start_date", "end_date", "description", "creation_date", "create_by"}},
+	"runsummaries":    {fields: []string{"run_num", "max_lumi"}},
+	"datasetparents": {
+		fields: []string{"this_dataset", "parent_dataset", "parent_dataset_id"},
+		from:   map[string]string{"this_dataset": "dataset"},
+		needs:  "parent_dataset",
+	},
+	"datasetchildren": {
+		fields: []string{"dataset", "child_dataset", "child_dataset_id"},
+		from:   map[string]string{"dataset": "parent_dataset", "child_dataset": "dataset", "child_dataset_id": "dataset_id"},
+		params: map[string]string{"dataset": "parent_dataset"},
+		needs:  "parent_dataset",
+	},
+	"blockparents": {
+		fields: []string{"this_block_name", "parent_block_name"},
+		from:   map[string]string{"this_block_name": "block_name"},
+		needs:  "parent_block_name",
+	},
+	"blockchildren": {
+		fields: []string{"block_name"},
+		params: map[string]string{"block_name": "parent_block_name"},
+		needs:  "parent_block_name",
+	},
+	"fileparents": {
+		fields: []string{"logical_file_name", "parent_logical_file_name", "parent_file_id"},
+		needs:  "parent_logical_file_name",
+	},
+	"filechildren": {
+		fields: []string{"logical_file_name", "child_logical_file_name", "child_file_id"},
+		from:   map[string]string{"logical_file_name": "parent_logical_file_name", "child_logical_file_name": "logical_file_name", "child_file_id": "file_id"},
+		params: map[string]string{"logical_file_name": "parent_logical_file_name"},
+		needs:  "parent_logical_file_name",
+	},
+}
+
+// dbsAliases defines fields of DBS view of API parameters which differ from field names
+var dbsAliases = map[string]string{
+	"era":           "acquisition_era_name",
+	"release":       "release_version",
+	"validFileOnly": "is_file_valid",
+	"data_type":     "primary_ds_type",
+	"primary_ds":    "primary_ds_name",
+}
+
+// helper function to create DBS view of the catalogue
+func (c *Catalog) dbsRows() []row {
+	var rows []row
+	for _, f := range c.Files {
+		d, _ := c.Dataset(f.Dataset)
+		b, _ := c.Block(f.Block)
+		r, _ := c.Run(f.Run)
+		blockFiles := c.BlockFiles(b.Name)
+		rec := row{
+			"dataset":                  d.Name,
+			"dataset_id":               d.ID,
+			"primary_ds_name":          d.PrimaryDS,
+			"primary_ds_type":          d.Type,
+			"primary_ds_id":            primaryID(d.PrimaryDS),
+			"processed_ds_name":        d.ProcessedDS,
+			"data_tier_name":           d.Tier,
+			"acquisition_era_name":     d.Era,
+			"processing_version":       d.ProcVersion,
+			"physics_group_name":       d.PhysicsGroup,
+			"dataset_access_type":      d.AccessType,
+			"prep_id":                  d.PrepID,
+			"xtcrosssection":           nil,
+			"release_version":          d.Release,
+			"global_tag":               d.GlobalTag,
+			"app_name":                 "cmsRun",
+			"pset_hash":                fmt.Sprintf("%x", md5.Sum([]byte(d.Release+d.GlobalTag))),
+			"output_module_label":      "output",
+			"start_date":               catalogTime,
+			"end_date":                 0,
+			"description":              "mock acquisition era",
+			"block_name":               b.Name,
+			"block_id":                 b.ID,
+			"origin_site_name":         b.Sites[0],
+			"open_for_writing":         0,
+			"block_size":               c.BlockSize(b.Name),
+			"file_count":               len(blockFiles),
+			"logical_file_name":        f.Name,
+			"file_id":                  f.ID,
+			"file_size":                f.Size,
+			"event_count":              f.Events(),
+			"file_type":                "EDM",
+			"is_file_valid":            1,
+			"check_sum":                fmt.Sprintf("%d", f.Size%1000003),
+			"adler32":                  f.Adler32(),
+			"md5":                      "NOTSET",
+			"branch_hash_id":           nil,
+			"auto_cross_section":       0.0,
+			"run_num":                  f.Run,
+			"lumi_section_num":         f.Lumis,
+			"max_lumi":                 r.Lumis,
+			"creation_date":            catalogTime,
+			"create_by":                "/DC=ch/DC=cern/OU=computers/CN=mock",
+			"last_modification_date":   catalogTime,
+			"last_modified_by":         "/DC=ch/DC=cern/OU=computers/CN=mock",
+			"parent_dataset":           nil,
+			"parent_dataset_id":        nil,
+			"parent_block_name":        nil,
+			"parent_logical_file_name": nil,
+			"parent_file_id":           nil,
+		}
+		if p, ok := c.Dataset(d.Parent); ok {
+			rec["parent_dataset"] = p.Name
+			rec["parent_dataset_id"] = p.ID
+		}
+		if b.Parent != "" {
+			rec["parent_block_name"] = b.Parent
+		}
+		for _, pf := range c.Files {
+			if pf.Name == f.Parent {
+				rec["parent_logical_file_name"] = pf.Name
+				rec["parent_file_id"] = pf.ID
+			}
+		}
+		rows = append(rows, rec)
+	}
+	return rows
+}
+
+// helper function to create (synthetic) id of primary dataset
+func primaryID(name string) int64 {
+	v, _ := strconv.ParseInt(strings.TrimPrefix(name, "MockPrimary"), 10, 64)
+	return v
+}
+
+// helper function to convert glob pattern, e.g. /a*/b/*, to regular expression
+func globPattern(pat string) *regexp.Regexp {
+	pat = regexp.QuoteMeta(pat)
+	pat = strings.Replace(pat, "\\*", ".*", -1)
+	pat = strings.Replace(pat, "%", ".*", -1)
+	return regexp.MustCompile("^" + pat + "$")
+}
+
+// helper function to parse list of integers and integer ranges, e.g. [1,2], 1-10 or 5
+func parseRanges(val string) [][2]int64 {
+	var out [][2]int64
+	val = strings.Trim(val, "[]")
+	for _, item := range strings.Split(val, ",") {
+		item = strings.Trim(strings.TrimSpace(item), "'\"")
+		if item == "" {
+			continue
+		}
+		arr := strings.SplitN(item, "-", 2)
+		min, err := strconv.ParseInt(strings.TrimSpace(arr[0]), 10, 64)
+		if err != nil {
+			continue
+		}
+		max := min
+		if len(arr) == 2 {
+			if v, err := strconv.ParseInt(strings.TrimSpace(arr[1]), 10, 64); err == nil {
+				max = v
+			}
+		}
+		out = append(out, [2]int64{min, max})
+	}
+	return out
+}
+
+// helper function to check if integer belongs to one of the ranges
+func inRanges(v int64, ranges [][2]int64) bool {
+	for _, r := range ranges {
+		if v >= r[0] && v <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to check if field of a row matches one of given values
+func matchField(key string, field interface{}, values []string) bool {
+	for _, val := range values {
+		switch key {
+		case "run_num":
+			if inRanges(field.(int64), parseRanges(val)) {
+				return true
+			}
+		case "lumi_section_num":
+			ranges := parseRanges(val)
+			for _, lumi := range field.([]int64) {
+				if inRanges(lumi, ranges) {
+					return true
+				}
+			}
+		default:
+			if field == nil {
+				continue
+			}
+			if globPattern(val).MatchString(fmt.Sprintf("%v", field)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// helper function to select rows which match given parameters, parameters
+// which do not match fields of DBS view (e.g. detail) are ignored
+func selectRows(rows []row, params map[string][]string, view dbsView) []row {
+	filters := make(map[string][]string)
+	for key, vals := range params {
+		if v, ok := view.params[key]; ok {
+			key = v
+		} else if v, ok := dbsAliases[key]; ok {
+			key = v
+		}
+		if key == "lumi_list" {
+			key = "lumi_section_num"
+		}
+		if len(rows) == 0 {
+			break
+		}
+		if _, ok := rows[0][key]; !ok {
+			continue
+		}
+		if key == "is_file_valid" {
+			// validFileOnly=0 means all files
+			if len(vals) > 0 && vals[0] == "0" {
+				continue
+			}
+			vals = []string{"1"}
+		}
+		filters[key] = append(filters[key], vals...)
+	}
+	var out []row
+	for _, r := range rows {
+		match := true
+		for key, vals := range filters {
+			if !matchField(key, r[key], vals) {
+				match = false
+				break
+			}
+		}
+		if match && (view.needs == "" || r[view.needs] != nil) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+// helper function to project rows to distinct records of given view
+func project(rows []row, view dbsView, detail bool) []row {
+	fields := view.fields
+	if !detail && len(view.brief) > 0 {
+		fields = view.brief
+	}
+	var out []row
+	seen := make(map[string]bool)
+	for _, r := range rows {
+		rec := make(row)
+		for _, key := range fields {
+			src := key
+			if v, ok := view.from[key]; ok {
+				src = v
+			}
+			rec[key] = r[src]
+		}
+		data, _ := json.Marshal(rec)
+		if seen[string(data)] {
+			continue
+		}
+		seen[string(data)] = true
+		out = append(out, rec)
+	}
+	return out
+}
+
+// helper function to parse parameters of DBS request, POST request provides
+// them as JSON object
+func dbsParams(r *http.Request) (map[string][]string, error) {
+	params := make(map[string][]string)
+	for key, vals := range r.URL.Query() {
+		params[key] = vals
+	}
+	if r.Method != "POST" {
+		return params, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return params, err
+	}
+	var spec map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&spec); err != nil {
+		return params, err
+	}
+	for key, val := range spec {
+		switch v := val.(type) {
+		case []interface{}:
+			for _, item := range v {
+				params[key] = append(params[key], fmt.Sprintf("%v", item))
+			}
+		default:
+			params[key] = append(params[key], fmt.Sprintf("%v", v))
+		}
+	}
+	return params, nil
+}
+
+// helper function to check if detail flag is set in request parameters
+func detailFlag(params map[string][]string) bool {
+	for _, v := range params["detail"] {
+		switch strings.ToLower(v) {
+		case "1", "true":
+			return true
+		}
+	}
+	return false
+}
+
+// DBSHandler serves DBS APIs, i.e. /dbs/<instance>/DBSReader/<api>
+func (c *Catalog) DBSHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	arr := strings.Split(path, "/")
+	api := arr[len(arr)-1]
+	params, err := dbsParams(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("unable to parse parameters, error %v", err))
+		return
+	}
+	var out []row
+	rows := c.dbsRows()
+	switch api {
+	case "filelumis":
+		for _, rec := range selectRows(rows, params, dbsView{}) {
+			ranges := parseRanges(strings.Join(params["lumi_list"], ","))
+			for _, lumi := range rec["lumi_section_num"].([]int64) {
+				if len(ranges) > 0 && !inRanges(lumi, ranges) {
+					continue
+				}
+				out = append(out, row{"logical_file_name": rec["logical_file_name"], "run_num": rec["run_num"], "lumi_section_num": lumi, "event_count": EventsPerLumi})
+			}
+		}
+	case "filesummaries":
+		rows = selectRows(rows, params, dbsView{})
+		if len(rows) > 0 {
+			var size, events, lumis int64
+			blocks := make(map[interface{}]bool)
+			for _, rec := range rows {
+				size += rec["file_size"].(int64)
+				events += rec["event_count"].(int64)
+				lumis += int64(len(rec["lumi_section_num"].([]int64)))
+				blocks[rec["block_name"]] = true
+			}
+			out = append(out, row{"num_file": len(rows), "num_event": events, "num_lumi": lumis, "num_block": len(blocks), "file_size": size, "max_ldate": catalogTime, "median_cdate": catalogTime, "median_ldate": catalogTime})
+		}
+	case "releaseversions":
+		var releases []string
+		for _, rec := range selectRows(rows, params, dbsView{}) {
+			if v := rec["release_version"].(string); !utils.InList(v, releases) {
+				releases = append(releases, v)
+			}
+		}
+		out = append(out, row{"release_version": releases})
+	case "datasetaccesstypes":
+		out = append(out, row{"dataset_access_type": []string{"VALID", "INVALID", "PRODUCTION", "DEPRECATED", "DELETED"}})
+	default:
+		view, ok := dbsViews[api]
+		if !ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unsupported DBS API %s", api))
+			return
+		}
+		out = project(selectRows(rows, params, view), view, detailFlag(params))
+	}
+	if out == nil {
+		out = []row{}
+	}
+	writeJSON(w, out)
+}
@@ -0,0 +1,226 @@
+package mock
+
+// DAS mock module, Rucio emulation
+// CMS datasets, blocks and files are represented in Rucio as containers,
+// datasets and files of cms scope, block replicas define replicas of their
+// files. Records are streamed as application/x-json-stream (one JSON record
+// per line) unless client accepts only application/json.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dmwm/das2go/utils"
+)
+
+// RucioToken is authentication token issued by mock Rucio server
+const RucioToken = "das-mock-token"
+
+// helper function to find blocks of given Rucio did (container, dataset or file)
+func (c *Catalog) didBlocks(name string) ([]Block, string) {
+	if strings.HasPrefix(name, "/store/") {
+		for _, f := range c.Files {
+			if f.Name == name {
+				b, _ := c.Block(f.Block)
+				return []Block{b}, "FILE"
+			}
+		}
+		return nil, ""
+	}
+	if strings.Contains(name, "#") {
+		if b, ok := c.Block(name); ok {
+			return []Block{b}, "DATASET"
+		}
+		return nil, ""
+	}
+	var out []Block
+	for _, b := range c.Blocks {
+		if b.Dataset == name {
+			out = append(out, b)
+		}
+	}
+	return out, "CONTAINER"
+}
+
+// helper function to create Rucio record of block replica
+func (c *Catalog) blockReplica(b Block, rse string) row {
+	size := c.BlockSize(b.Name)
+	nfiles := len(c.BlockFiles(b.Name))
+	return row{"scope": "cms", "name": b.Name, "rse": rse, "state": "AVAILABLE", "length": nfiles, "available_length": nfiles, "bytes": size, "available_bytes": size, "created_at": rucioTime(catalogTime), "updated_at": rucioTime(catalogTime)}
+}
+
+// helper function to create Rucio record of file replicas, only replicas at
+// given rse are included unless rse is empty
+func fileReplica(f File, b Block, rse string) row {
+	states := make(map[string]string)
+	rses := make(map[string][]string)
+	for _, site := range b.Sites {
+		if rse != "" && site != rse {
+			continue
+		}
+		states[site] = "AVAILABLE"
+		rses[site] = []string{fmt.Sprintf("davs://%s.mock.cern.ch:1094%s", strings.ToLower(site), f.Name)}
+	}
+	return row{"scope": "cms", "name": f.Name, "bytes": f.Size, "adler32": f.Adler32(), "md5": nil, "states": states, "rses": rses, "pfns": map[string]interface{}{}}
+}
+
+// helper function to format time as Rucio does
+func rucioTime(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.RFC1123)
+}
+
+// helper function to split Rucio did path, e.g. MockPrimary1/MockEra2024-v1/RAW/dids,
+// into CMS name and Rucio method
+func didPath(path string, methods ...string) (string, string) {
+	path = strings.TrimRight(path, "/")
+	var method string
+	for _, m := range methods {
+		if strings.HasSuffix(path, "/"+m) {
+			method = m
+			path = strings.TrimSuffix(path, "/"+m)
+			break
+		}
+	}
+	return "/" + strings.TrimLeft(path, "/"), method
+}
+
+// RucioHandler serves Rucio APIs used by DAS
+func (c *Catalog) RucioHandler(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	var out []row
+	switch {
+	case strings.HasPrefix(path, "/auth/"):
+		var fail string
+		switch path {
+		case "/auth/userpass":
+			if r.Header.Get("X-Rucio-Username") == "" || r.Header.Get("X-Rucio-Password") == "" {
+				fail = "Cannot authenticate with given credentials"
+			}
+		case "/auth/validate":
+			if r.Header.Get("X-Rucio-Auth-Token") == "" {
+				fail = "Cannot authenticate to account das with given token"
+			}
+		case "/auth/x509", "/auth/x509_proxy":
+			// client certificate is only available over TLS, see das2go_mock -cert and -key options
+			if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+				fail = "Cannot get DN from client certificate"
+			}
+		}
+		if fail != "" {
+			w.Header().Set("ExceptionClass", "CannotAuthenticate")
+			w.Header().Set("ExceptionMessage", fail)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(row{"ExceptionClass": "CannotAuthenticate", "ExceptionMessage": fail})
+			return
+		}
+		if path == "/auth/validate" {
+			writeJSON(w, row{"account": "das", "identity": "mock", "lifetime": rucioTime(time.Now().Add(time.Hour).Unix())})
+			return
+		}
+		w.Header().Set("X-Rucio-Auth-Token", RucioToken)
+		w.Header().Set("X-Rucio-Auth-Token-Expires", time.Now().Add(time.Hour).UTC().Format(time.RFC1123))
+		w.WriteHeader(http.StatusOK)
+		return
+	case strings.HasPrefix(path, "/accounts"):
+		out = append(out, row{"account": "das", "type": "SERVICE", "email": "das@mock.cern.ch"})
+	case strings.HasPrefix(path, "/rses"):
+		for _, site := range c.Sites {
+			out = append(out, row{"id": uuid(site), "rse": site, "rse_type": "DISK", "deterministic": true, "volatile": false, "availability": 7})
+		}
+	case strings.HasPrefix(path, "/replicas/rse/"):
+		rse := strings.Trim(strings.TrimPrefix(path, "/replicas/rse/"), "/")
+		for _, b := range c.Blocks {
+			if utils.InList(rse, b.Sites) {
+				out = append(out, c.blockReplica(b, rse))
+			}
+		}
+	case path == "/replicas/list" && r.Method == "POST":
+		var spec struct {
+			DIDs []map[string]string `json:"dids"`
+			RSE  string              `json:"rse"`
+		}
+		body, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = json.Unmarshal(body, &spec)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unable to parse request, error %v", err))
+			return
+		}
+		for _, did := range spec.DIDs {
+			blocks, _ := c.didBlocks(did["name"])
+			for _, b := range blocks {
+				if spec.RSE != "" && !utils.InList(spec.RSE, b.Sites) {
+					continue
+				}
+				for _, f := range c.BlockFiles(b.Name) {
+					out = append(out, fileReplica(f, b, spec.RSE))
+				}
+			}
+		}
+	case strings.HasPrefix(path, "/replicas/cms/"):
+		name, method := didPath(strings.TrimPrefix(path, "/replicas/cms/"), "datasets")
+		blocks, dtype := c.didBlocks(name)
+		for _, b := range blocks {
+			if method == "datasets" {
+				for _, rse := range b.Sites {
+					out = append(out, c.blockReplica(b, rse))
+				}
+				continue
+			}
+			for _, f := range c.BlockFiles(b.Name) {
+				if dtype == "FILE" && f.Name != name {
+					continue
+				}
+				out = append(out, fileReplica(f, b, ""))
+			}
+		}
+	case strings.HasPrefix(path, "/dids/cms/"):
+		name, method := didPath(strings.TrimPrefix(path, "/dids/cms/"), "dids", "rules")
+		blocks, dtype := c.didBlocks(name)
+		switch method {
+		case "dids":
+			for _, b := range blocks {
+				if dtype == "CONTAINER" {
+					out = append(out, row{"scope": "cms", "name": b.Name, "type": "DATASET", "bytes": c.BlockSize(b.Name), "length": len(c.BlockFiles(b.Name))})
+				}
+			}
+		case "rules":
+			var sites []string
+			for _, b := range blocks {
+				for _, site := range b.Sites {
+					if !utils.InList(site, sites) {
+						sites = append(sites, site)
+					}
+				}
+			}
+			for _, site := range sites {
+				out = append(out, row{"id": strings.ToLower(strings.Replace(uuid(name+site), "-", "", -1)), "scope": "cms", "name": name, "did_type": dtype, "account": "das", "rse_expression": site, "copies": 1, "state": "OK", "grouping": "DATASET", "expires_at": nil, "created_at": rucioTime(catalogTime)})
+			}
+		default:
+			writeError(w, http.StatusNotFound, fmt.Sprintf("unsupported Rucio API %s", path))
+			return
+		}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unsupported Rucio API %s", path))
+		return
+	}
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/json") && !strings.Contains(accept, "application/x-json-stream") {
+		if out == nil {
+			out = []row{}
+		}
+		writeJSON(w, out)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-json-stream")
+	enc := json.NewEncoder(w)
+	for _, rec := range out {
+		enc.Encode(rec)
+	}
+}
@@ -0,0 +1,79 @@
+package mock
+
+// DAS mock module, mock server of CMS data-services
+// It emulates DBS, Rucio, ReqMgr2, McM, CondDB, RunRegistry and CRIC
+// endpoints used by DAS. Services which DAS identifies by their host name
+// (Rucio, CondDB and CRIC) are served under /rucio, /conddb and /cric
+// prefixes, while others are served under their own paths, e.g.
+//
+//	http://localhost:8300/dbs/prod/global/DBSReader/datasets?dataset=/MockPrimary1/*/*
+//	http://localhost:8300/rucio/replicas/cms/MockPrimary1/MockEra2024-v1/RAW/datasets
+//	http://localhost:8300/reqmgr2/data/request?outputdataset=/MockPrimary1/MockEra2024-PromptReco-v1/AOD
+//	http://localhost:8300/mcm/public/restapi/requests/get/MOCK-MockEra2024-00001
+//	http://localhost:8300/conddb/getLumi/?Runs=370101
+//	http://localhost:8300/runregistry/api/GLOBAL/runsummary/json/number/none/data
+//	http://localhost:8300/cric/api/cms/site/query?json&preset=site-names
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// VERBOSE controls verbosity level of mock server
+var VERBOSE int
+
+// route represents path prefix of a service and its handler
+type route struct {
+	prefix  string
+	strip   bool // strip prefix from request path
+	handler func(http.ResponseWriter, *http.Request)
+}
+
+// Handler returns http handler of mock server which serves given catalogue.
+// Request paths are matched by their prefixes without path cleaning since
+// names of CMS datasets and files start with a slash.
+func Handler(c *Catalog) http.Handler {
+	routes := []route{
+		{"/dbs/", false, c.DBSHandler},
+		{"/rucio", true, c.RucioHandler},
+		{"/reqmgr2/data/request", false, c.ReqMgrHandler},
+		{"/couchdb/reqmgr_config_cache/", false, c.ConfigCacheHandler},
+		{"/mcm/public/restapi/requests/", false, c.McMHandler},
+		{"/conddb/getLumi", false, c.CondDBHandler},
+		{"/runregistry/", false, c.RunRegistryHandler},
+		{"/cric", true, c.CRICHandler},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if VERBOSE > 0 {
+			log.Printf("%s %s\n", r.Method, r.URL.String())
+		}
+		for _, rt := range routes {
+			if !strings.HasPrefix(r.URL.Path, rt.prefix) {
+				continue
+			}
+			if rt.strip {
+				r.URL.Path = strings.TrimPrefix(r.URL.Path, rt.prefix)
+			}
+			rt.handler(w, r)
+			return
+		}
+		writeError(w, http.StatusNotFound, "unsupported API "+r.URL.Path)
+	})
+}
+
+// helper function to write JSON response
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Printf("ERROR: unable to write response, error %v\n", err)
+	}
+}
+
+// helper function to write error response
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(row{"error": msg, "code": code})
+}
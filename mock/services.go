@@ -0,0 +1,338 @@
+package mock
+
+// DAS mock module, emulation of ReqMgr2, McM, CondDB, RunRegistry and CRIC
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// helper function to create ReqMgr2 request which produced given dataset
+func (c *Catalog) request(d Dataset) (string, row) {
+	name := fmt.Sprintf("mock_%s_%s_240101_000000_%04d", d.ProcessedDS, d.PrimaryDS, d.ID)
+	return name, row{
+		"RequestName":    name,
+		"RequestType":    "ReReco",
+		"RequestStatus":  "announced",
+		"PrepID":         d.PrepID,
+		"InputDatasets":  []string{d.Parent},
+		"OutputDatasets": []string{d.Name},
+		"CMSSWVersion":   d.Release,
+		"GlobalTag":      d.GlobalTag,
+		"ConfigCacheID":  configID(d.Name),
+		"Campaign":       d.Era,
+		"RequestDate":    []int{2024, 1, 1, 0, 0, 0},
+	}
+}
+
+// helper function to create ReqMgr2 config cache id of given dataset
+func configID(dataset string) string {
+	h := md5.Sum([]byte("config" + dataset))
+	return hex.EncodeToString(h[:])
+}
+
+// ReqMgrHandler serves ReqMgr2 request API, i.e. /reqmgr2/data/request
+func (c *Catalog) ReqMgrHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/reqmgr2/data/request"), "/")
+	requests := make(row)
+	for _, d := range c.Datasets {
+		if d.Parent == "" {
+			continue // requests produce AOD datasets from RAW ones
+		}
+		rname, req := c.request(d)
+		switch {
+		case name != "" && name != rname && name != d.PrepID:
+		case query.Get("outputdataset") != "" && query.Get("outputdataset") != d.Name:
+		case query.Get("inputdataset") != "" && query.Get("inputdataset") != d.Parent:
+		case query.Get("prep_id") != "" && query.Get("prep_id") != d.PrepID:
+		default:
+			requests[rname] = req
+		}
+	}
+	writeJSON(w, row{"result": []row{requests}})
+}
+
+// ConfigCacheHandler serves ReqMgr2 configurations, i.e. /couchdb/reqmgr_config_cache/<id>
+func (c *Catalog) ConfigCacheHandler(w http.ResponseWriter, r *http.Request) {
+	arr := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/couchdb/reqmgr_config_cache"), "/"), "/")
+	for _, d := range c.Datasets {
+		if d.Parent == "" || configID(d.Name) != arr[0] {
+			continue
+		}
+		if len(arr) > 1 && arr[1] == "configFile" {
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintf(w, "# mock configuration of %s\nimport FWCore.ParameterSet.Config as cms\nprocess = cms.Process('RECO')\nprocess.GlobalTag.globaltag = '%s'\n", d.Name, d.GlobalTag)
+			return
+		}
+		writeJSON(w, row{"_id": arr[0], "owner": row{"group": "DATAOPS", "user": "mock"}, "pset_hash": fmt.Sprintf("%x", md5.Sum([]byte(d.Release+d.GlobalTag)))})
+		return
+	}
+	writeError(w, http.StatusNotFound, "missing")
+}
+
+// helper function to create McM request of given dataset
+func (c *Catalog) mcmRequest(d Dataset) row {
+	rname, _ := c.request(d)
+	_, events := c.datasetSummary(d.Name)
+	return row{"prepid": d.PrepID, "dataset_name": d.PrimaryDS, "member_of_campaign": d.Era, "cmssw_release": d.Release, "total_events": events, "completed_events": events, "status": "done", "output_dataset": []string{d.Name}, "reqmgr_name": []row{{"name": rname}}}
+}
+
+// helper function to calculate number of files and events of given dataset
+func (c *Catalog) datasetSummary(name string) (int, int64) {
+	var nfiles int
+	var events int64
+	for _, f := range c.Files {
+		if f.Dataset == name {
+			nfiles++
+			events += f.Events()
+		}
+	}
+	return nfiles, events
+}
+
+// McMHandler serves McM APIs, i.e. /mcm/public/restapi/requests/{get,produces,output}/<arg>
+func (c *Catalog) McMHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/mcm/public/restapi/requests/")
+	arr := strings.SplitN(path, "/", 2)
+	if len(arr) != 2 {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unsupported McM API %s", r.URL.Path))
+		return
+	}
+	api, arg := arr[0], strings.TrimRight(arr[1], "/")
+	var results interface{} = row{}
+	for _, d := range c.Datasets {
+		if d.PrepID == "" {
+			continue
+		}
+		switch api {
+		case "get":
+			if d.PrepID == arg {
+				results = c.mcmRequest(d)
+			}
+		case "produces":
+			if d.Name == "/"+strings.TrimLeft(arg, "/") {
+				results = c.mcmRequest(d)
+			}
+		case "output":
+			if d.PrepID == arg {
+				results = []string{d.Name}
+			}
+		default:
+			writeError(w, http.StatusNotFound, fmt.Sprintf("unsupported McM API %s", r.URL.Path))
+			return
+		}
+	}
+	if api == "output" {
+		if _, ok := results.([]string); !ok {
+			results = []string{}
+		}
+	}
+	writeJSON(w, row{"results": results})
+}
+
+// CondDBHandler serves CondDB getLumi API, i.e. /getLumi/?Runs=<runs>
+func (c *Catalog) CondDBHandler(w http.ResponseWriter, r *http.Request) {
+	ranges := parseRanges(strings.Join(r.URL.Query()["Runs"], ","))
+	out := []row{}
+	for _, run := range c.Runs {
+		if len(ranges) > 0 && !inRanges(run.Number, ranges) {
+			continue
+		}
+		out = append(out, row{"Run": run.Number, "DeliveredLumi": run.DeliveredLumi, "Lumi": run.DeliveredLumi * 0.9})
+	}
+	writeJSON(w, out)
+}
+
+// helper function to create RunRegistry record of given run
+func runRecord(run Run) row {
+	const layout = "2006-01-02 15:04:05"
+	start := time.Unix(run.Start, 0).UTC()
+	stop := time.Unix(run.Stop, 0).UTC()
+	return row{
+		"number":            run.Number,
+		"startTime":         start.Format(layout),
+		"stopTime":          stop.Format(layout),
+		"triggers":          run.Lumis * EventsPerLumi,
+		"runClassName":      "Collisions24",
+		"runStopReason":     "",
+		"bfield":            3.8,
+		"gtKey":             "mock_gt_key",
+		"l1Menu":            "mock_l1_menu",
+		"hltKeyDescription": "/cdaq/physics/Run2024/mock",
+		"lhcFill":           9000 + run.Number%1000,
+		"lhcEnergy":         6800,
+		"runCreated":        start.Format(layout),
+		"modified":          stop.Format(layout),
+		"lsCount":           run.Lumis,
+		"lsRanges":          fmt.Sprintf("[1-%d]", run.Lumis),
+	}
+}
+
+// runRegistryCond represents single condition of RunRegistry filter, e.g. ">= 1"
+var runRegistryCond = regexp.MustCompile(`^(>=|<=|>|<|=)\s*(.+)$`)
+
+// helper function to check if value satisfies RunRegistry condition, e.g.
+// ">= 1 and <= 2" or "= 1 or = 2", numbers are compared as numbers and other
+// values (e.g. dates) as strings
+func runRegistryMatch(val interface{}, cond string) bool {
+	check := func(expr string) bool {
+		m := runRegistryCond.FindStringSubmatch(strings.TrimSpace(expr))
+		if m == nil {
+			return false
+		}
+		var cmp int
+		v := fmt.Sprintf("%v", val)
+		x, e1 := strconv.ParseFloat(v, 64)
+		y, e2 := strconv.ParseFloat(m[2], 64)
+		if e1 == nil && e2 == nil {
+			switch {
+			case x < y:
+				cmp = -1
+			case x > y:
+				cmp = 1
+			}
+		} else {
+			cmp = strings.Compare(v, m[2])
+		}
+		switch m[1] {
+		case ">=":
+			return cmp >= 0
+		case "<=":
+			return cmp <= 0
+		case ">":
+			return cmp > 0
+		case "<":
+			return cmp < 0
+		}
+		return cmp == 0
+	}
+	for _, alt := range strings.Split(cond, " or ") {
+		match := true
+		for _, expr := range strings.Split(alt, " and ") {
+			if !check(expr) {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// RunRegistryHandler serves RunRegistry API, i.e. POST request to
+// /runregistry/api/GLOBAL/runsummary/json/<columns>/none/data with filter
+func (c *Catalog) RunRegistryHandler(w http.ResponseWriter, r *http.Request) {
+	var spec struct {
+		Filter map[string]string `json:"filter"`
+	}
+	if r.Method == "POST" {
+		body, err := io.ReadAll(r.Body)
+		if err == nil && len(body) > 0 {
+			err = json.Unmarshal(body, &spec)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("unable to parse filter, error %v", err))
+			return
+		}
+	}
+	var columns []string
+	arr := strings.Split(r.URL.Path, "/")
+	for i, v := range arr {
+		if v == "json" && i+1 < len(arr) {
+			columns = strings.Split(arr[i+1], ",")
+		}
+	}
+	out := []row{}
+	for _, run := range c.Runs {
+		rec := runRecord(run)
+		match := true
+		for key, cond := range spec.Filter {
+			if !runRegistryMatch(rec[key], cond) {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		if len(columns) > 0 {
+			sel := make(row)
+			for _, col := range columns {
+				if v, ok := rec[col]; ok {
+					sel[col] = v
+				}
+			}
+			rec = sel
+		}
+		out = append(out, rec)
+	}
+	writeJSON(w, out)
+}
+
+// helper function to write CRIC records with given columns
+func writeCRIC(w http.ResponseWriter, columns []string, rows [][]interface{}) {
+	if rows == nil {
+		rows = [][]interface{}{}
+	}
+	writeJSON(w, row{"desc": row{"columns": columns}, "result": rows})
+}
+
+// CRICHandler serves CRIC APIs, i.e. /api/cms/site/query and
+// /api/accounts/user/query with preset parameter
+func (c *Catalog) CRICHandler(w http.ResponseWriter, r *http.Request) {
+	var rows [][]interface{}
+	preset := r.URL.Query().Get("preset")
+	if strings.HasPrefix(r.URL.Path, "/api/cms/site/") {
+		for _, site := range c.Sites {
+			for _, stype := range []string{"cms", "phedex", "psn"} {
+				rows = append(rows, []interface{}{stype, strings.ToLower(strings.Split(site, "_")[2]), site})
+			}
+		}
+		writeCRIC(w, []string{"type", "site", "alias"}, rows)
+		return
+	}
+	people := [][]interface{}{
+		{"mockadmin", "Mock", "Admin", "mock.admin@mock.cern.ch", "/DC=ch/DC=cern/OU=Users/CN=mockadmin"},
+		{"mockuser", "Mock", "User", "mock.user@mock.cern.ch", "/DC=ch/DC=cern/OU=Users/CN=mockuser"},
+	}
+	switch preset {
+	case "group-responsibilities":
+		rows = [][]interface{}{
+			{"DataOps", "mockadmin", "DataOps", "admin"},
+			{"Facilities", "mockuser", "Facilities", "operator"},
+		}
+		writeCRIC(w, []string{"name", "user_name", "user_group", "role"}, rows)
+	case "roles":
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			// list of users and their roles used by CMS authentication of DAS server
+			var users []row
+			for i, p := range people {
+				roles := map[string][]string{"admin": {"group:dataops"}}
+				if i > 0 {
+					roles = map[string][]string{"operator": {"group:facilities"}}
+				}
+				users = append(users, row{"DN": p[4], "DNs": []interface{}{p[4]}, "ID": i + 1, "LOGIN": p[0], "NAME": fmt.Sprintf("%s %s", p[1], p[2]), "ROLES": roles})
+			}
+			writeJSON(w, users)
+			return
+		}
+		rows = [][]interface{}{
+			{"admin", "Admin", []string{"mockadmin"}},
+			{"operator", "Operator", []string{"mockuser"}},
+		}
+		writeCRIC(w, []string{"title", "name", "users"}, rows)
+	default:
+		writeCRIC(w, []string{"username", "forename", "surname", "email", "dn"}, people)
+	}
+}
@@ -12,8 +12,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"html"
+	"io"
 	"log"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dmwm/das2go/config"
@@ -163,86 +167,197 @@ func GetInt64Value(rec DASRecord, key string) (int64, error) {
 
 // MongoConnection defines connection to MongoDB
 type MongoConnection struct {
+	sync.Mutex
 	Session *mgo.Session
 }
 
-// Connect provides connection to MongoDB
-func (m *MongoConnection) Connect() *mgo.Session {
-	var err error
+// helper function to build MongoDB write concern from DAS configuration
+func writeConcern() *mgo.Safe {
+	wc := config.Config.MongoWriteConcern
+	if wc == "0" {
+		return nil // unacknowledged writes
+	}
+	safe := &mgo.Safe{J: config.Config.MongoJournal}
+	if n, err := strconv.Atoi(wc); err == nil {
+		safe.W = n
+	} else {
+		safe.WMode = wc
+	}
+	if config.Config.MongoTimeout > 0 && (safe.W > 1 || safe.WMode != "") {
+		safe.WTimeout = config.Config.MongoTimeout * 1000 // in milliseconds
+	}
+	return safe
+}
+
+// helper function to dial MongoDB using DAS configuration
+func dial() (*mgo.Session, error) {
+	info, err := mgo.ParseURL(config.Config.Uri)
+	if err != nil {
+		return nil, err
+	}
+	info.Timeout = 10 * time.Second // default timeout of mgo.Dial
+	timeout := time.Duration(config.Config.MongoTimeout) * time.Second
+	if timeout > 0 {
+		info.Timeout = timeout
+	}
+	if config.Config.MongoPoolLimit > 0 {
+		info.PoolLimit = config.Config.MongoPoolLimit
+	}
+	session, err := mgo.DialWithInfo(info)
+	if err != nil {
+		return nil, err
+	}
+	//     session.SetMode(mgo.Monotonic, true)
+	session.SetMode(mgo.Strong, true)
+	if timeout > 0 {
+		session.SetSocketTimeout(timeout)
+		session.SetSyncTimeout(timeout)
+	}
+	session.SetSafe(writeConcern())
+	return session, nil
+}
+
+// Connect provides connection to MongoDB, the returned session should be
+// closed by the caller. It returns an error if MongoDB is not reachable, in
+// this case we'll dial MongoDB again on next call.
+func (m *MongoConnection) Connect() (*mgo.Session, error) {
+	m.Lock()
+	defer m.Unlock()
 	if m.Session == nil {
-		m.Session, err = mgo.Dial(config.Config.Uri)
+		session, err := dial()
 		if err != nil {
-			log.Fatal("ERROR ", err)
+			return nil, err
 		}
-		//         m.Session.SetMode(mgo.Monotonic, true)
-		m.Session.SetMode(mgo.Strong, true)
+		m.Session = session
+	}
+	return m.Session.Copy(), nil
+}
+
+// Reconnect discards connections of MongoDB session, new connections will
+// be established by next operation
+func (m *MongoConnection) Reconnect() {
+	m.Lock()
+	defer m.Unlock()
+	if m.Session != nil {
+		m.Session.Refresh()
 	}
-	return m.Session.Clone()
 }
 
 // global object which holds MongoDB connection
 var _Mongo MongoConnection
 
-// Insert records into MongoDB
-func Insert(dbname, collname string, records []DASRecord) {
+// helper function to check if given error is caused by lost connection to MongoDB
+func connectionError(err error) bool {
+	if err == nil || err == mgo.ErrNotFound {
+		return false
+	}
+	if err == io.EOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	msg := err.Error()
+	for _, pat := range []string{"no reachable servers", "Closed explicitly", "connection reset", "broken pipe"} {
+		if strings.Contains(msg, pat) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to run given operation on MongoDB collection. When operation
+// fails due to lost connection we reconnect to MongoDB, and if operation is
+// idempotent (i.e. can be safely repeated) we retry it once.
+func run(dbname, collname string, idempotent bool, op func(c *mgo.Collection) error) error {
+	attempts := 1
+	if idempotent {
+		attempts = 2
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		var s *mgo.Session
+		s, err = _Mongo.Connect()
+		if err != nil {
+			return err
+		}
+		err = op(s.DB(dbname).C(collname))
+		s.Close()
+		if !connectionError(err) {
+			return err
+		}
+		log.Printf("ERROR: lost connection to MongoDB, error %v, reconnect\n", err)
+		_Mongo.Reconnect()
+	}
+	return err
+}
+
+// Insert records into MongoDB, records are inserted in bulk and insertion
+// continues after failed records, the returned error reports all failures
+func Insert(dbname, collname string, records []DASRecord) error {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/Insert")()
 
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	for _, rec := range records {
-		if err := c.Insert(&rec); err != nil {
-			log.Println("Fail to insert DAS record", err)
-			break
+	if len(records) == 0 {
+		return nil
+	}
+	err := run(dbname, collname, false, func(c *mgo.Collection) error {
+		bulk := c.Bulk()
+		bulk.Unordered()
+		for _, rec := range records {
+			bulk.Insert(rec)
 		}
+		_, err := bulk.Run()
+		return err
+	})
+	if err != nil {
+		log.Println("Fail to insert DAS records", err)
 	}
+	return err
 }
 
 // Get records from MongoDB
-func Get(dbname, collname string, spec bson.M, idx, limit int) []DASRecord {
+func Get(dbname, collname string, spec bson.M, idx, limit int) ([]DASRecord, error) {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/Get")()
 
 	out := []DASRecord{}
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	var err error
-	if limit > 0 {
-		err = c.Find(spec).Skip(idx).Limit(limit).All(&out)
-	} else {
-		err = c.Find(spec).Skip(idx).All(&out)
-	}
+	err := run(dbname, collname, true, func(c *mgo.Collection) error {
+		if limit > 0 {
+			return c.Find(spec).Skip(idx).Limit(limit).All(&out)
+		}
+		return c.Find(spec).Skip(idx).All(&out)
+	})
 	if err != nil {
 		log.Println("ERROR: unable to get records", err)
 	}
-	return out
+	return out, err
 }
 
 // GetSorted records from MongoDB sorted by given key
-func GetSorted(dbname, collname string, spec bson.M, skeys []string) []DASRecord {
+func GetSorted(dbname, collname string, spec bson.M, skeys []string) ([]DASRecord, error) {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/GetSorted")()
 
 	out := []DASRecord{}
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	err := c.Find(spec).Sort(skeys...).All(&out)
-	if err != nil {
+	err := run(dbname, collname, true, func(c *mgo.Collection) error {
+		return c.Find(spec).Sort(skeys...).All(&out)
+	})
+	if err != nil && !connectionError(err) {
 		log.Println("unable to sort records", err)
 		// try to fetch all unsorted data
-		err = c.Find(spec).All(&out)
-		if err != nil {
-			log.Println("ERROR: unable to find records", err)
-			out = append(out, DASErrorRecord(fmt.Sprintf("%v", err), utils.MongoDBErrorName, utils.MongoDBError))
-		}
+		err = run(dbname, collname, true, func(c *mgo.Collection) error {
+			return c.Find(spec).All(&out)
+		})
 	}
-	return out
+	if err != nil {
+		log.Println("ERROR: unable to find records", err)
+		out = append(out, DASErrorRecord(fmt.Sprintf("%v", err), utils.MongoDBErrorName, utils.MongoDBError))
+	}
+	return out, err
 }
 
 // helper function to present in bson selected fields
@@ -255,105 +370,154 @@ func sel(q ...string) (r bson.M) {
 }
 
 // GetFilteredSorted get records from MongoDB filtered and sorted by given key
-func GetFilteredSorted(dbname, collname string, spec bson.M, fields, skeys []string, idx, limit int) []DASRecord {
+func GetFilteredSorted(dbname, collname string, spec bson.M, fields, skeys []string, idx, limit int) ([]DASRecord, error) {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/GetFiltered/Sorted")()
 
 	out := []DASRecord{}
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	var err error
 	fields = append(fields, "das") // always extract das part of the record
-	if limit > 0 {
-		if len(skeys) > 0 {
-			err = c.Find(spec).Skip(idx).Limit(limit).Select(sel(fields...)).Sort(skeys...).All(&out)
-		} else {
-			err = c.Find(spec).Skip(idx).Limit(limit).Select(sel(fields...)).All(&out)
+	err := run(dbname, collname, true, func(c *mgo.Collection) error {
+		query := c.Find(spec).Skip(idx).Select(sel(fields...))
+		if limit > 0 {
+			query = query.Limit(limit)
 		}
-	} else {
 		if len(skeys) > 0 {
-			err = c.Find(spec).Select(sel(fields...)).Sort(skeys...).All(&out)
-		} else {
-			err = c.Find(spec).Select(sel(fields...)).All(&out)
+			query = query.Sort(skeys...)
 		}
-	}
+		return query.All(&out)
+	})
 	if err != nil {
 		log.Println("ERROR: unable to fetch from MOngoDB", time.Now(), err)
 	}
+	return out, err
+}
+
+// OrderKeys returns given sort keys followed by _id, unless they already end
+// with _id (e.g. -_id), such that order of records is unique
+func OrderKeys(skeys []string) []string {
+	out := append([]string{}, skeys...)
+	if n := len(out); n == 0 || strings.TrimLeft(out[n-1], "+-") != "_id" {
+		out = append(out, "_id")
+	}
 	return out
 }
 
+// Iterate calls given function for every record matching given spec. Records
+// are read from MongoDB cursor, ordered by given sort keys and _id and contain
+// only given fields (all fields if none are given). Iteration skips idx records
+// and stops after limit records (if positive) or when function returns an error.
+func Iterate(dbname, collname string, spec bson.M, fields, skeys []string, idx, limit int, fn func(rec DASRecord) error) error {
+
+	// defer function profiler
+	defer utils.MeasureTime("mongo/Iterate")()
+
+	// records may be already passed to the function, therefore we can't repeat this operation
+	err := run(dbname, collname, false, func(c *mgo.Collection) error {
+		query := c.Find(spec).Sort(OrderKeys(skeys)...).Skip(idx)
+		if len(fields) > 0 {
+			query = query.Select(sel(fields...))
+		}
+		if limit > 0 {
+			query = query.Limit(limit)
+		}
+		iter := query.Iter()
+		for {
+			var rec DASRecord
+			if !iter.Next(&rec) {
+				break
+			}
+			if err := fn(rec); err != nil {
+				iter.Close()
+				return err
+			}
+		}
+		return iter.Close()
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to iterate over records, spec %v, error %v\n", spec, err)
+	}
+	return err
+}
+
 // Update inplace for given spec
-func Update(dbname, collname string, spec, newdata bson.M) {
+func Update(dbname, collname string, spec, newdata bson.M) error {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/Update")()
 
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	err := c.Update(spec, newdata)
+	err := run(dbname, collname, false, func(c *mgo.Collection) error {
+		return c.Update(spec, newdata)
+	})
 	if err != nil {
 		log.Printf("ERROR: unable to update record, spec %v, data %+v, error %v\n", spec, newdata, err)
 	}
+	return err
 }
 
 // Count gets number records from MongoDB
-func Count(dbname, collname string, spec bson.M) int {
+func Count(dbname, collname string, spec bson.M) (int, error) {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/Count")()
 
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	nrec, err := c.Find(spec).Count()
+	var nrec int
+	err := run(dbname, collname, true, func(c *mgo.Collection) error {
+		var err error
+		nrec, err = c.Find(spec).Count()
+		return err
+	})
 	if err != nil {
 		log.Printf("ERROR: unable to count records, spec %+v, error %v\n", spec, err)
 	}
-	return nrec
+	return nrec, err
 }
 
-// Bytes gets number records from MongoDB
-func Bytes(dbname, collname string, spec bson.M) int {
+// Bytes returns total size of records matching given spec. The size of every
+// DAS record is kept in its das.bytes field (see services.SetBytes) and we sum
+// them up on MongoDB side
+func Bytes(dbname, collname string, spec bson.M) (int, error) {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/Bytes")()
 
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	var rec DASRecord
-	err := c.Find(spec).One(&rec)
-	if err != nil {
-		log.Printf("ERROR: unable to find record spec=%+v error=%v\n", spec, err)
+	var res struct {
+		Bytes int64 `bson:"bytes"`
+	}
+	pipeline := []bson.M{
+		{"$match": spec},
+		{"$group": bson.M{"_id": nil, "bytes": bson.M{"$sum": "$das.bytes"}}},
+	}
+	err := run(dbname, collname, true, func(c *mgo.Collection) error {
+		return c.Pipe(pipeline).One(&res)
+	})
+	if err == mgo.ErrNotFound {
+		return 0, nil
 	}
-	data, err := json.Marshal(rec)
 	if err != nil {
-		log.Printf("ERROR: unable to marshl DASRecord error=%v\n", err)
+		log.Printf("ERROR: unable to get size of records spec=%+v error=%v\n", spec, err)
+		return 0, err
 	}
-	// find total number of records
-	nrec := Count(dbname, collname, spec)
-
-	// return total size of all DAS records for given spec
-	return nrec * len(data)
+	return int(res.Bytes), nil
 }
 
 // Remove records from MongoDB
-func Remove(dbname, collname string, spec bson.M) {
+func Remove(dbname, collname string, spec bson.M) error {
 
 	// defer function profiler
 	defer utils.MeasureTime("mongo/Remove")()
 
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	_, err := c.RemoveAll(spec)
-	if err != nil && err != mgo.ErrNotFound {
+	err := run(dbname, collname, true, func(c *mgo.Collection) error {
+		_, err := c.RemoveAll(spec)
+		return err
+	})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
 		log.Printf("ERROR: untable to remove records, spec %+v, error %v\n", spec, err)
 	}
+	return err
 }
 
 // LoadJsonData stream from series of bytes
@@ -367,22 +531,72 @@ func LoadJsonData(data []byte) DASRecord {
 }
 
 // CreateIndexes creates DAS cache indexes
-func CreateIndexes(dbname, collname string, keys []string) {
-	s := _Mongo.Connect()
-	defer s.Close()
-	c := s.DB(dbname).C(collname)
-	for _, key := range keys {
-		index := mgo.Index{
-			Key:        []string{key},
-			Unique:     false,
-			Background: true,
-			//             Sparse:     true,
+func CreateIndexes(dbname, collname string, keys []string) error {
+	return run(dbname, collname, true, func(c *mgo.Collection) error {
+		for _, key := range keys {
+			index := mgo.Index{
+				Key:        []string{key},
+				Unique:     false,
+				Background: true,
+				//             Sparse:     true,
+			}
+			err := c.EnsureIndex(index)
+			if err != nil {
+				log.Printf("ERROR: unable to ensure index, index %v, error %v\n", index, err)
+				return err
+			}
 		}
-		err := c.EnsureIndex(index)
+		return nil
+	})
+}
+
+// CreateTTLIndex creates TTL index on given date key, MongoDB will remove
+// records whose date is older than expireAfter
+func CreateTTLIndex(dbname, collname, key string, expireAfter time.Duration) error {
+	// zero value means no TTL in MongoDB, therefore we use at least one second
+	if expireAfter < time.Second {
+		expireAfter = time.Second
+	}
+	index := mgo.Index{
+		Key:         []string{key},
+		Background:  true,
+		ExpireAfter: expireAfter,
+	}
+	err := run(dbname, collname, true, func(c *mgo.Collection) error {
+		indexes, err := c.Indexes()
 		if err != nil {
-			log.Printf("ERROR: unable to ensure index, index %v, error %v\n", index, err)
+			return err
+		}
+		for _, idx := range indexes {
+			if len(idx.Key) != 1 || idx.Key[0] != key {
+				continue
+			}
+			if idx.ExpireAfter == expireAfter {
+				return nil
+			}
+			// EnsureIndex fails with IndexOptionsConflict when expireAfterSeconds
+			// changes, therefore we modify existing index and recreate it if
+			// it can't be modified, e.g. it is not TTL index
+			log.Printf("change TTL index %s of %s.%s from %v to %v\n", idx.Name, dbname, collname, idx.ExpireAfter, expireAfter)
+			cmd := bson.D{
+				{Name: "collMod", Value: collname},
+				{Name: "index", Value: bson.M{"name": idx.Name, "expireAfterSeconds": int(expireAfter.Seconds())}},
+			}
+			var res bson.M
+			if err = c.Database.Run(cmd, &res); err == nil {
+				return nil
+			}
+			log.Printf("ERROR: unable to modify TTL index %s, error %v, recreate it\n", idx.Name, err)
+			if err = c.DropIndexName(idx.Name); err != nil {
+				return err
+			}
 		}
+		return c.EnsureIndex(index)
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to ensure TTL index, index %v, error %v\n", index, err)
 	}
+	return err
 }
 
 // GetBytesFromDASRecord converts DASRecord map into bytes
@@ -0,0 +1,116 @@
+package services
+
+// DAS service module
+// this module contains cross-service consistency checks of merged DAS records
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/utils"
+)
+
+// helper function to normalize values for comparison, e.g. numbers
+// may come as json.Number strings from one service and as ints from another
+func normalizeValue(val interface{}) string {
+	v := fmt.Sprintf("%v", val)
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return v
+}
+
+// helper function to look-up (nested) attribute value in a record
+func attrValue(rec mongo.DASRecord, attr string) (interface{}, bool) {
+	keys := strings.Split(attr, ".")
+	for idx, key := range keys {
+		val, ok := rec[key]
+		if !ok || val == nil {
+			return nil, false
+		}
+		if idx == len(keys)-1 {
+			return val, true
+		}
+		switch v := val.(type) {
+		case mongo.DASRecord:
+			rec = v
+		case map[string]interface{}:
+			rec = mongo.Convert2DASRecord(v)
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// UncheckedRecords counts merged records whose values can not be compared
+// among services since their parts are not aligned with das.services list
+var UncheckedRecords uint64
+
+// CheckConsistency compares values of given diff keys (see "diff" lists of
+// DAS presentation map) among different services which provided the same
+// merged record. The merged record parts are aligned with das.services list,
+// records whose parts can not be aligned are logged and counted, see
+// UncheckedRecords.
+// The discrepancies are attached to das part of the record as "diff" list of
+// {"key": daskey, "values": [{"service": srv, "value": val}, ...]} records.
+// It returns number of records with discrepancies.
+func CheckConsistency(records []mongo.DASRecord, mkey string, diffKeys []string) int {
+	if len(diffKeys) == 0 {
+		return 0
+	}
+	ndiff := 0
+	for _, rec := range records {
+		das, ok := rec["das"].(mongo.DASRecord)
+		if !ok {
+			continue
+		}
+		srvs := services(das)
+		parts := getRecords(rec, mkey)
+		if len(parts) < 2 {
+			continue
+		}
+		var systems []string
+		for _, srv := range srvs {
+			systems = append(systems, strings.Split(srv, ":")[0])
+		}
+		if len(utils.List2Set(systems)) < 2 {
+			continue // we only compare data from different systems
+		}
+		if len(parts) != len(srvs) {
+			atomic.AddUint64(&UncheckedRecords, 1)
+			log.Printf("WARNING: unable to check consistency of %s record of query %v, %d parts of %d services %v\n", mkey, rec["qhash"], len(parts), len(srvs), srvs)
+			continue
+		}
+		var diffs []mongo.DASRecord
+		for _, key := range diffKeys {
+			attr := strings.TrimPrefix(key, mkey+".")
+			var values []mongo.DASRecord
+			var normValues []string
+			var valSystems []string
+			for idx, part := range parts {
+				val, ok := attrValue(part, attr)
+				if !ok {
+					continue
+				}
+				values = append(values, mongo.DASRecord{"service": srvs[idx], "value": val})
+				normValues = append(normValues, normalizeValue(val))
+				valSystems = append(valSystems, systems[idx])
+			}
+			if len(utils.List2Set(valSystems)) < 2 || len(utils.List2Set(normValues)) < 2 {
+				continue
+			}
+			diffs = append(diffs, mongo.DASRecord{"key": key, "values": values})
+		}
+		if len(diffs) > 0 {
+			das["diff"] = diffs
+			rec["das"] = das
+			ndiff++
+		}
+	}
+	return ndiff
+}
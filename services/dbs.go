@@ -10,6 +10,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/url"
 	"strconv"
@@ -23,29 +24,63 @@ import (
 // helper function to load DBS data stream
 func loadDBSData(api string, data []byte) []mongo.DASRecord {
 	var out []mongo.DASRecord
+	decodeDBSData(api, bytes.NewReader(data), 0, func(records []mongo.DASRecord) error {
+		out = append(out, records...)
+		return nil
+	})
+	return out
+}
 
+// helper function to decode DBS data stream (JSON array of records) record by
+// record and pass records to given function in batches of given size (0 means
+// single batch). Failure to decode the stream is passed as DAS error record,
+// the returned error comes from given function.
+func decodeDBSData(api string, r io.Reader, size int, fn func([]mongo.DASRecord) error) error {
+	var out []mongo.DASRecord
 	// to prevent json.Unmarshal behavior to convert all numbers to float
 	// we'll use json decode method with instructions to use numbers as is
-	buf := bytes.NewBuffer(data)
-	dec := json.NewDecoder(buf)
+	dec := json.NewDecoder(r)
 	dec.UseNumber()
-	err := dec.Decode(&out)
-
-	// original way to decode data
-	// err := json.Unmarshal(data, &out)
+	tok, err := dec.Token()
+	if err == nil && tok != json.Delim('[') {
+		err = fmt.Errorf("unexpected token %v, expect array of records", tok)
+	}
+	for err == nil && dec.More() {
+		var rec mongo.DASRecord
+		if err = dec.Decode(&rec); err != nil {
+			break
+		}
+		out = append(out, rec)
+		if size > 0 && len(out) == size {
+			if e := fn(out); e != nil {
+				return e
+			}
+			out = nil
+		}
+	}
+	if err == nil {
+		_, err = dec.Token() // closing bracket of the array
+	}
 	if err != nil {
-		msg := fmt.Sprintf("DBS unable to unmarshal the data into DAS record, api=%s, data=%s, error=%v", api, string(data), err)
+		msg := fmt.Sprintf("DBS unable to unmarshal the data into DAS record, api=%s, error=%v", api, err)
 		if utils.VERBOSE > 0 {
-			log.Printf("ERROR: DBS unable to unmarshal, data %+v, api %v, error %v\n", string(data), api, err)
+			log.Printf("ERROR: DBS unable to unmarshal, api %v, error %v\n", api, err)
 		}
 		out = append(out, mongo.DASErrorRecord(msg, utils.DBSErrorName, utils.DBSError))
 	}
-	return out
+	if len(out) == 0 {
+		return nil
+	}
+	return fn(out)
 }
 
 // DBSUnmarshal unmarshals DBS data stream and return DAS records based on api
 func DBSUnmarshal(api string, data []byte) []mongo.DASRecord {
-	records := loadDBSData(api, data)
+	return dbsRecords(api, loadDBSData(api, data))
+}
+
+// helper function to convert DBS records into DAS records based on api
+func dbsRecords(api string, records []mongo.DASRecord) []mongo.DASRecord {
 	var out []mongo.DASRecord
 	if api == "dataset_info" || api == "datasets" || api == "datasetlist" {
 		for _, rec := range records {
@@ -102,7 +102,7 @@ func bareSitedbUrl() string {
 // CricUrl returns Cric URL
 func CricUrl(api string) string {
 	v := utils.GetEnv("CRIC_URL")
-	surl := "https://cms-cric.cern.ch"
+	surl := CricURL
 	if val, ok := UrlMap["cric"]; ok {
 		if val != "" {
 			surl = val
@@ -176,8 +176,9 @@ func processUrls(dasquery dasql.DASQuery, system, api string, urls []string) []m
 	umap := map[string]int{}
 	client := utils.HttpClient()
 	for _, furl := range urls {
-		umap[furl] = 1                        // keep track of processed urls below
-		go utils.Fetch(client, furl, "", out) // "" specify optional args
+		umap[furl] = 1 // keep track of processed urls below
+		// "" specify optional args
+		go utils.FetchQuery(client, furl, "", out, dasquery.Qhash, dasquery.Priority)
 	}
 	// collect all results from out channel
 	exit := false
@@ -186,7 +187,9 @@ func processUrls(dasquery dasql.DASQuery, system, api string, urls []string) []m
 		case r := <-out:
 			// process data
 			var records []mongo.DASRecord
-			if system == "dbs3" || system == "dbs" {
+			if r.Error != nil {
+				records = append(records, ErrorRecord(system, api, r))
+			} else if system == "dbs3" || system == "dbs" {
 				records = DBSUnmarshal(api, r.Data)
 			} else if system == "phedex" {
 				records = PhedexUnmarshal(api, r.Data)
@@ -0,0 +1,286 @@
+package services
+
+// DAS service module
+// this module contains merge logic of DAS records for multi-field look-ups,
+// e.g. file,run,lumi dataset=X
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/utils"
+)
+
+// helper function to extract primary keys from das part of DAS record
+func primaryKeys(das mongo.DASRecord) []string {
+	var out []string
+	switch v := das["primary_keys"].(type) {
+	case []string:
+		out = append(out, v...)
+	case []interface{}:
+		for _, k := range v {
+			if key, ok := k.(string); ok {
+				out = append(out, key)
+			}
+		}
+	}
+	if pkey, ok := das["primary_key"].(string); ok && pkey != "" && !utils.InList(pkey, out) {
+		out = append(out, pkey)
+	}
+	return out
+}
+
+// FieldKeys returns primary key (in dot notation) for every look-up field,
+// fields without primary key are mapped to an empty string
+func FieldKeys(fields, pkeys []string) map[string]string {
+	out := make(map[string]string)
+	for _, field := range fields {
+		out[field] = ""
+		for _, pkey := range pkeys {
+			if strings.HasPrefix(pkey, field+".") {
+				out[field] = pkey
+				break
+			}
+		}
+	}
+	return out
+}
+
+// helper function to collect values of given attribute from list of records
+func attrValues(records []mongo.DASRecord, attr string) ([]interface{}, bool) {
+	var out []interface{}
+	isList := false
+	for _, rec := range records {
+		val, ok := attrValue(rec, attr)
+		if !ok {
+			continue
+		}
+		switch v := val.(type) {
+		case []interface{}:
+			isList = true
+			out = append(out, v...)
+		default:
+			out = append(out, v)
+		}
+	}
+	return out, isList
+}
+
+// helper function to compare two values, numbers are compared numerically
+func lessValues(v1, v2 string) bool {
+	f1, err1 := strconv.ParseFloat(v1, 64)
+	f2, err2 := strconv.ParseFloat(v2, 64)
+	if err1 == nil && err2 == nil {
+		return f1 < f2
+	}
+	return v1 < v2
+}
+
+// helper function to create unique sorted list of values
+func unionValues(values []interface{}) []interface{} {
+	vmap := make(map[string]interface{})
+	var keys []string
+	for _, v := range values {
+		key := normalizeValue(v)
+		if _, ok := vmap[key]; !ok {
+			vmap[key] = v
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return lessValues(keys[i], keys[j]) })
+	var out []interface{}
+	for _, k := range keys {
+		out = append(out, vmap[k])
+	}
+	return out
+}
+
+// CompositeKey returns composite key of given multi-field DAS record made of
+// primary key values of look-up fields. Fields with empty primary key (e.g. list
+// values such as lumi numbers) are not part of the key since they are merged within
+// a key tuple (similar to OrderByRunLumis). It returns false if record does not
+// contain any primary key value.
+func CompositeKey(rec mongo.DASRecord, fields []string, fkeys map[string]string) ([]string, bool) {
+	var out []string
+	found := false
+	for _, field := range fields {
+		pkey := fkeys[field]
+		if pkey == "" {
+			out = append(out, "")
+			continue
+		}
+		attr := strings.TrimPrefix(pkey, field+".")
+		values, isList := attrValues(getRecords(rec, field), attr)
+		if isList || len(values) != 1 {
+			out = append(out, "")
+			continue
+		}
+		out = append(out, normalizeValue(values[0]))
+		found = true
+	}
+	return out, found
+}
+
+// helper function to merge sub-records of given field, sub-records of list
+// fields are compacted into single record with unique list of key values
+func mergeFieldRecords(records []mongo.DASRecord, field, pkey string, isList bool) []mongo.DASRecord {
+	var out []mongo.DASRecord
+	attr := strings.TrimPrefix(pkey, field+".")
+	if values, _ := attrValues(records, attr); pkey != "" && isList {
+		// compact list values (e.g. lumi numbers) into single record
+		rec := make(mongo.DASRecord)
+		for _, r := range records {
+			for k, v := range r {
+				if _, ok := rec[k]; !ok {
+					rec[k] = v
+				}
+			}
+		}
+		rec[attr] = unionValues(values)
+		return append(out, rec)
+	}
+	// remove duplicate records
+	var reprs []string
+	for _, r := range records {
+		repr := fmt.Sprintf("%v", r)
+		if utils.InList(repr, reprs) {
+			continue
+		}
+		reprs = append(reprs, repr)
+		out = append(out, r)
+	}
+	return out
+}
+
+// helper function to remove duplicates from provenance records
+func uniqueProvenance(records []mongo.DASRecord) []mongo.DASRecord {
+	var out []mongo.DASRecord
+	keys := make(map[string]bool)
+	for _, rec := range records {
+		key := fmt.Sprintf("%v %v", rec["key"], rec["service"])
+		if _, ok := keys[key]; ok {
+			continue
+		}
+		keys[key] = true
+		out = append(out, rec)
+	}
+	return out
+}
+
+// MergeMultiFieldRecords merges DAS records of multi-field look-up, e.g.
+// file,run,lumi dataset=X, using composite key made of primary keys of all
+// look-up fields. Records from different APIs which share the same key tuple
+// are joined into a single row, records which lack some of the key fields are
+// joined with all rows matching their key values.
+func MergeMultiFieldRecords(records []mongo.DASRecord, fields, pkeys []string, qhash string) []mongo.DASRecord {
+	var out []mongo.DASRecord
+	fkeys := FieldKeys(fields, pkeys)
+	// find out fields with list values, e.g. lumi numbers, they are merged within key tuple
+	listFields := make(map[string]bool)
+	for _, field := range fields {
+		attr := strings.TrimPrefix(fkeys[field], field+".")
+		for _, rec := range records {
+			if _, isList := attrValues(getRecords(rec, field), attr); isList {
+				listFields[field] = true
+				break
+			}
+		}
+	}
+	tkeys := make(map[string]string)
+	for field, pkey := range fkeys {
+		if !listFields[field] {
+			tkeys[field] = pkey
+		}
+	}
+	groups := make(map[string][]mongo.DASRecord)
+	tuples := make(map[string][]string)
+	var gkeys []string
+	addRecord := func(tuple []string, rec mongo.DASRecord) {
+		key := strings.Join(tuple, "\x00")
+		if _, ok := groups[key]; !ok {
+			gkeys = append(gkeys, key)
+			tuples[key] = tuple
+		}
+		groups[key] = append(groups[key], rec)
+	}
+	// first, group records which have values for all key fields
+	var partial []mongo.DASRecord
+	var ptuples [][]string
+	for _, rec := range records {
+		tuple, ok := CompositeKey(rec, fields, tkeys)
+		if !ok { // nothing to join on, e.g. error records
+			out = append(out, rec)
+			continue
+		}
+		complete := true
+		for idx, field := range fields {
+			if tkeys[field] != "" && tuple[idx] == "" {
+				complete = false
+			}
+		}
+		if complete {
+			addRecord(tuple, rec)
+		} else {
+			partial = append(partial, rec)
+			ptuples = append(ptuples, tuple)
+		}
+	}
+	// then, join records with missing key fields (e.g. file records from API
+	// which does not know about runs) with all groups which match their key values
+	ngroups := len(gkeys)
+	for idx, rec := range partial {
+		tuple := ptuples[idx]
+		found := false
+		for _, key := range gkeys[:ngroups] {
+			match := true
+			for jdx, val := range tuple {
+				if val != "" && val != tuples[key][jdx] {
+					match = false
+					break
+				}
+			}
+			if match {
+				groups[key] = append(groups[key], rec)
+				found = true
+			}
+		}
+		if !found {
+			addRecord(tuple, rec)
+		}
+	}
+	sort.Slice(gkeys, func(i, j int) bool {
+		t1 := tuples[gkeys[i]]
+		t2 := tuples[gkeys[j]]
+		for idx := range t1 {
+			if t1[idx] != t2[idx] {
+				return lessValues(t1[idx], t2[idx])
+			}
+		}
+		return false
+	})
+	for _, key := range gkeys {
+		group := groups[key]
+		rec := mongo.DASRecord{"qhash": qhash}
+		for _, field := range fields {
+			var parts []mongo.DASRecord
+			for _, r := range group {
+				parts = append(parts, getRecords(r, field)...)
+			}
+			if len(parts) > 0 {
+				rec[field] = mergeFieldRecords(parts, field, fkeys[field], listFields[field])
+			}
+		}
+		das := group[0]["das"].(mongo.DASRecord)
+		for _, r := range group[1:] {
+			das = mergeDASparts(das, r["das"].(mongo.DASRecord))
+		}
+		das["services"] = utils.List2Set(services(das))
+		das["provenance"] = uniqueProvenance(provenance(das))
+		rec["das"] = das
+		out = append(out, rec)
+	}
+	return out
+}
@@ -7,8 +7,11 @@ package services
 //
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"regexp"
 	"strings"
@@ -21,46 +24,63 @@ import (
 // helper function to load data stream and return DAS records
 func loadRucioData(api string, data []byte) []mongo.DASRecord {
 	var out []mongo.DASRecord
+	decodeRucioData(api, bytes.NewReader(data), 0, func(records []mongo.DASRecord) error {
+		out = append(out, records...)
+		return nil
+	})
+	return out
+}
 
+// helper function to decode Rucio data stream line by line and pass records
+// to given function in batches of given size (0 means single batch). Rows which
+// can not be decoded are passed as DAS error records, the returned error comes
+// from given function.
+func decodeRucioData(api string, r io.Reader, size int, fn func([]mongo.DASRecord) error) error {
+	var out []mongo.DASRecord
 	// Rucio uses application/x-json-stream content type which yields dict records from the server
-	var row []byte
-	for _, r := range data {
-		if string(r) == "\n" {
+	reader := bufio.NewReader(r)
+	for {
+		row, err := reader.ReadBytes('\n')
+		// last record from Rucio does not have '\n' so we collect it along with EOF
+		if row = bytes.TrimSpace(row); len(row) > 0 {
 			var rec mongo.DASRecord
-			err := json.Unmarshal(row, &rec)
-			if err != nil {
-				msg := fmt.Sprintf("Rucio unable to unmarshal the data into DAS record, api=%s, data=%s, error=%v", api, string(row), err)
+			if e := json.Unmarshal(row, &rec); e != nil {
+				msg := fmt.Sprintf("Rucio unable to unmarshal the data into DAS record, api=%s, data=%s, error=%v", api, utils.Truncate(string(row), MaxErrorMessage), e)
 				if utils.VERBOSE > 0 {
-					log.Printf("ERROR: Rucio unable to unmarshal, data %+v, api %v, error %v\n", string(row), api, err)
+					log.Printf("ERROR: Rucio unable to unmarshal, data %+v, api %v, error %v\n", string(row), api, e)
 				}
-				out = append(out, mongo.DASErrorRecord(msg, utils.RucioErrorName, utils.RucioError))
+				rec = mongo.DASErrorRecord(msg, utils.RucioErrorName, utils.RucioError)
 			}
 			out = append(out, rec)
-			row = []byte{}
-		} else {
-			row = append(row, r)
 		}
-	}
-	// last record from Rucio does not have '\n' so we need to collect it
-	if len(row) > 0 {
-		var rec mongo.DASRecord
-		err := json.Unmarshal(row, &rec)
+		if size > 0 && len(out) == size {
+			if e := fn(out); e != nil {
+				return e
+			}
+			out = nil
+		}
 		if err != nil {
-			msg := fmt.Sprintf("Rucio unable to unmarshal the data into DAS record, api=%s, data=%s, error=%v", api, string(row), err)
-			if utils.VERBOSE > 0 {
-				log.Printf("ERROR: Rucio unable to unmarshal, data %+v, row %+v, api %v, error %v\n", string(data), string(row), api, err)
+			if err != io.EOF {
+				msg := fmt.Sprintf("Rucio unable to read the data, api=%s, error=%v", api, err)
+				out = append(out, mongo.DASErrorRecord(msg, utils.RucioErrorName, utils.RucioError))
 			}
-			out = append(out, mongo.DASErrorRecord(msg, utils.RucioErrorName, utils.RucioError))
+			break
 		}
-		out = append(out, rec)
 	}
-	return out
+	if len(out) == 0 {
+		return nil
+	}
+	return fn(out)
 }
 
 // RucioUnmarshal unmarshals Rucio data stream and return DAS records based on api
 func RucioUnmarshal(dasquery dasql.DASQuery, api string, data []byte) []mongo.DASRecord {
+	return rucioRecords(dasquery, api, loadRucioData(api, data))
+}
+
+// helper function to convert Rucio records into DAS records based on api
+func rucioRecords(dasquery dasql.DASQuery, api string, records []mongo.DASRecord) []mongo.DASRecord {
 	var out []mongo.DASRecord
-	records := loadRucioData(api, data)
 	specs := dasquery.Spec
 	rmap := make(mongo.DASRecord)
 	for _, rec := range records {
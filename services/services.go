@@ -7,12 +7,19 @@ package services
 //
 
 import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"html"
+	"io"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/dmwm/das2go/dasmaps"
 	"github.com/dmwm/das2go/dasql"
 	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/storage"
 	"github.com/dmwm/das2go/utils"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -23,6 +30,9 @@ var FrontendURL string
 // RucioURL represents Rucio URL
 var RucioURL string
 
+// CricURL represents CRIC URL
+var CricURL = "https://cms-cric.cern.ch"
+
 // remap function uses DAS notations and convert series of DAS records
 // into another set where appropriate remapping is done
 func remap(api string, records []mongo.DASRecord, notations []mongo.DASRecord) []mongo.DASRecord {
@@ -52,12 +62,25 @@ func remap(api string, records []mongo.DASRecord, notations []mongo.DASRecord) [
 	return out
 }
 
+// ErrorRecord creates DAS error record for failed upstream call of given system and api,
+// the record contains HTTP status code and kind of failure, see utils.FetchError
+func ErrorRecord(system, api string, r utils.ResponseType) mongo.DASRecord {
+	code, name := utils.SystemError(system)
+	msg := fmt.Sprintf("%s:%s upstream error, %v", system, api, r.Error)
+	rec := mongo.DASErrorRecord(utils.Truncate(msg, MaxErrorMessage), name, code)
+	rec["service"] = fmt.Sprintf("%s:%s", system, api)
+	rec["http_status"] = r.StatusCode
+	if kind := utils.ErrorKind(r.Error); kind != "" {
+		rec["error_kind"] = kind
+	}
+	return rec
+}
+
 // Unmarshal generic function to unmarshal DAS record for given system/api/data/notations
 func Unmarshal(dasquery dasql.DASQuery, system, api string, r utils.ResponseType, notations []mongo.DASRecord, pkeys []string) []mongo.DASRecord {
 	var out []mongo.DASRecord
 	if r.Error != nil {
-		rec := CreateDASErrorRecord(dasquery, pkeys)
-		out = append(out, rec)
+		out = append(out, ErrorRecord(system, api, r))
 		return out
 	}
 	data := r.Data
@@ -83,7 +106,58 @@ func Unmarshal(dasquery dasql.DASQuery, system, api string, r utils.ResponseType
 	case system == "cric":
 		out = CRICUnmarshal(api, data)
 	}
-	return remap(api, out, notations)
+	return markMalformed(remap(api, out, notations), r)
+}
+
+// helper function to mark records which can not be decoded, they carry
+// status code of the response and kind of failure of streamed body (if any)
+func markMalformed(records []mongo.DASRecord, r utils.ResponseType) []mongo.DASRecord {
+	kind := utils.FetchMalformed.String()
+	if r.Body != nil {
+		if k := utils.ErrorKind(r.Body.Err()); k != "" {
+			kind = k
+		}
+	}
+	for _, rec := range records {
+		if _, ok := rec["error"]; ok {
+			rec["http_status"] = r.StatusCode
+			rec["error_kind"] = kind
+		}
+	}
+	return records
+}
+
+// StreamBatchSize defines number of records decoded and stored at once, see StreamUnmarshal
+var StreamBatchSize = 1000
+
+// StreamUnmarshal decodes response of given system/api record by record and
+// passes DAS records to given function in batches of StreamBatchSize records,
+// such that large responses are not decoded into memory at once. Body of
+// streamed response is decoded while it is read, see utils.FetchStream. It
+// returns false if response can not be decoded in batches (e.g. api
+// aggregates all records) and should be processed by Unmarshal.
+func StreamUnmarshal(dasquery dasql.DASQuery, system, api string, r utils.ResponseType, notations []mongo.DASRecord, fn func([]mongo.DASRecord) error) (bool, error) {
+	if r.Error != nil {
+		return false, nil
+	}
+	var body io.Reader = bytes.NewReader(r.Data)
+	if r.Body != nil {
+		body = r.Body
+	}
+	batch := func(records []mongo.DASRecord) error {
+		return fn(markMalformed(remap(api, records, notations), r))
+	}
+	switch {
+	case (system == "dbs3" || system == "dbs") && api != "site4dataset" && api != "site4block":
+		return true, decodeDBSData(api, body, StreamBatchSize, func(records []mongo.DASRecord) error {
+			return batch(dbsRecords(api, records))
+		})
+	case system == "rucio" && api != "dataset4site":
+		return true, decodeRucioData(api, body, StreamBatchSize, func(records []mongo.DASRecord) error {
+			return batch(rucioRecords(dasquery, api, records))
+		})
+	}
+	return false, nil
 }
 
 // DASHeader represents DAS Header
@@ -122,18 +196,23 @@ func AdjustRecords(dasquery dasql.DASQuery, system, api string, records []mongo.
 		srv := strings.Join([]string{system, api}, ":")
 		srvs = append(srvs, srv)
 		dasheader["services"] = srvs
-		dasheader["expire"] = utils.Expire(expire)
+		SetExpire(dasheader, utils.Expire(expire))
 		dasheader["primary_key"] = pkeys[0]
 		dasheader["instance"] = dasquery.Instance
 
+		ts := time.Now().Unix()
+		dasheader["ts"] = ts
+
 		keys := utils.MapKeys(rec)
 		if utils.InList(skey, keys) {
+			dasheader["provenance"] = Provenance(rec, srv, ts)
 			rec["qhash"] = qhash
 			rec["das"] = dasheader
 			out = append(out, rec)
 		} else {
 			newrec := make(mongo.DASRecord)
 			newrec[skey] = []mongo.DASRecord{rec} // record internal type must be list
+			dasheader["provenance"] = Provenance(newrec, srv, ts)
 			newrec["qhash"] = qhash
 			newrec["das"] = dasheader
 			out = append(out, newrec)
@@ -142,6 +221,90 @@ func AdjustRecords(dasquery dasql.DASQuery, system, api string, records []mongo.
 	return out
 }
 
+// helper function to collect leaf keys (in dot notation) of given value
+func leafKeys(prefix string, val interface{}, keys map[string]bool) {
+	switch v := val.(type) {
+	case mongo.DASRecord:
+		for k, vvv := range v {
+			leafKeys(prefix+"."+k, vvv, keys)
+		}
+	case map[string]interface{}:
+		for k, vvv := range v {
+			leafKeys(prefix+"."+k, vvv, keys)
+		}
+	case []mongo.DASRecord:
+		for _, r := range v {
+			leafKeys(prefix, r, keys)
+		}
+	case []interface{}:
+		for _, r := range v {
+			switch r.(type) {
+			case mongo.DASRecord, map[string]interface{}:
+				leafKeys(prefix, r, keys)
+			default:
+				keys[prefix] = true
+			}
+		}
+	default:
+		keys[prefix] = true
+	}
+}
+
+// Provenance creates provenance list of given data record, i.e. for every leaf
+// field (in dot notation, e.g. file.size) it records the service (system:urn)
+// which supplied it and fetch timestamp. We use list of records instead of a map
+// since MongoDB does not allow dots in key names.
+func Provenance(rec mongo.DASRecord, srv string, ts int64) []mongo.DASRecord {
+	var out []mongo.DASRecord
+	keys := make(map[string]bool)
+	for k, v := range rec {
+		if k == "das" || k == "qhash" || k == "_id" {
+			continue
+		}
+		leafKeys(k, v, keys)
+	}
+	var lkeys []string
+	for k := range keys {
+		lkeys = append(lkeys, k)
+	}
+	sort.Strings(lkeys)
+	for _, k := range lkeys {
+		out = append(out, mongo.DASRecord{"key": k, "service": srv, "ts": ts})
+	}
+	return out
+}
+
+// helper function to extract provenance records from das part of DAS record
+func provenance(das mongo.DASRecord) []mongo.DASRecord {
+	var out []mongo.DASRecord
+	switch v := das["provenance"].(type) {
+	case []mongo.DASRecord:
+		out = append(out, v...)
+	case []interface{}:
+		for _, r := range v {
+			switch rec := r.(type) {
+			case mongo.DASRecord:
+				out = append(out, rec)
+			case map[string]interface{}:
+				out = append(out, mongo.Convert2DASRecord(rec))
+			}
+		}
+	}
+	return out
+}
+
+// FieldProvenance returns list of services (system:urn) along with their
+// fetch timestamps which supplied given field (in dot notation) of DAS record
+func FieldProvenance(das mongo.DASRecord, key string) []mongo.DASRecord {
+	var out []mongo.DASRecord
+	for _, rec := range provenance(das) {
+		if rec["key"] == key {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
 // CreateDASRecord creates DAS record for DAS cache
 func CreateDASRecord(dasquery dasql.DASQuery, srvs, pkeys []string) mongo.DASRecord {
 	dasrecord := make(mongo.DASRecord)
@@ -156,9 +319,18 @@ func CreateDASRecord(dasquery dasql.DASQuery, srvs, pkeys []string) mongo.DASRec
 	} else {
 		dasheader["primary_key"] = ""
 	}
-	dasheader["expire"] = utils.Expire(60) // initial expire, 60 seconds from now
+	// keep all primary keys to be able to merge records of multi-field look-ups
+	dasheader["primary_keys"] = utils.List2Set(pkeys)
+	SetExpire(dasheader, utils.Expire(60)) // initial expire, 60 seconds from now
 	dasheader["ts"] = time.Now().Unix()
 	dasheader["instance"] = dasquery.Instance
+	// keep track of individual services, each of them will report its own
+	// state such that we can present partial results while query is processing
+	states := make(mongo.DASRecord)
+	for _, srv := range srvs {
+		states[srv] = mongo.DASRecord{"status": ServicePending, "ts": time.Now().Unix()}
+	}
+	dasheader["service_status"] = states
 	dasrecord["das"] = dasheader
 	return dasrecord
 }
@@ -177,7 +349,7 @@ func CreateDASErrorRecord(dasquery dasql.DASQuery, pkeys []string) mongo.DASReco
 	} else {
 		dasheader["primary_key"] = ""
 	}
-	dasheader["expire"] = utils.Expire(600) // initial expire, 600 seconds from now
+	SetExpire(dasheader, utils.Expire(600)) // initial expire, 600 seconds from now
 	dasheader["ts"] = time.Now().Unix()
 	dasheader["instance"] = dasquery.Instance
 	dasrecord["das"] = dasheader
@@ -187,32 +359,231 @@ func CreateDASErrorRecord(dasquery dasql.DASQuery, pkeys []string) mongo.DASReco
 // GetDASRecord gets DAS record from das cache
 func GetDASRecord(dasquery dasql.DASQuery) mongo.DASRecord {
 	spec := bson.M{"qhash": dasquery.Qhash, "das.record": 0}
-	rec := mongo.Get("das", "cache", spec, 0, 1)
-	if len(rec) > 0 {
+	rec, err := storage.DB.Get(storage.Cache, spec, 0, 1)
+	if err == nil && len(rec) > 0 {
 		return rec[0]
 	}
 	return CreateDASErrorRecord(dasquery, []string{})
 }
 
-// GetMinExpire gets DAS min expire timestamp out of DAS record
+// GetMinExpire gets DAS min expire timestamp out of DAS record, the DAS record
+// keeps min expire of all data records of the query, see UpdateExpireRange
 func GetMinExpire(dasquery dasql.DASQuery) int64 {
 	expire := utils.Expire(3600)
-	spec := bson.M{"qhash": dasquery.Qhash}
-	records := mongo.Get("das", "cache", spec, 0, -1) // get all records
+	spec := bson.M{"qhash": dasquery.Qhash, "das.record": 0}
+	records, _ := storage.DB.Get(storage.Cache, spec, 0, 1)
 	for _, rec := range records {
-		dasExpire := GetExpire(rec)
-		if dasExpire < expire {
-			expire = dasExpire
+		das := rec["das"].(mongo.DASRecord)
+		for _, key := range []string{"expire", "min_expire"} {
+			if dasExpire, err := mongo.GetInt64Value(das, key); err == nil && dasExpire < expire {
+				expire = dasExpire
+			}
 		}
 	}
 	return expire
 }
 
+// SetExpire sets expire timestamp of DAS header along with its date
+// representation used by TTL indexes to remove expired records
+func SetExpire(das mongo.DASRecord, expire int64) {
+	das["expire"] = expire
+	das["expire_at"] = time.Unix(expire, 0)
+}
+
+// UpdateExpireRange updates min and max expire timestamps of data records
+// kept in DAS header of DAS record
+func UpdateExpireRange(das mongo.DASRecord, expire int64) {
+	if val, err := mongo.GetInt64Value(das, "min_expire"); err != nil || expire < val {
+		das["min_expire"] = expire
+	}
+	if val, err := mongo.GetInt64Value(das, "max_expire"); err != nil || expire > val {
+		das["max_expire"] = expire
+	}
+}
+
+// SetBytes sets das.bytes of given data records to their size in BSON format
+// and returns total size of the records. DAS cache uses das.bytes to report
+// size of query results, see mongo.Bytes
+func SetBytes(records []mongo.DASRecord) int64 {
+	var total int64
+	for _, rec := range records {
+		das, ok := rec["das"].(mongo.DASRecord)
+		if !ok {
+			continue
+		}
+		das["bytes"] = int64(0) // fixed size placeholder, such that size includes das.bytes itself
+		data, err := bson.Marshal(rec)
+		if err != nil {
+			continue
+		}
+		das["bytes"] = int64(len(data))
+		total += int64(len(data))
+	}
+	return total
+}
+
 // UpdateDASRecord updates DAS record in das cache
-func UpdateDASRecord(qhash string, dasrecord mongo.DASRecord) {
+func UpdateDASRecord(qhash string, dasrecord mongo.DASRecord) error {
 	spec := bson.M{"qhash": qhash, "das.record": 0}
 	newdata := bson.M{"query": dasrecord["query"], "qhash": dasrecord["qhash"], "instance": dasrecord["instance"], "das": dasrecord["das"]}
-	mongo.Update("das", "cache", spec, newdata)
+	return storage.DB.Update(storage.Cache, spec, newdata)
+}
+
+// ServicePending and others represent processing states of individual services
+const (
+	ServicePending = "pending"
+	ServiceOk      = "ok"
+	ServiceError   = "error"
+	ServiceSkipped = "skipped"
+)
+
+// helper function to get service states out of das part of DAS record
+func serviceStates(das mongo.DASRecord) mongo.DASRecord {
+	states := make(mongo.DASRecord)
+	switch v := das["service_status"].(type) {
+	case mongo.DASRecord:
+		states = v
+	case map[string]interface{}:
+		states = mongo.Convert2DASRecord(v)
+	}
+	return states
+}
+
+// SetServiceStatus sets processing state of given service (system:urn) in DAS record
+func SetServiceStatus(dasrecord mongo.DASRecord, srv, status string) {
+	das := dasrecord["das"].(mongo.DASRecord)
+	states := serviceStates(das)
+	states[srv] = mongo.DASRecord{"status": status, "ts": time.Now().Unix()}
+	das["service_status"] = states
+	dasrecord["das"] = das
+}
+
+// FinalizeServiceStatus marks all services which did not report their state as skipped,
+// e.g. services for which we were unable to construct an API call
+func FinalizeServiceStatus(dasrecord mongo.DASRecord) {
+	das := dasrecord["das"].(mongo.DASRecord)
+	states := serviceStates(das)
+	for srv, val := range states {
+		rec := mongo.Convert2DASRecord(val)
+		if rec == nil || rec["status"] == ServicePending {
+			states[srv] = mongo.DASRecord{"status": ServiceSkipped, "ts": time.Now().Unix()}
+		}
+	}
+	das["service_status"] = states
+	dasrecord["das"] = das
+}
+
+// MaxErrorMessage defines max size of upstream error message we keep in DAS records
+const MaxErrorMessage = 512
+
+// ServiceOutcome creates outcome record of given service (system:urn) call
+// from its response and unmarshalled data records. The outcome contains
+// service status, HTTP status code, latency (in seconds), number of retries,
+// number of records and, in case of failure, the error class (kind of failure,
+// see utils.FetchErrorKind), system error code and name (see utils/errors.go)
+// and truncated upstream error message
+func ServiceOutcome(system string, r utils.ResponseType, records []mongo.DASRecord) mongo.DASRecord {
+	rec := mongo.DASRecord{"status": ServiceOk, "ts": time.Now().Unix()}
+	rec["http_status"] = r.StatusCode
+	rec["latency"] = r.Time.Seconds()
+	rec["retries"] = r.Retries
+	if r.Cached {
+		rec["cached"] = true
+	}
+	var msg, kind string
+	nrec := 0
+	for _, r := range records {
+		if r == nil {
+			continue
+		}
+		if e, ok := r["error"]; ok {
+			if msg == "" {
+				msg = html.UnescapeString(fmt.Sprintf("%v", e))
+				kind, _ = r["error_kind"].(string)
+			}
+			continue
+		}
+		nrec++
+	}
+	rec["nrecords"] = nrec
+	if r.Error != nil {
+		msg = r.Error.Error()
+		kind = utils.ErrorKind(r.Error)
+	} else if r.StatusCode >= 400 && msg == "" {
+		msg = fmt.Sprintf("HTTP status %d, %s", r.StatusCode, string(r.Data))
+	}
+	if r.Error != nil || r.StatusCode >= 400 || msg != "" {
+		if kind == "" {
+			switch {
+			case r.StatusCode >= 300:
+				kind = utils.HTTPError(r.StatusCode, nil, nil).Kind.String()
+			case r.Error != nil:
+				kind = utils.FetchTransport.String()
+			default:
+				// error records of successful response
+				kind = utils.FetchMalformed.String()
+			}
+		}
+		code, name := utils.SystemError(system)
+		rec["status"] = ServiceError
+		rec["error_class"] = kind
+		rec["error_code"] = code
+		rec["error_system"] = name
+		rec["error"] = utils.Truncate(msg, MaxErrorMessage)
+	}
+	return rec
+}
+
+// SetStorageError marks outcome of the service as failed when its records
+// can not be stored in DAS cache
+func SetStorageError(outcome mongo.DASRecord, err error) {
+	outcome["status"] = ServiceError
+	outcome["error_class"] = "storage"
+	outcome["error_code"] = utils.MongoDBError
+	outcome["error_system"] = utils.MongoDBErrorName
+	outcome["error"] = utils.Truncate(err.Error(), MaxErrorMessage)
+}
+
+// SetServiceOutcome sets outcome record of given service (system:urn) in DAS record
+func SetServiceOutcome(dasrecord mongo.DASRecord, srv string, outcome mongo.DASRecord) {
+	das := dasrecord["das"].(mongo.DASRecord)
+	states := serviceStates(das)
+	states[srv] = outcome
+	das["service_status"] = states
+	dasrecord["das"] = das
+}
+
+// ServiceErrors returns list of service states which failed
+func ServiceErrors(states []mongo.DASRecord) []mongo.DASRecord {
+	var out []mongo.DASRecord
+	for _, rec := range states {
+		if rec["status"] == ServiceError {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// ServiceStates returns list of service states from DAS record, each entry
+// contains service name (system:urn) and its processing state
+func ServiceStates(dasrecord mongo.DASRecord) []mongo.DASRecord {
+	var out []mongo.DASRecord
+	das, ok := dasrecord["das"].(mongo.DASRecord)
+	if !ok {
+		return out
+	}
+	states := serviceStates(das)
+	keys := utils.MapKeys(states)
+	sort.Strings(keys)
+	for _, srv := range keys {
+		rec := make(mongo.DASRecord)
+		for k, v := range mongo.Convert2DASRecord(states[srv]) {
+			rec[k] = v
+		}
+		rec["service"] = srv
+		out = append(out, rec)
+	}
+	return out
 }
 
 // GetExpire helper function to get expire value from DAS/data record
@@ -222,13 +593,13 @@ func GetExpire(rec mongo.DASRecord) int64 {
 	return expire
 }
 
-// MergeDASRecords merges DAS data records
-func MergeDASRecords(dasquery dasql.DASQuery) ([]mongo.DASRecord, int64) {
+// MergeDASRecords merges DAS data records stored in DAS cache collection
+func MergeDASRecords(dasquery dasql.DASQuery) ([]mongo.DASRecord, int64, error) {
 	// get DAS record and extract primary key
 	spec := bson.M{"qhash": dasquery.Qhash, "das.record": 0}
-	records := mongo.Get("das", "cache", spec, 0, 1)
-	if len(records) == 0 {
-		return records, time.Now().Unix() + 1
+	records, err := storage.DB.Get(storage.Cache, spec, 0, 1)
+	if err != nil || len(records) == 0 {
+		return records, time.Now().Unix() + 1, err
 	}
 	dasrecord := records[0]
 	das := dasrecord["das"].(mongo.DASRecord)
@@ -240,15 +611,20 @@ func MergeDASRecords(dasquery dasql.DASQuery) ([]mongo.DASRecord, int64) {
 	var skeys []string
 	skeys = append(skeys, pkey)
 	if len(lkeys) > 1 {
-		records = mongo.Get("das", "cache", spec, 0, -1) // get all unsorted records
-		status := das["status"].(string)
 		expire := das["expire"].(int64)
+		records, err = storage.DB.Get(storage.Cache, spec, 0, -1) // get all unsorted records
+		if err != nil {
+			return records, expire, err
+		}
+		// join records from different APIs using composite key of all look-up fields
+		records = MergeMultiFieldRecords(records, lkeys, primaryKeys(das), dasquery.Qhash)
+		status := das["status"].(string)
 		for _, rec := range records {
 			das := rec["das"].(mongo.DASRecord)
 			das["status"] = status
 			rec["das"] = das
 		}
-		return records, expire
+		return records, expire, nil
 	}
 
 	// loop over data records and merge them, extract smallest expire timestamp
@@ -257,10 +633,13 @@ func MergeDASRecords(dasquery dasql.DASQuery) ([]mongo.DASRecord, int64) {
 	var out []mongo.DASRecord
 	var oldrec, rec mongo.DASRecord
 	if len(skeys) > 0 {
-		records = mongo.GetSorted("das", "cache", spec, skeys)
+		records, err = storage.DB.GetSorted(storage.Cache, spec, skeys)
+		if err != nil {
+			return records, expire, err
+		}
 	} else {
-		records = mongo.Get("das", "cache", spec, 0, -1) // get all unsorted records
-		return records, time.Now().Unix() + 300
+		records, err = storage.DB.Get(storage.Cache, spec, 0, -1) // get all unsorted records
+		return records, time.Now().Unix() + 300, err
 	}
 	for idx, rec := range records {
 		if idx == 0 { // we need to advance to new record because of init conditions above
@@ -285,7 +664,7 @@ func MergeDASRecords(dasquery dasql.DASQuery) ([]mongo.DASRecord, int64) {
 	if rec[mkey] == nil {
 		out = append(out, oldrec)
 	}
-	return out, expire
+	return out, expire, nil
 }
 
 // helper function to get DAS records from different interfaces
@@ -322,6 +701,153 @@ func mergeRecords(oldrec, newrec mongo.DASRecord, pkey, qhash string) mongo.DASR
 	return mongo.DASRecord{pkey: rec, "qhash": qhash, "das": das}
 }
 
+// MergeBatchSize defines number of records we look-up at once in DAS merge collection
+var MergeBatchSize = 1000
+
+// IncrementalMerge checks if records of DAS query with given fields and primary key
+// are merged as they arrive from data-services, see UpsertRecords. Records of
+// multi-field look-ups are merged once all services are done, see MergeDASRecords.
+func IncrementalMerge(fields []string, pkey string) bool {
+	return len(fields) == 1 && pkey != ""
+}
+
+// UpsertRetries defines how many times UpsertRecords merges again records which
+// were modified concurrently, e.g. by another DAS server using the same DAS
+// merge collection
+var UpsertRetries = 100
+
+// helper function to get _id of merged record of given query and primary key
+// value, concurrent inserts of the same record fail due to unique _id. The _id
+// is ObjectId such that it can be used in cursors, see storage.Cursor
+func mergeID(qhash, val string) bson.ObjectId {
+	sum := md5.Sum([]byte(qhash + "\x00" + val))
+	return bson.ObjectId(sum[:12])
+}
+
+// UpsertRecords merges given data records into DAS merge collection. Records
+// are keyed by (qhash, primary key value) and records with the same key are
+// merged the same way as MergeDASRecords does. The diffKeys are used to check
+// consistency of merged records, see CheckConsistency. Every merged record
+// carries revision (das.rev) and it is written back only if it was not
+// modified since it was read, such that concurrent calls for the same query,
+// in this or other DAS servers, neither lose nor duplicate records.
+func UpsertRecords(qhash, pkey string, records []mongo.DASRecord, diffKeys []string) error {
+
+	// defer function profiler
+	defer utils.MeasureTime("services/UpsertRecords")()
+
+	mkey := strings.Split(pkey, ".")[0]
+	// merge records with the same primary key value within given set of records
+	var values []string
+	merged := make(map[string]mongo.DASRecord)
+	for _, rec := range records {
+		val, _ := mongo.GetSingleStringValue(rec, pkey)
+		if oldrec, ok := merged[val]; ok {
+			merged[val] = mergeRecords(rec, oldrec, mkey, qhash)
+		} else {
+			merged[val] = rec
+			values = append(values, val)
+		}
+	}
+	// merge them with records already stored in DAS merge collection
+	for i := 0; i < len(values); i += MergeBatchSize {
+		end := i + MergeBatchSize
+		if end > len(values) {
+			end = len(values)
+		}
+		pending := values[i:end]
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt == UpsertRetries {
+				return fmt.Errorf("unable to merge %d records of query %s, they are modified concurrently", len(pending), qhash)
+			}
+			var err error
+			pending, err = upsertBatch(qhash, mkey, pending, merged, diffKeys)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// helper function to merge records of given primary key values into DAS merge
+// collection, it returns values whose records were modified concurrently and
+// should be merged again
+func upsertBatch(qhash, mkey string, values []string, merged map[string]mongo.DASRecord, diffKeys []string) ([]string, error) {
+	spec := bson.M{"qhash": qhash, "das.record": 1, "das.primary_value": bson.M{"$in": values}}
+	recs, err := storage.DB.Get(storage.Merge, spec, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]mongo.DASRecord)
+	for _, rec := range recs {
+		val, _ := mongo.GetStringValue(rec, "das.primary_value")
+		existing[val] = rec
+	}
+	rev := bson.NewObjectId().Hex()
+	var retry []string
+	var inserts []mongo.DASRecord
+	for _, val := range values {
+		rec := merged[val]
+		oldrec, ok := existing[val]
+		if ok {
+			rec = mergeRecords(rec, oldrec, mkey, qhash)
+		}
+		das := rec["das"].(mongo.DASRecord)
+		das["primary_value"] = val
+		das["rev"] = rev
+		rec["das"] = das
+		if len(services(das)) > 1 {
+			CheckConsistency([]mongo.DASRecord{rec}, mkey, diffKeys)
+		}
+		SetBytes([]mongo.DASRecord{rec})
+		if !ok {
+			rec["_id"] = mergeID(qhash, val)
+			inserts = append(inserts, rec)
+			continue
+		}
+		// replace stored record only if it has revision we read
+		uspec := bson.M{"_id": oldrec["_id"], "das.rev": bson.M{"$exists": false}}
+		if oldrev, err := mongo.GetStringValue(oldrec, "das.rev"); err == nil {
+			uspec["das.rev"] = oldrev
+		}
+		err := storage.DB.Update(storage.Merge, uspec, bson.M(rec))
+		if err == storage.ErrNotFound {
+			retry = append(retry, val)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = storage.DB.Insert(storage.Merge, inserts)
+	if err == nil || !storage.IsDup(err) {
+		return retry, err
+	}
+	// records inserted concurrently by others are merged again
+	var ids []bson.ObjectId
+	for _, rec := range inserts {
+		ids = append(ids, rec["_id"].(bson.ObjectId))
+	}
+	recs, err = storage.DB.Get(storage.Merge, bson.M{"_id": bson.M{"$in": ids}}, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	revs := make(map[bson.ObjectId]string)
+	for _, rec := range recs {
+		if id, ok := rec["_id"].(bson.ObjectId); ok {
+			revs[id], _ = mongo.GetStringValue(rec, "das.rev")
+		}
+	}
+	for _, rec := range inserts {
+		if revs[rec["_id"].(bson.ObjectId)] != rev {
+			val, _ := mongo.GetStringValue(rec, "das.primary_value")
+			retry = append(retry, val)
+		}
+	}
+	return retry, nil
+}
+
 // helper function to extract services from das record
 func services(das mongo.DASRecord) []string {
 	var srvs []string
@@ -352,6 +878,7 @@ func mergeDASparts(das1, das2 mongo.DASRecord) mongo.DASRecord {
 		srvs = append(srvs, srv)
 	}
 	das["services"] = srvs
+	das["provenance"] = append(provenance(das1), provenance(das2)...)
 	var expire int64
 	expire = time.Now().Unix() * 2
 	ex1, err1 := mongo.GetInt64Value(das1, "expire")
@@ -362,7 +889,7 @@ func mergeDASparts(das1, das2 mongo.DASRecord) mongo.DASRecord {
 	if err2 == nil && ex2 < expire {
 		expire = ex2
 	}
-	das["expire"] = expire
+	SetExpire(das, expire)
 	das["status"] = "ok" // merged step should return ok status
 	das["primary_key"] = das1["primary_key"]
 	das["instance"] = das1["instance"]
@@ -375,7 +902,7 @@ func UpdateExpire(qhash string, records []mongo.DASRecord, dasexpire int64) []mo
 	var out []mongo.DASRecord
 	for _, rec := range records {
 		das := rec["das"].(mongo.DASRecord)
-		das["expire"] = dasexpire
+		SetExpire(das, dasexpire)
 		rec["das"] = das
 		out = append(out, rec)
 	}
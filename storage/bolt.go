@@ -0,0 +1,358 @@
+package storage
+
+// DAS storage module, embedded on-disk backend based on bbolt key-value store.
+// Every DAS collection is kept in its own bucket where records are stored in
+// BSON format under their _id. Since all DAS look-ups are done by query hash
+// we also keep an index bucket with qhash+_id keys for every collection.
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dmwm/das2go/mongo"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// BoltStore implements Store interface using embedded bbolt database file
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore creates new store with given database file
+func NewBoltStore(fname string) (*BoltStore, error) {
+	db, err := bolt.Open(fname, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Close closes underlying database file
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// helper function to return name of index bucket for given collection
+func indexBucket(coll string) []byte {
+	return []byte(coll + ".qhash")
+}
+
+// helper function to build record key from its _id
+func recordKey(id interface{}) []byte {
+	if oid, ok := id.(bson.ObjectId); ok {
+		return []byte(string(oid))
+	}
+	return []byte(fmt.Sprintf("%v", id))
+}
+
+// helper function to build index key for given record
+func indexKey(rec mongo.DASRecord, key []byte) ([]byte, bool) {
+	qhash, ok := rec["qhash"].(string)
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(qhash+"\x00"), key...), true
+}
+
+// helper function to put record into collection and its index
+func putRecord(data, index *bolt.Bucket, rec mongo.DASRecord) error {
+	val, err := bson.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	key := recordKey(rec["_id"])
+	if err := data.Put(key, val); err != nil {
+		return err
+	}
+	if ikey, ok := indexKey(rec, key); ok {
+		return index.Put(ikey, nil)
+	}
+	return nil
+}
+
+// helper function to delete record from collection and its index
+func deleteRecord(data, index *bolt.Bucket, rec mongo.DASRecord) error {
+	key := recordKey(rec["_id"])
+	if err := data.Delete(key); err != nil {
+		return err
+	}
+	if ikey, ok := indexKey(rec, key); ok {
+		return index.Delete(ikey)
+	}
+	return nil
+}
+
+// helper function to find records matching given spec. If spec contains _id
+// we look-up single record, if it contains qhash we only scan records from
+// the index, otherwise we scan whole bucket.
+// The callback function receives every matched record along with its size.
+func find(tx *bolt.Tx, coll string, spec bson.M, fn func(rec mongo.DASRecord, size int) bool) error {
+	data := tx.Bucket([]byte(coll))
+	if data == nil {
+		return nil
+	}
+	check := func(val []byte) (bool, error) {
+		var rec mongo.DASRecord
+		if err := bson.Unmarshal(val, &rec); err != nil {
+			return false, err
+		}
+		if !Match(rec, spec) {
+			return true, nil
+		}
+		return fn(rec, len(val)), nil
+	}
+	if id, ok := spec["_id"].(bson.ObjectId); ok {
+		if val := data.Get(recordKey(id)); val != nil {
+			_, err := check(val)
+			return err
+		}
+		return nil
+	}
+	index := tx.Bucket(indexBucket(coll))
+	if qhash, ok := spec["qhash"].(string); ok && index != nil {
+		prefix := []byte(qhash + "\x00")
+		c := index.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			val := data.Get(k[len(prefix):])
+			if val == nil {
+				continue
+			}
+			next, err := check(val)
+			if err != nil {
+				return err
+			}
+			if !next {
+				return nil
+			}
+		}
+		return nil
+	}
+	c := data.Cursor()
+	for k, val := c.First(); k != nil; k, val = c.Next() {
+		next, err := check(val)
+		if err != nil {
+			return err
+		}
+		if !next {
+			return nil
+		}
+	}
+	return nil
+}
+
+// helper function to collect all records matching given spec
+func (s *BoltStore) records(coll string, spec bson.M) ([]mongo.DASRecord, error) {
+	var out []mongo.DASRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return find(tx, coll, spec, func(rec mongo.DASRecord, size int) bool {
+			out = append(out, rec)
+			return true
+		})
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to read records, collection %s, spec %v, error %v\n", coll, spec, err)
+	}
+	return out, err
+}
+
+// Insert records into given collection
+func (s *BoltStore) Insert(coll string, records []mongo.DASRecord) error {
+	var dup error
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		data, err := tx.CreateBucketIfNotExists([]byte(coll))
+		if err != nil {
+			return err
+		}
+		index, err := tx.CreateBucketIfNotExists(indexBucket(coll))
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			rec := make(mongo.DASRecord)
+			for k, v := range r {
+				rec[k] = v
+			}
+			if _, ok := rec["_id"]; !ok {
+				rec["_id"] = bson.NewObjectId()
+			}
+			if data.Get(recordKey(rec["_id"])) != nil {
+				dup = ErrDuplicate
+				continue
+			}
+			if err := putRecord(data, index, rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("Fail to insert DAS record", err)
+		return err
+	}
+	return dup
+}
+
+// Get records from given collection
+func (s *BoltStore) Get(coll string, spec bson.M, idx, limit int) ([]mongo.DASRecord, error) {
+	var out []mongo.DASRecord
+	if idx < 0 {
+		idx = 0
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return find(tx, coll, spec, func(rec mongo.DASRecord, size int) bool {
+			if idx > 0 {
+				idx--
+				return true
+			}
+			out = append(out, rec)
+			return limit <= 0 || len(out) < limit
+		})
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to read records, collection %s, spec %v, error %v\n", coll, spec, err)
+	}
+	if out == nil {
+		out = []mongo.DASRecord{}
+	}
+	return out, err
+}
+
+// GetSorted records from given collection sorted by given keys
+func (s *BoltStore) GetSorted(coll string, spec bson.M, skeys []string) ([]mongo.DASRecord, error) {
+	records, err := s.records(coll, spec)
+	if err != nil {
+		return []mongo.DASRecord{}, err
+	}
+	Sort(records, skeys)
+	return slice(records, 0, -1, nil)
+}
+
+// GetFilteredSorted records from given collection with selected fields and sorted by given keys
+func (s *BoltStore) GetFilteredSorted(coll string, spec bson.M, fields, skeys []string, idx, limit int) ([]mongo.DASRecord, error) {
+	records, err := s.records(coll, spec)
+	if err != nil {
+		return []mongo.DASRecord{}, err
+	}
+	Sort(records, skeys)
+	fields = append(fields, "das") // always extract das part of the record
+	return slice(records, idx, limit, fields)
+}
+
+// Iterate calls given function for records from given collection ordered by given keys and _id
+func (s *BoltStore) Iterate(coll string, spec bson.M, fields, skeys []string, idx, limit int, fn func(rec mongo.DASRecord) error) error {
+	records, err := s.records(coll, spec)
+	if err != nil {
+		return err
+	}
+	return iterate(records, fields, skeys, idx, limit, fn)
+}
+
+// Update first record matching given spec in given collection, it returns
+// ErrNotFound if there is no such record
+func (s *BoltStore) Update(coll string, spec, newdata bson.M) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var orig mongo.DASRecord
+		err := find(tx, coll, spec, func(rec mongo.DASRecord, size int) bool {
+			orig = rec
+			return false
+		})
+		if err != nil {
+			return err
+		}
+		if orig == nil {
+			return ErrNotFound
+		}
+		update, err := Copy(mongo.DASRecord(newdata))
+		if err != nil {
+			return err
+		}
+		old, err := Copy(orig)
+		if err != nil {
+			return err
+		}
+		rec, err := Apply(orig, bson.M(update))
+		if err != nil {
+			return err
+		}
+		data := tx.Bucket([]byte(coll))
+		index := tx.Bucket(indexBucket(coll))
+		if err := deleteRecord(data, index, old); err != nil {
+			return err
+		}
+		return putRecord(data, index, rec)
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to update record, spec %v, data %+v, error %v\n", spec, newdata, err)
+	}
+	return err
+}
+
+// Count records in given collection
+func (s *BoltStore) Count(coll string, spec bson.M) (int, error) {
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return find(tx, coll, spec, func(rec mongo.DASRecord, size int) bool {
+			count++
+			return true
+		})
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to count records, collection %s, spec %v, error %v\n", coll, spec, err)
+	}
+	return count, err
+}
+
+// Bytes returns size of records in given collection
+func (s *BoltStore) Bytes(coll string, spec bson.M) (int, error) {
+	total := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return find(tx, coll, spec, func(rec mongo.DASRecord, size int) bool {
+			total += size
+			return true
+		})
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to get size of records, collection %s, spec %v, error %v\n", coll, spec, err)
+	}
+	return total, err
+}
+
+// Remove records from given collection
+func (s *BoltStore) Remove(coll string, spec bson.M) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var records []mongo.DASRecord
+		err := find(tx, coll, spec, func(rec mongo.DASRecord, size int) bool {
+			records = append(records, rec)
+			return true
+		})
+		if err != nil || len(records) == 0 {
+			return err
+		}
+		data := tx.Bucket([]byte(coll))
+		index := tx.Bucket(indexBucket(coll))
+		for _, rec := range records {
+			if err := deleteRecord(data, index, rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to remove records, collection %s, spec %v, error %v\n", coll, spec, err)
+	}
+	return err
+}
+
+// CreateIndexes is no-op for bolt store, the qhash index is always maintained
+func (s *BoltStore) CreateIndexes(coll string, keys []string) error {
+	return nil
+}
+
+// CreateTTLIndex starts removal of records whose date key is older than expireAfter
+func (s *BoltStore) CreateTTLIndex(coll, key string, expireAfter time.Duration) error {
+	go reap(s, coll, key, expireAfter)
+	return nil
+}
@@ -0,0 +1,129 @@
+package storage
+
+// DAS storage module, cursors of ordered sets of records
+// Cursor points to a record in set of records ordered by sort keys and _id,
+// it is passed to clients as opaque token and allows to read next (or
+// previous) page of records without skipping all records before the page.
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/dmwm/das2go/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Cursor represents position of a record in set of records ordered by sort keys and _id
+type Cursor struct {
+	Values []interface{} `bson:"v"`            // values of sort keys
+	ID     bson.ObjectId `bson:"id,omitempty"` // record _id, empty for end of set
+	Prev   bool          `bson:"p,omitempty"`  // cursor selects records placed before the record
+}
+
+// EndCursor returns cursor which selects last records of the set
+func EndCursor() Cursor {
+	return Cursor{Prev: true}
+}
+
+// ReverseKeys returns sort keys of reversed order of records, i.e. given
+// keys with opposite directions followed by -_id
+func ReverseKeys(skeys []string) []string {
+	var out []string
+	for _, skey := range mongo.OrderKeys(skeys) {
+		if strings.HasPrefix(skey, "-") {
+			out = append(out, strings.TrimPrefix(skey, "-"))
+		} else {
+			out = append(out, "-"+strings.TrimPrefix(skey, "+"))
+		}
+	}
+	return out
+}
+
+// NewCursor creates cursor pointing to given record of set ordered by given sort keys
+func NewCursor(rec mongo.DASRecord, skeys []string) Cursor {
+	var vals []interface{}
+	for _, skey := range skeys {
+		vals = append(vals, sortValue(rec, strings.TrimLeft(skey, "+-"), strings.HasPrefix(skey, "-")))
+	}
+	id, _ := rec["_id"].(bson.ObjectId)
+	return Cursor{Values: vals, ID: id}
+}
+
+// Encode returns opaque token of the cursor
+func (c Cursor) Encode() string {
+	data, err := bson.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor decodes cursor from given token
+func DecodeCursor(token string) (Cursor, error) {
+	var c Cursor
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, errors.New("invalid cursor")
+	}
+	if err := bson.Unmarshal(data, &c); err != nil || !(c.ID.Valid() || c.Prev && c.ID == "") {
+		return c, errors.New("invalid cursor")
+	}
+	return c, nil
+}
+
+// Spec returns spec which selects records placed after the cursor in set of
+// records ordered by given sort keys and _id. Records without sort key
+// (null values) are placed first in ascending and last in descending order.
+// Records with multiple values of sort key (e.g. list of files) are ordered
+// by the smallest value in ascending and by the largest value in descending
+// order, therefore all their values are compared with the cursor. Records
+// before the cursor are records after it in reversed order, see ReverseKeys.
+func (c Cursor) Spec(skeys []string) (bson.M, error) {
+	if c.Prev && c.ID == "" {
+		return bson.M{}, nil
+	}
+	if len(skeys) != len(c.Values) {
+		return nil, errors.New("cursor does not match sort keys")
+	}
+	idCond := bson.M{"$gt": c.ID}
+	if c.Prev {
+		keys := ReverseKeys(skeys)
+		skeys = keys[:len(keys)-1]
+		idCond = bson.M{"$lt": c.ID}
+	}
+	var conds []interface{}
+	prefix := bson.M{}
+	// helper function to add condition to the conditions with equal prefix
+	add := func(key string, cond interface{}) {
+		spec := bson.M{key: cond}
+		for k, v := range prefix {
+			spec[k] = v
+		}
+		conds = append(conds, spec)
+	}
+	for idx, skey := range skeys {
+		desc := strings.HasPrefix(skey, "-")
+		key := strings.TrimLeft(skey, "+-")
+		val := c.Values[idx]
+		switch {
+		case val == nil && !desc:
+			add(key, bson.M{"$ne": nil})
+		case desc && val != nil:
+			add(key, bson.M{"$lt": val, "$not": bson.M{"$gte": val}})
+			add(key, nil)
+		case !desc:
+			add(key, bson.M{"$gt": val, "$not": bson.M{"$lte": val}})
+		}
+		switch {
+		case val == nil:
+			prefix[key] = nil
+		case desc:
+			prefix[key] = bson.M{"$eq": val, "$not": bson.M{"$gt": val}}
+		default:
+			prefix[key] = bson.M{"$eq": val, "$not": bson.M{"$lt": val}}
+		}
+	}
+	add("_id", idCond)
+	return bson.M{"$or": conds}, nil
+}
@@ -0,0 +1,520 @@
+package storage
+
+// DAS storage module, generic query engine used by embedded backends.
+// It implements subset of MongoDB query language used by DAS: look-up by
+// (dotted) keys which traverse lists of records, comparison operators,
+// regular expressions, sorting, projections and updates.
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dmwm/das2go/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// helper function to convert given value to a map if possible
+func toMap(val interface{}) (map[string]interface{}, bool) {
+	switch v := val.(type) {
+	case mongo.DASRecord:
+		return v, true
+	case bson.M:
+		return v, true
+	case map[string]interface{}:
+		return v, true
+	}
+	return nil, false
+}
+
+// helper function to convert given value to a list if possible
+func toList(val interface{}) ([]interface{}, bool) {
+	switch v := val.(type) {
+	case []interface{}:
+		return v, true
+	case []mongo.DASRecord:
+		var out []interface{}
+		for _, r := range v {
+			out = append(out, r)
+		}
+		return out, true
+	case []string:
+		var out []interface{}
+		for _, r := range v {
+			out = append(out, r)
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+// helper function to find all values of given (dotted) key, lists are traversed
+// the same way as MongoDB does, i.e. a.b matches b key of all records in list a
+func lookup(val interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		return []interface{}{val}
+	}
+	if m, ok := toMap(val); ok {
+		if sub, ok := m[parts[0]]; ok {
+			return lookup(sub, parts[1:])
+		}
+		return nil
+	}
+	if list, ok := toList(val); ok {
+		var out []interface{}
+		for _, elem := range list {
+			if _, ok := toMap(elem); ok {
+				out = append(out, lookup(elem, parts)...)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// helper function to look-up values of given key, list values are expanded
+func values(rec mongo.DASRecord, key string) ([]interface{}, bool) {
+	found := lookup(rec, strings.Split(key, "."))
+	var out []interface{}
+	for _, val := range found {
+		out = append(out, val)
+		if list, ok := toList(val); ok {
+			out = append(out, list...)
+		}
+	}
+	return out, len(found) > 0
+}
+
+// helper function to convert value to float
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// helper function to compare two values, it returns comparison result and
+// a flag if values are comparable
+func compare(v1, v2 interface{}) (int, bool) {
+	if f1, ok := toFloat(v1); ok {
+		if f2, ok := toFloat(v2); ok {
+			switch {
+			case f1 < f2:
+				return -1, true
+			case f1 > f2:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	if s1, ok := v1.(string); ok {
+		if s2, ok := v2.(string); ok {
+			return strings.Compare(s1, s2), true
+		}
+		return 0, false
+	}
+	if id1, ok := v1.(bson.ObjectId); ok {
+		if id2, ok := v2.(bson.ObjectId); ok {
+			return strings.Compare(string(id1), string(id2)), true
+		}
+		return 0, false
+	}
+	if t1, ok := v1.(time.Time); ok {
+		if t2, ok := v2.(time.Time); ok {
+			switch {
+			case t1.Before(t2):
+				return -1, true
+			case t1.After(t2):
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	if v1 == nil && v2 == nil {
+		return 0, true
+	}
+	if b1, ok := v1.(bool); ok {
+		if b2, ok := v2.(bool); ok && b1 == b2 {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+// helper function to check equality of two values
+func equal(v1, v2 interface{}) bool {
+	if res, ok := compare(v1, v2); ok {
+		return res == 0
+	}
+	return false
+}
+
+// helper function to match value against regular expression
+func matchRegex(vals []interface{}, pattern, options string) bool {
+	if strings.Contains(options, "i") {
+		pattern = "(?i)" + pattern
+	}
+	pat, err := regexp.Compile(pattern)
+	if err != nil {
+		return false
+	}
+	for _, val := range vals {
+		if s, ok := val.(string); ok && pat.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// helper function to match values against given operator condition
+func matchOperator(vals []interface{}, exists bool, op string, cond interface{}) bool {
+	cmp := func(check func(int) bool) bool {
+		for _, val := range vals {
+			if res, ok := compare(val, cond); ok && check(res) {
+				return true
+			}
+		}
+		return false
+	}
+	switch op {
+	case "$eq":
+		return cmp(func(r int) bool { return r == 0 })
+	case "$ne":
+		return !cmp(func(r int) bool { return r == 0 })
+	case "$gt":
+		return cmp(func(r int) bool { return r > 0 })
+	case "$gte", "$ge":
+		return cmp(func(r int) bool { return r >= 0 })
+	case "$lt":
+		return cmp(func(r int) bool { return r < 0 })
+	case "$lte", "$le":
+		return cmp(func(r int) bool { return r <= 0 })
+	case "$in", "$nin":
+		found := false
+		if list, ok := toList(cond); ok {
+			for _, c := range list {
+				for _, val := range vals {
+					if equal(val, c) {
+						found = true
+					}
+				}
+			}
+		}
+		if op == "$in" {
+			return found
+		}
+		return !found
+	case "$exists":
+		if b, ok := cond.(bool); ok {
+			return b == exists
+		}
+		return exists
+	case "$regex":
+		return matchRegex(vals, fmt.Sprintf("%v", cond), "")
+	case "$not":
+		return !matchCondition(vals, exists, cond)
+	}
+	return false
+}
+
+// helper function to match values against given condition
+func matchCondition(vals []interface{}, exists bool, cond interface{}) bool {
+	if !exists {
+		vals = []interface{}{nil} // missing key is matched as null value, like in MongoDB
+	}
+	switch c := cond.(type) {
+	case bson.RegEx:
+		return matchRegex(vals, c.Pattern, c.Options)
+	case *regexp.Regexp:
+		return matchRegex(vals, c.String(), "")
+	}
+	if m, ok := toMap(cond); ok {
+		isOperator := len(m) > 0
+		for k := range m {
+			if !strings.HasPrefix(k, "$") {
+				isOperator = false
+			}
+		}
+		if isOperator {
+			for op, c := range m {
+				if !matchOperator(vals, exists, op, c) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	for _, val := range vals {
+		if equal(val, cond) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match checks if given record matches given spec
+func Match(rec mongo.DASRecord, spec bson.M) bool {
+	for key, cond := range spec {
+		switch key {
+		case "$and", "$or":
+			list, _ := toList(cond)
+			matched := key == "$and"
+			for _, item := range list {
+				m, _ := toMap(item)
+				res := Match(rec, bson.M(m))
+				if key == "$and" && !res {
+					matched = false
+					break
+				}
+				if key == "$or" && res {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+			continue
+		}
+		vals, exists := values(rec, key)
+		if !matchCondition(vals, exists, cond) {
+			return false
+		}
+	}
+	return true
+}
+
+// helper function to get sort value of given record, like in MongoDB the
+// smallest of multiple values of the key is used in ascending order and the
+// largest one in descending order
+func sortValue(rec mongo.DASRecord, key string, desc bool) interface{} {
+	var out interface{}
+	found := false
+	for _, val := range lookup(rec, strings.Split(key, ".")) {
+		vals := []interface{}{val}
+		if list, ok := toList(val); ok {
+			vals = list
+		}
+		for _, v := range vals {
+			if res := order(v, out); !found || (desc && res > 0) || (!desc && res < 0) {
+				out = v
+				found = true
+			}
+		}
+	}
+	return out
+}
+
+// helper function to compare two values of sort key, values of different
+// types are ordered by their type
+func order(v1, v2 interface{}) int {
+	res, ok := compare(v1, v2)
+	if !ok {
+		res = typeOrder(v1) - typeOrder(v2)
+	}
+	return res
+}
+
+// helper function to define order of different value types, similar to MongoDB
+func typeOrder(val interface{}) int {
+	if val == nil {
+		return 0
+	}
+	if _, ok := toFloat(val); ok {
+		return 1
+	}
+	if _, ok := val.(string); ok {
+		return 2
+	}
+	return 3
+}
+
+// Sort sorts records by given keys, key prefixed with minus sign defines descending order
+func Sort(records []mongo.DASRecord, skeys []string) {
+	if len(skeys) == 0 {
+		return
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		for _, skey := range skeys {
+			desc := strings.HasPrefix(skey, "-")
+			key := strings.TrimLeft(skey, "+-")
+			res := order(sortValue(records[i], key, desc), sortValue(records[j], key, desc))
+			if res == 0 {
+				continue
+			}
+			if desc {
+				return res > 0
+			}
+			return res < 0
+		}
+		return false
+	})
+}
+
+// helper function to copy given (dotted) key from source to destination record
+func copyPath(src, dst mongo.DASRecord, parts []string) {
+	val, ok := src[parts[0]]
+	if !ok {
+		return
+	}
+	key := parts[0]
+	if len(parts) == 1 {
+		dst[key] = val
+		return
+	}
+	if m, ok := toMap(val); ok {
+		sub, ok := dst[key].(mongo.DASRecord)
+		if !ok {
+			sub = make(mongo.DASRecord)
+		}
+		copyPath(mongo.DASRecord(m), sub, parts[1:])
+		dst[key] = sub
+		return
+	}
+	if list, ok := toList(val); ok {
+		var docs []mongo.DASRecord
+		for _, elem := range list {
+			if m, ok := toMap(elem); ok {
+				docs = append(docs, mongo.DASRecord(m))
+			}
+		}
+		sub, ok := dst[key].([]interface{})
+		if !ok || len(sub) != len(docs) {
+			sub = make([]interface{}, len(docs))
+			for idx := range sub {
+				sub[idx] = make(mongo.DASRecord)
+			}
+		}
+		for idx, doc := range docs {
+			copyPath(doc, sub[idx].(mongo.DASRecord), parts[1:])
+		}
+		dst[key] = sub
+	}
+}
+
+// Project returns record with selected fields only, _id is always selected
+func Project(rec mongo.DASRecord, fields []string) mongo.DASRecord {
+	if len(fields) == 0 {
+		return rec
+	}
+	out := make(mongo.DASRecord)
+	if id, ok := rec["_id"]; ok {
+		out["_id"] = id
+	}
+	for _, field := range fields {
+		copyPath(rec, out, strings.Split(field, "."))
+	}
+	return out
+}
+
+// helper function to set value of given (dotted) key
+func setPath(rec mongo.DASRecord, parts []string, val interface{}) {
+	if len(parts) == 1 {
+		rec[parts[0]] = val
+		return
+	}
+	var sub mongo.DASRecord
+	if m, ok := toMap(rec[parts[0]]); ok {
+		sub = mongo.DASRecord(m)
+	} else {
+		sub = make(mongo.DASRecord)
+	}
+	setPath(sub, parts[1:], val)
+	rec[parts[0]] = sub
+}
+
+// helper function to unset value of given (dotted) key
+func unsetPath(rec mongo.DASRecord, parts []string) {
+	if len(parts) == 1 {
+		delete(rec, parts[0])
+		return
+	}
+	if m, ok := toMap(rec[parts[0]]); ok {
+		unsetPath(mongo.DASRecord(m), parts[1:])
+	}
+}
+
+// Apply applies given update to a record, the update may either contain update
+// operators ($set, $unset, $inc) or represent new content of the record
+func Apply(rec mongo.DASRecord, update bson.M) (mongo.DASRecord, error) {
+	isOperator := false
+	for k := range update {
+		if strings.HasPrefix(k, "$") {
+			isOperator = true
+		}
+	}
+	if !isOperator {
+		out := make(mongo.DASRecord)
+		for k, v := range update {
+			out[k] = v
+		}
+		if id, ok := rec["_id"]; ok {
+			out["_id"] = id
+		}
+		return out, nil
+	}
+	for op, val := range update {
+		m, ok := toMap(val)
+		if !ok {
+			return rec, fmt.Errorf("invalid update %v", update)
+		}
+		for key, v := range m {
+			parts := strings.Split(key, ".")
+			switch op {
+			case "$set":
+				setPath(rec, parts, v)
+			case "$unset":
+				unsetPath(rec, parts)
+			case "$inc":
+				inc, ok := toFloat(v)
+				if !ok {
+					return rec, fmt.Errorf("invalid $inc value %v", v)
+				}
+				var cur interface{}
+				if vals := lookup(rec, parts); len(vals) > 0 {
+					cur = vals[0]
+				}
+				switch c := cur.(type) {
+				case int:
+					setPath(rec, parts, c+int(inc))
+				case int64:
+					setPath(rec, parts, c+int64(inc))
+				case float64:
+					setPath(rec, parts, c+inc)
+				case nil:
+					setPath(rec, parts, v)
+				default:
+					return rec, fmt.Errorf("unable to increment %v", cur)
+				}
+			default:
+				return rec, fmt.Errorf("unsupported update operator %s", op)
+			}
+		}
+	}
+	return rec, nil
+}
+
+// Copy returns deep copy of given record with BSON data types, i.e. the same
+// types as records fetched from MongoDB
+func Copy(rec mongo.DASRecord) (mongo.DASRecord, error) {
+	data, err := bson.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	var out mongo.DASRecord
+	err = bson.Unmarshal(data, &out)
+	return out, err
+}
@@ -0,0 +1,213 @@
+package storage
+
+// DAS storage module, in-memory backend
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dmwm/das2go/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MemoryStore implements Store interface using in-memory collections,
+// records are stored as copies with BSON data types, i.e. they look
+// exactly like records fetched from MongoDB
+type MemoryStore struct {
+	sync.RWMutex
+	collections map[string][]mongo.DASRecord
+}
+
+// NewMemoryStore creates new in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{collections: make(map[string][]mongo.DASRecord)}
+}
+
+// helper function to find records matching given spec, must be called under lock
+func (s *MemoryStore) find(coll string, spec bson.M) []mongo.DASRecord {
+	var out []mongo.DASRecord
+	for _, rec := range s.collections[coll] {
+		if Match(rec, spec) {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+// helper function to return copies of records within given index/limit range
+func slice(records []mongo.DASRecord, idx, limit int, fields []string) ([]mongo.DASRecord, error) {
+	out := []mongo.DASRecord{}
+	if idx < 0 {
+		idx = 0
+	}
+	for i := idx; i < len(records); i++ {
+		if limit > 0 && len(out) == limit {
+			break
+		}
+		rec, err := Copy(Project(records[i], fields))
+		if err != nil {
+			return out, err
+		}
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+// helper function to pass records within given index/limit range ordered by
+// given keys and _id to given function
+func iterate(records []mongo.DASRecord, fields, skeys []string, idx, limit int, fn func(rec mongo.DASRecord) error) error {
+	Sort(records, mongo.OrderKeys(skeys))
+	if idx < 0 {
+		idx = 0
+	}
+	for i := idx; i < len(records); i++ {
+		if limit > 0 && i-idx == limit {
+			break
+		}
+		if err := fn(Project(records[i], fields)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Insert records into given collection
+func (s *MemoryStore) Insert(coll string, records []mongo.DASRecord) error {
+	s.Lock()
+	defer s.Unlock()
+	ids := make(map[string]bool)
+	for _, rec := range s.collections[coll] {
+		ids[string(recordKey(rec["_id"]))] = true
+	}
+	var dup error
+	for _, r := range records {
+		rec, err := Copy(r)
+		if err != nil {
+			log.Println("Fail to insert DAS record", err)
+			return err
+		}
+		if _, ok := rec["_id"]; !ok {
+			rec["_id"] = bson.NewObjectId()
+		}
+		key := string(recordKey(rec["_id"]))
+		if ids[key] {
+			dup = ErrDuplicate
+			continue
+		}
+		ids[key] = true
+		s.collections[coll] = append(s.collections[coll], rec)
+	}
+	return dup
+}
+
+// Get records from given collection
+func (s *MemoryStore) Get(coll string, spec bson.M, idx, limit int) ([]mongo.DASRecord, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return slice(s.find(coll, spec), idx, limit, nil)
+}
+
+// GetSorted records from given collection sorted by given keys
+func (s *MemoryStore) GetSorted(coll string, spec bson.M, skeys []string) ([]mongo.DASRecord, error) {
+	s.RLock()
+	defer s.RUnlock()
+	records := s.find(coll, spec)
+	Sort(records, skeys)
+	return slice(records, 0, -1, nil)
+}
+
+// GetFilteredSorted records from given collection with selected fields and sorted by given keys
+func (s *MemoryStore) GetFilteredSorted(coll string, spec bson.M, fields, skeys []string, idx, limit int) ([]mongo.DASRecord, error) {
+	s.RLock()
+	defer s.RUnlock()
+	records := s.find(coll, spec)
+	Sort(records, skeys)
+	fields = append(fields, "das") // always extract das part of the record
+	return slice(records, idx, limit, fields)
+}
+
+// Iterate calls given function for records from given collection ordered by given keys and _id
+func (s *MemoryStore) Iterate(coll string, spec bson.M, fields, skeys []string, idx, limit int, fn func(rec mongo.DASRecord) error) error {
+	s.RLock()
+	records, err := slice(s.find(coll, spec), 0, -1, nil)
+	s.RUnlock()
+	if err != nil {
+		return err
+	}
+	return iterate(records, fields, skeys, idx, limit, fn)
+}
+
+// Update first record matching given spec in given collection, it returns
+// ErrNotFound if there is no such record
+func (s *MemoryStore) Update(coll string, spec, newdata bson.M) error {
+	s.Lock()
+	defer s.Unlock()
+	for idx, rec := range s.collections[coll] {
+		if !Match(rec, spec) {
+			continue
+		}
+		update, err := Copy(mongo.DASRecord(newdata))
+		if err != nil {
+			return err
+		}
+		// work on a copy of the record to keep it intact in case of errors
+		orig, err := Copy(rec)
+		if err == nil {
+			orig, err = Apply(orig, bson.M(update))
+		}
+		if err != nil {
+			return err
+		}
+		s.collections[coll][idx] = orig
+		return nil
+	}
+	return ErrNotFound
+}
+
+// Count records in given collection
+func (s *MemoryStore) Count(coll string, spec bson.M) (int, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.find(coll, spec)), nil
+}
+
+// Bytes returns size of records in given collection
+func (s *MemoryStore) Bytes(coll string, spec bson.M) (int, error) {
+	s.RLock()
+	defer s.RUnlock()
+	size := 0
+	for _, rec := range s.find(coll, spec) {
+		data, err := bson.Marshal(rec)
+		if err != nil {
+			return size, err
+		}
+		size += len(data)
+	}
+	return size, nil
+}
+
+// Remove records from given collection
+func (s *MemoryStore) Remove(coll string, spec bson.M) error {
+	s.Lock()
+	defer s.Unlock()
+	var out []mongo.DASRecord
+	for _, rec := range s.collections[coll] {
+		if !Match(rec, spec) {
+			out = append(out, rec)
+		}
+	}
+	s.collections[coll] = out
+	return nil
+}
+
+// CreateIndexes is no-op for in-memory store
+func (s *MemoryStore) CreateIndexes(coll string, keys []string) error {
+	return nil
+}
+
+// CreateTTLIndex starts removal of records whose date key is older than expireAfter
+func (s *MemoryStore) CreateTTLIndex(coll, key string, expireAfter time.Duration) error {
+	go reap(s, coll, key, expireAfter)
+	return nil
+}
@@ -0,0 +1,87 @@
+package storage
+
+// DAS storage module, MongoDB backend
+
+import (
+	"time"
+
+	"github.com/dmwm/das2go/mongo"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MongoStore implements Store interface using MongoDB
+type MongoStore struct{}
+
+// helper function to map DAS collection into MongoDB database and collection names
+func mongoNames(coll string) (string, string) {
+	if coll == Maps {
+		return "mapping", "db"
+	}
+	return "das", coll
+}
+
+// Insert records into given collection
+func (s *MongoStore) Insert(coll string, records []mongo.DASRecord) error {
+	dbname, cname := mongoNames(coll)
+	return mongo.Insert(dbname, cname, records)
+}
+
+// Get records from given collection
+func (s *MongoStore) Get(coll string, spec bson.M, idx, limit int) ([]mongo.DASRecord, error) {
+	dbname, cname := mongoNames(coll)
+	return mongo.Get(dbname, cname, spec, idx, limit)
+}
+
+// GetSorted records from given collection sorted by given keys
+func (s *MongoStore) GetSorted(coll string, spec bson.M, skeys []string) ([]mongo.DASRecord, error) {
+	dbname, cname := mongoNames(coll)
+	return mongo.GetSorted(dbname, cname, spec, skeys)
+}
+
+// GetFilteredSorted records from given collection with selected fields and sorted by given keys
+func (s *MongoStore) GetFilteredSorted(coll string, spec bson.M, fields, skeys []string, idx, limit int) ([]mongo.DASRecord, error) {
+	dbname, cname := mongoNames(coll)
+	return mongo.GetFilteredSorted(dbname, cname, spec, fields, skeys, idx, limit)
+}
+
+// Iterate calls given function for records from given collection ordered by given keys and _id
+func (s *MongoStore) Iterate(coll string, spec bson.M, fields, skeys []string, idx, limit int, fn func(rec mongo.DASRecord) error) error {
+	dbname, cname := mongoNames(coll)
+	return mongo.Iterate(dbname, cname, spec, fields, skeys, idx, limit, fn)
+}
+
+// Update record in given collection
+func (s *MongoStore) Update(coll string, spec, newdata bson.M) error {
+	dbname, cname := mongoNames(coll)
+	return mongo.Update(dbname, cname, spec, newdata)
+}
+
+// Count records in given collection
+func (s *MongoStore) Count(coll string, spec bson.M) (int, error) {
+	dbname, cname := mongoNames(coll)
+	return mongo.Count(dbname, cname, spec)
+}
+
+// Bytes returns size of records in given collection
+func (s *MongoStore) Bytes(coll string, spec bson.M) (int, error) {
+	dbname, cname := mongoNames(coll)
+	return mongo.Bytes(dbname, cname, spec)
+}
+
+// Remove records from given collection
+func (s *MongoStore) Remove(coll string, spec bson.M) error {
+	dbname, cname := mongoNames(coll)
+	return mongo.Remove(dbname, cname, spec)
+}
+
+// CreateIndexes creates indexes in given collection
+func (s *MongoStore) CreateIndexes(coll string, keys []string) error {
+	dbname, cname := mongoNames(coll)
+	return mongo.CreateIndexes(dbname, cname, keys)
+}
+
+// CreateTTLIndex creates TTL index on given date key in given collection
+func (s *MongoStore) CreateTTLIndex(coll, key string, expireAfter time.Duration) error {
+	dbname, cname := mongoNames(coll)
+	return mongo.CreateTTLIndex(dbname, cname, key, expireAfter)
+}
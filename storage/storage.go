@@ -0,0 +1,97 @@
+package storage
+
+// DAS storage module
+// It defines storage interface used by DAS to keep its cache, merge,
+// audit and DAS maps collections along with its implementations
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/dmwm/das2go/mongo"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Cache and others represent names of DAS collections
+const (
+	Cache = "cache" // DAS cache collection with raw records from data-services
+	Merge = "merge" // DAS merge collection with merged records
+	Audit = "audit" // DAS audit collection with records of administrative actions
+	Maps  = "maps"  // DAS maps collection
+)
+
+// Store defines interface of DAS storage backend. The spec and update
+// arguments follow MongoDB query language, e.g. {"das.expire": {"$lt": ts}}
+type Store interface {
+	Insert(coll string, records []mongo.DASRecord) error
+	Get(coll string, spec bson.M, idx, limit int) ([]mongo.DASRecord, error)
+	GetSorted(coll string, spec bson.M, skeys []string) ([]mongo.DASRecord, error)
+	GetFilteredSorted(coll string, spec bson.M, fields, skeys []string, idx, limit int) ([]mongo.DASRecord, error)
+	Iterate(coll string, spec bson.M, fields, skeys []string, idx, limit int, fn func(rec mongo.DASRecord) error) error
+	Update(coll string, spec, newdata bson.M) error
+	Count(coll string, spec bson.M) (int, error)
+	Bytes(coll string, spec bson.M) (int, error)
+	Remove(coll string, spec bson.M) error
+	CreateIndexes(coll string, keys []string) error
+	CreateTTLIndex(coll, key string, expireAfter time.Duration) error
+}
+
+// ErrNotFound is returned by Update of all backends when no record matches
+// given spec, it is the error of MongoDB driver
+var ErrNotFound = mgo.ErrNotFound
+
+// ErrDuplicate is returned by Insert of embedded backends when record with
+// the same _id already exists, other records are inserted as MongoDB does
+var ErrDuplicate = &mgo.LastError{Code: 11000, Err: "E11000 duplicate key error"}
+
+// IsDup reports if Insert failed only due to records with existing _id
+func IsDup(err error) bool {
+	return mgo.IsDup(err)
+}
+
+// DB represents DAS storage backend, by default we use MongoDB
+var DB Store = &MongoStore{}
+
+// Init initializes DAS storage backend for given name, the dbfile
+// defines location of database file used by embedded bolt backend
+func Init(backend, dbfile string) error {
+	switch backend {
+	case "", "mongo", "mongodb":
+		DB = &MongoStore{}
+	case "memory":
+		DB = NewMemoryStore()
+	case "bolt":
+		store, err := NewBoltStore(dbfile)
+		if err != nil {
+			return err
+		}
+		DB = store
+	default:
+		return fmt.Errorf("unsupported storage backend %s", backend)
+	}
+	return nil
+}
+
+// ReapInterval defines how often embedded backends remove expired records,
+// it matches interval of MongoDB TTL monitor
+var ReapInterval = time.Minute
+
+// helper function used by embedded backends to emulate MongoDB TTL index,
+// it periodically removes records whose date key is older than expireAfter
+func reap(store Store, coll, key string, expireAfter time.Duration) {
+	for {
+		time.Sleep(ReapInterval)
+		spec := bson.M{key: bson.M{"$lt": time.Now().Add(-expireAfter)}}
+		n, err := store.Count(coll, spec)
+		if err == nil && n > 0 {
+			err = store.Remove(coll, spec)
+		}
+		if err != nil {
+			log.Printf("ERROR: unable to remove expired records from %s collection, error %v\n", coll, err)
+		} else if n > 0 {
+			log.Printf("removed %d expired records from %s collection\n", n, coll)
+		}
+	}
+}
@@ -1,12 +1,38 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/dmwm/das2go/config"
+	"github.com/dmwm/das2go/das"
+	"github.com/dmwm/das2go/dasql"
 	"github.com/dmwm/das2go/mongo"
 	"github.com/dmwm/das2go/services"
+	"github.com/dmwm/das2go/storage"
+	"github.com/dmwm/das2go/utils"
+	"github.com/dmwm/das2go/web"
+	"gopkg.in/mgo.v2/bson"
 )
 
 func TestOrderByRunLumis(t *testing.T) {
@@ -39,3 +65,563 @@ func TestOrderByRunLumis(t *testing.T) {
 		t.Error("Fail to collect lumis in OrderByRunLumis")
 	}
 }
+
+func TestServiceStates(t *testing.T) {
+	srvs := []string{"dbs3:files", "rucio:file4dataset_site"}
+	dasquery := dasql.DASQuery{Query: "file dataset=/a/b/c", Qhash: "123"}
+	dasrecord := services.CreateDASRecord(dasquery, srvs, []string{"file.name"})
+	services.SetServiceStatus(dasrecord, "dbs3:files", services.ServiceOk)
+	services.FinalizeServiceStatus(dasrecord)
+	states := services.ServiceStates(dasrecord)
+	if len(states) != 2 {
+		t.Errorf("Fail TestServiceStates, wrong number of services %v\n", states)
+	}
+	for _, rec := range states {
+		if rec["service"] == "dbs3:files" && rec["status"] != services.ServiceOk {
+			t.Errorf("Fail TestServiceStates, wrong status %v\n", rec)
+		}
+		if rec["service"] == "rucio:file4dataset_site" && rec["status"] != services.ServiceSkipped {
+			t.Errorf("Fail TestServiceStates, wrong status %v\n", rec)
+		}
+	}
+}
+
+// TestServiceOutcome
+func TestServiceOutcome(t *testing.T) {
+	r := utils.ResponseType{StatusCode: 503, Retries: 2, Error: errors.New("service unavailable")}
+	outcome := services.ServiceOutcome("dbs3", r, nil)
+	if outcome["status"] != services.ServiceError {
+		t.Errorf("Fail TestServiceOutcome, wrong status %v\n", outcome)
+	}
+	if outcome["error_class"] != "server" || outcome["error_code"] != utils.DBSError || outcome["error_system"] != utils.DBSErrorName || outcome["http_status"] != 503 || outcome["retries"] != 2 {
+		t.Errorf("Fail TestServiceOutcome, wrong outcome %v\n", outcome)
+	}
+	// class of failure is taken from error of upstream call
+	r = utils.ResponseType{Error: &utils.FetchError{Kind: utils.FetchAuth, Err: errors.New("no token")}}
+	if outcome = services.ServiceOutcome("rucio", r, nil); outcome["error_class"] != "auth" || outcome["error_code"] != utils.RucioError {
+		t.Errorf("Fail TestServiceOutcome, wrong outcome %v\n", outcome)
+	}
+	// or from error records of successful response
+	r = utils.ResponseType{StatusCode: 200}
+	if outcome = services.ServiceOutcome("dbs3", r, []mongo.DASRecord{{"error": "bad json"}}); outcome["error_class"] != "malformed" {
+		t.Errorf("Fail TestServiceOutcome, wrong outcome %v\n", outcome)
+	}
+	r = utils.ResponseType{StatusCode: 200}
+	records := []mongo.DASRecord{mongo.DASRecord{"name": "/a/b/c"}}
+	outcome = services.ServiceOutcome("dbs3", r, records)
+	if outcome["status"] != services.ServiceOk || outcome["nrecords"] != 1 {
+		t.Errorf("Fail TestServiceOutcome, wrong outcome %v\n", outcome)
+	}
+}
+
+// TestCheckConsistency
+func TestCheckConsistency(t *testing.T) {
+	das := mongo.DASRecord{"services": []string{"dbs3:blocks", "rucio:block4dataset"}}
+	rec1 := mongo.DASRecord{"name": "/a/b/c#1", "size": json.Number("10"), "nfiles": json.Number("2")}
+	rec2 := mongo.DASRecord{"name": "/a/b/c#1", "size": int64(12), "nfiles": 2}
+	records := []mongo.DASRecord{mongo.DASRecord{"block": []mongo.DASRecord{rec1, rec2}, "das": das}}
+	ndiff := services.CheckConsistency(records, "block", []string{"block.size", "block.nfiles", "block.nevents"})
+	if ndiff != 1 {
+		t.Errorf("Fail TestCheckConsistency, wrong number of inconsistent records %v\n", ndiff)
+	}
+	diffs := records[0]["das"].(mongo.DASRecord)["diff"].([]mongo.DASRecord)
+	if len(diffs) != 1 || diffs[0]["key"] != "block.size" {
+		t.Errorf("Fail TestCheckConsistency, wrong diff %v\n", diffs)
+	}
+	// parts which are not aligned with services are counted as unchecked
+	unchecked := atomic.LoadUint64(&services.UncheckedRecords)
+	rec3 := mongo.DASRecord{"name": "/a/b/c#1", "size": int64(14)}
+	das = mongo.DASRecord{"services": []string{"dbs3:blocks", "rucio:block4dataset"}}
+	records = []mongo.DASRecord{mongo.DASRecord{"block": []mongo.DASRecord{rec1, rec2, rec3}, "das": das}}
+	if ndiff := services.CheckConsistency(records, "block", []string{"block.size"}); ndiff != 0 {
+		t.Errorf("Fail TestCheckConsistency, wrong number of inconsistent records %v\n", ndiff)
+	}
+	if n := atomic.LoadUint64(&services.UncheckedRecords); n != unchecked+1 {
+		t.Errorf("Fail TestCheckConsistency, wrong number of unchecked records %v\n", n-unchecked)
+	}
+}
+
+// TestUpsertRecords
+func TestUpsertRecords(t *testing.T) {
+	store := storage.DB
+	storage.DB = storage.NewMemoryStore()
+	defer func() { storage.DB = store }()
+	batch := func(srv string, sizes map[string]int64) []mongo.DASRecord {
+		var records []mongo.DASRecord
+		for _, name := range []string{"/a/b/c#1", "/a/b/c#2"} {
+			size, ok := sizes[name]
+			if !ok {
+				continue
+			}
+			das := mongo.DASRecord{"services": []string{srv}, "record": 1, "primary_key": "block.name"}
+			services.SetExpire(das, 100)
+			rec := mongo.DASRecord{"qhash": "123", "block": []mongo.DASRecord{{"name": name, "size": size}}, "das": das}
+			records = append(records, rec)
+		}
+		return records
+	}
+	diffKeys := []string{"block.size"}
+	if err := services.UpsertRecords("123", "block.name", batch("dbs3:blocks", map[string]int64{"/a/b/c#1": 10}), diffKeys); err != nil {
+		t.Fatal(err)
+	}
+	if err := services.UpsertRecords("123", "block.name", batch("rucio:block4dataset", map[string]int64{"/a/b/c#1": 12, "/a/b/c#2": 1}), diffKeys); err != nil {
+		t.Fatal(err)
+	}
+	spec := bson.M{"qhash": "123", "das.record": 1}
+	records, err := storage.DB.GetSorted(storage.Merge, spec, []string{"das.primary_value"})
+	if err != nil || len(records) != 2 {
+		t.Errorf("Fail TestUpsertRecords, wrong number of merged records %v\n", records)
+		return
+	}
+	das := records[0]["das"].(mongo.DASRecord)
+	if blocks := records[0]["block"].([]interface{}); len(blocks) != 2 {
+		t.Errorf("Fail TestUpsertRecords, records are not merged %v\n", records[0])
+	}
+	if srvs := das["services"].([]interface{}); len(srvs) != 2 || srvs[0] != "rucio:block4dataset" {
+		t.Errorf("Fail TestUpsertRecords, wrong services %v\n", das["services"])
+	}
+	if _, ok := das["diff"]; !ok {
+		t.Errorf("Fail TestUpsertRecords, inconsistent sizes are not reported %v\n", das)
+	}
+	// merged records can be used as cursors of next page
+	if _, err := storage.DecodeCursor(storage.NewCursor(records[0], nil).Encode()); err != nil {
+		t.Errorf("Fail TestUpsertRecords, merged record %v, error %v\n", records[0]["_id"], err)
+	}
+}
+
+// slowStore delays reads of records such that concurrent read-then-write
+// sequences of its callers overlap
+type slowStore struct {
+	storage.Store
+}
+
+// Get records of wrapped store with a delay
+func (s slowStore) Get(coll string, spec bson.M, idx, limit int) ([]mongo.DASRecord, error) {
+	recs, err := s.Store.Get(coll, spec, idx, limit)
+	time.Sleep(10 * time.Millisecond)
+	return recs, err
+}
+
+// TestUpsertRecordsConcurrent, goroutines do not share any state but the
+// store, i.e. they merge records like DAS servers sharing DAS merge collection
+func TestUpsertRecordsConcurrent(t *testing.T) {
+	store := storage.DB
+	storage.DB = slowStore{storage.NewMemoryStore()}
+	defer func() { storage.DB = store }()
+	// records of the same block are provided by several services at once
+	nsrv, nblk := 10, 20
+	var wg sync.WaitGroup
+	for i := 0; i < nsrv; i++ {
+		wg.Add(1)
+		go func(srv string) {
+			defer wg.Done()
+			var records []mongo.DASRecord
+			for j := 0; j < nblk; j++ {
+				das := mongo.DASRecord{"services": []string{srv}, "record": 1, "primary_key": "block.name"}
+				services.SetExpire(das, 100)
+				name := fmt.Sprintf("/a/b/c#%d", j)
+				records = append(records, mongo.DASRecord{"qhash": "123", "block": []mongo.DASRecord{{"name": name}}, "das": das})
+			}
+			if err := services.UpsertRecords("123", "block.name", records, nil); err != nil {
+				t.Error(err)
+			}
+		}(fmt.Sprintf("srv%d:blocks", i))
+	}
+	wg.Wait()
+	records, err := storage.DB.GetSorted(storage.Merge, bson.M{"qhash": "123", "das.record": 1}, nil)
+	if err != nil || len(records) != nblk {
+		t.Fatalf("Fail TestUpsertRecordsConcurrent, %d merged records, expect %d, error %v\n", len(records), nblk, err)
+	}
+	for _, rec := range records {
+		if srvs := rec["das"].(mongo.DASRecord)["services"].([]interface{}); len(srvs) != nsrv {
+			t.Errorf("Fail TestUpsertRecordsConcurrent, lost services of %v: %v\n", rec["block"], srvs)
+		}
+	}
+}
+
+// TestProvenance
+func TestProvenance(t *testing.T) {
+	rec := mongo.DASRecord{"file": []mongo.DASRecord{mongo.DASRecord{"name": "/a.root", "size": 1}}}
+	prov := services.Provenance(rec, "dbs3:files", 123)
+	if len(prov) != 2 || prov[0]["key"] != "file.name" || prov[1]["key"] != "file.size" {
+		t.Errorf("Fail TestProvenance, wrong provenance %v\n", prov)
+	}
+	das := mongo.DASRecord{"provenance": prov}
+	recs := services.FieldProvenance(das, "file.size")
+	if len(recs) != 1 || recs[0]["service"] != "dbs3:files" {
+		t.Errorf("Fail TestProvenance, wrong field provenance %v\n", recs)
+	}
+}
+
+// TestExpireRange
+func TestExpireRange(t *testing.T) {
+	das := mongo.DASRecord{}
+	services.SetExpire(das, 100)
+	if das["expire"] != int64(100) || das["expire_at"].(time.Time).Unix() != 100 {
+		t.Errorf("Fail TestExpireRange, wrong expire %v\n", das)
+	}
+	for _, expire := range []int64{20, 10, 30} {
+		services.UpdateExpireRange(das, expire)
+	}
+	if das["min_expire"] != int64(10) || das["max_expire"] != int64(30) {
+		t.Errorf("Fail TestExpireRange, wrong expire range %v\n", das)
+	}
+}
+
+// TestMergeMultiFieldRecords
+func TestMergeMultiFieldRecords(t *testing.T) {
+	fields := []string{"file", "run", "lumi"}
+	pkeys := []string{"file.name", "run.run_number", "lumi.number"}
+	das1 := mongo.DASRecord{"services": []string{"dbs3:file_run_lumi4dataset"}, "expire": int64(10)}
+	das2 := mongo.DASRecord{"services": []string{"dbs3:files"}, "expire": int64(10)}
+	var records []mongo.DASRecord
+	for _, lumis := range [][]interface{}{{1, 2}, {3, 2}} {
+		rec := mongo.DASRecord{
+			"file": []mongo.DASRecord{{"name": "/a.root"}},
+			"run":  []mongo.DASRecord{{"run_number": 1}},
+			"lumi": []mongo.DASRecord{{"number": lumis}},
+			"das":  das1}
+		records = append(records, rec)
+	}
+	rec := mongo.DASRecord{
+		"file": []mongo.DASRecord{{"name": "/a.root"}},
+		"run":  []mongo.DASRecord{{"run_number": 2}},
+		"lumi": []mongo.DASRecord{{"number": []interface{}{5}}},
+		"das":  das1}
+	records = append(records, rec)
+	// record without run and lumi information, e.g. from another API
+	rec = mongo.DASRecord{"file": []mongo.DASRecord{{"name": "/a.root", "size": 10}}, "das": das2}
+	records = append(records, rec)
+	out := services.MergeMultiFieldRecords(records, fields, pkeys, "123")
+	if len(out) != 2 {
+		t.Errorf("Fail TestMergeMultiFieldRecords, wrong number of records %v\n", out)
+		return
+	}
+	lumis := mongo.GetValue(out[0], "lumi.number").([]interface{})
+	if fmt.Sprintf("%v", lumis) != "[1 2 3]" {
+		t.Errorf("Fail TestMergeMultiFieldRecords, wrong lumis %v\n", lumis)
+	}
+	for _, r := range out {
+		files := r["file"].([]mongo.DASRecord)
+		if len(files) != 2 {
+			t.Errorf("Fail TestMergeMultiFieldRecords, file records are not joined %v\n", files)
+		}
+	}
+}
+
+// TestPopularQueries
+func TestPopularQueries(t *testing.T) {
+	q1 := dasql.DASQuery{Query: "dataset=/a/b/c", Qhash: "1"}
+	q2 := dasql.DASQuery{Query: "dataset=/x/y/z", Qhash: "2"}
+	das.Hit(q1)
+	das.Hit(q2)
+	das.Hit(q2)
+	queries := das.PopularQueries(1)
+	if len(queries) != 1 || queries[0].Query.Qhash != "2" {
+		t.Errorf("Fail TestPopularQueries, wrong popular queries %v\n", queries)
+	}
+}
+
+// TestSetBytes
+func TestSetBytes(t *testing.T) {
+	small := mongo.DASRecord{"file": []mongo.DASRecord{{"name": "/a.root"}}, "das": mongo.DASRecord{"record": 1}}
+	large := mongo.DASRecord{"file": []mongo.DASRecord{{"name": strings.Repeat("/a", 100)}}, "das": mongo.DASRecord{"record": 1}}
+	total := services.SetBytes([]mongo.DASRecord{small, large})
+	var sizes int64
+	for _, rec := range []mongo.DASRecord{small, large} {
+		data, _ := bson.Marshal(rec)
+		nbytes := rec["das"].(mongo.DASRecord)["bytes"]
+		if nbytes != int64(len(data)) {
+			t.Errorf("Fail TestSetBytes, wrong record size %v, expect %d\n", nbytes, len(data))
+		}
+		sizes += int64(len(data))
+	}
+	if total != sizes {
+		t.Errorf("Fail TestSetBytes, wrong total size %d, expect %d\n", total, sizes)
+	}
+}
+
+// TestStreamUnmarshal
+func TestStreamUnmarshal(t *testing.T) {
+	services.StreamBatchSize = 2
+	defer func() { services.StreamBatchSize = 1000 }()
+	var q dasql.DASQuery
+	// helper function to collect batches of decoded records
+	decode := func(system, api, data string) ([]int, []mongo.DASRecord) {
+		var sizes []int
+		var records []mongo.DASRecord
+		r := utils.ResponseType{Data: []byte(data), StatusCode: 200}
+		ok, err := services.StreamUnmarshal(q, system, api, r, nil, func(batch []mongo.DASRecord) error {
+			sizes = append(sizes, len(batch))
+			records = append(records, batch...)
+			return nil
+		})
+		if !ok || err != nil {
+			t.Errorf("Fail TestStreamUnmarshal, %s:%s is not decoded in batches, error %v\n", system, api, err)
+		}
+		return sizes, records
+	}
+	sizes, records := decode("dbs3", "datasets", `[{"dataset":"/a/b/RAW"},{"dataset":"/c/d/RAW"},{"dataset":"/e/f/RAW"}]`)
+	if fmt.Sprint(sizes) != "[2 1]" || records[2]["name"] != "/e/f/RAW" {
+		t.Errorf("Fail TestStreamUnmarshal, dbs batches %v, records %v\n", sizes, records)
+	}
+	// truncated DBS array yields records decoded so far and error record
+	_, records = decode("dbs3", "datasets", `[{"dataset":"/a/b/RAW"},{"dataset":`)
+	if len(records) != 2 || records[1]["error_kind"] != "malformed" {
+		t.Errorf("Fail TestStreamUnmarshal, truncated dbs records %v\n", records)
+	}
+	// Rucio rows which can not be decoded yield error records
+	sizes, records = decode("rucio", "full_record", "{\"name\":\"a\"}\nbla\n{\"name\":\"b\"}")
+	if fmt.Sprint(sizes) != "[2 1]" || records[1]["error_kind"] != "malformed" || records[2]["name"] != "b" {
+		t.Errorf("Fail TestStreamUnmarshal, rucio batches %v, records %v\n", sizes, records)
+	}
+	// aggregating apis are not decoded in batches
+	r := utils.ResponseType{Data: []byte(`{"name":"/a/b/RAW#1"}`)}
+	if ok, _ := services.StreamUnmarshal(q, "rucio", "dataset4site", r, nil, nil); ok {
+		t.Errorf("Fail TestStreamUnmarshal, aggregating api is decoded in batches\n")
+	}
+}
+
+// TestStreamBody
+func TestStreamBody(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"dataset":"/a/b/RAW"},{"dataset":"/c/d/RAW"},{"dataset":"/e/f/RAW"},`))
+		w.(http.Flusher).Flush()
+		if r.URL.Path == "/dbs/datasets" {
+			// the rest of the body is sent once first batch is decoded
+			select {
+			case <-release:
+			case <-time.After(5 * time.Second):
+			}
+		}
+		w.Write([]byte(`{"dataset":"/g/h/RAW"}]`))
+	}))
+	defer server.Close()
+	services.StreamBatchSize = 2
+	defer func() { services.StreamBatchSize = 1000 }()
+	var q dasql.DASQuery
+	out := make(chan utils.ResponseType)
+	go utils.FetchStream(server.Client(), server.URL+"/dbs/datasets", "", out, "stream", utils.FetchInteractive)
+	r := <-out
+	if r.Error != nil || r.Body == nil {
+		t.Fatalf("Fail TestStreamBody, response is not streamed %s\n", r.Details())
+	}
+	batches := make(chan []mongo.DASRecord)
+	done := make(chan error)
+	go func() {
+		_, err := services.StreamUnmarshal(q, "dbs3", "datasets", r, nil, func(batch []mongo.DASRecord) error {
+			batches <- batch
+			return nil
+		})
+		r.Body.Close()
+		close(batches)
+		done <- err
+	}()
+	select {
+	case batch := <-batches:
+		if len(batch) != 2 {
+			t.Errorf("Fail TestStreamBody, first batch %v\n", batch)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Fail TestStreamBody, no records are produced before body is read\n")
+	}
+	close(release)
+	var records []mongo.DASRecord
+	for batch := range batches {
+		records = append(records, batch...)
+	}
+	if err := <-done; err != nil || len(records) != 2 || records[1]["name"] != "/g/h/RAW" {
+		t.Errorf("Fail TestStreamBody, records %v, error %v\n", records, err)
+	}
+
+	// streamed body is limited by MaxResponseSize
+	utils.MaxResponseSize = 60
+	defer func() { utils.MaxResponseSize = 0 }()
+	go utils.FetchStream(server.Client(), server.URL+"/dbs/large", "", out, "stream", utils.FetchInteractive)
+	r = <-out
+	if r.Body == nil {
+		t.Fatalf("Fail TestStreamBody, response is not streamed %s\n", r.Details())
+	}
+	defer r.Body.Close()
+	records = nil
+	services.StreamUnmarshal(q, "dbs3", "datasets", r, nil, func(batch []mongo.DASRecord) error {
+		records = append(records, batch...)
+		return nil
+	})
+	if len(records) != 3 || records[2]["error_kind"] != "too-large" || utils.ErrorKind(r.Body.Err()) != "too-large" {
+		t.Errorf("Fail TestStreamBody, records %v, error %v\n", records, r.Body.Err())
+	}
+}
+
+// TestStreamJSON
+func TestStreamJSON(t *testing.T) {
+	records := []mongo.DASRecord{{"dataset": []mongo.DASRecord{{"name": "/a/b/RAW"}}}, {"dataset": []mongo.DASRecord{{"name": "/c/d/RAW"}}}}
+	iterate := func(fn func(rec mongo.DASRecord) error) error {
+		for _, rec := range records {
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		return errors.New("lost connection")
+	}
+	var buf bytes.Buffer
+	response := map[string]interface{}{"status": "ok", "nresults": 2, "data": []mongo.DASRecord(nil)}
+	if err := web.StreamJSON(&buf, response, iterate); err == nil {
+		t.Errorf("Fail TestStreamJSON, iteration error is not reported\n")
+	}
+	// keys of streamed response are unique
+	keys := make(map[string]int)
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	dec.Token()
+	for dec.More() {
+		key, _ := dec.Token()
+		keys[fmt.Sprint(key)]++
+		var val interface{}
+		if err := dec.Decode(&val); err != nil {
+			t.Fatalf("Fail TestStreamJSON, invalid response %s, error %v\n", buf.String(), err)
+		}
+	}
+	if keys["data"] != 1 || keys["status"] != 1 || keys["error"] != 1 {
+		t.Errorf("Fail TestStreamJSON, wrong keys %v of response %s\n", keys, buf.String())
+	}
+	var out struct {
+		Status   string            `json:"status"`
+		Nresults int               `json:"nresults"`
+		Data     []mongo.DASRecord `json:"data"`
+		Error    string            `json:"error"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("Fail TestStreamJSON, unable to unmarshal %s, error %v\n", buf.String(), err)
+	}
+	if out.Status != "ok" || out.Nresults != 2 || len(out.Data) != 2 || out.Error != "lost connection" {
+		t.Errorf("Fail TestStreamJSON, wrong response %+v\n", out)
+	}
+}
+
+// helper function to make subject of given DN, e.g. /DC=ch/CN=das
+func dnSubject(dn string) pkix.Name {
+	oids := map[string]asn1.ObjectIdentifier{
+		"DC": {0, 9, 2342, 19200300, 100, 1, 25},
+		"OU": {2, 5, 4, 11},
+		"CN": {2, 5, 4, 3},
+	}
+	var subject pkix.Name
+	for _, part := range strings.Split(strings.Trim(dn, "/"), "/") {
+		arr := strings.SplitN(part, "=", 2)
+		subject.ExtraNames = append(subject.ExtraNames, pkix.AttributeTypeAndValue{Type: oids[arr[0]], Value: arr[1]})
+	}
+	return subject
+}
+
+// helper function to issue certificate of given DN, the certificate is
+// signed by given CA or it is self-signed CA certificate if ca is nil
+func issueCert(t *testing.T, dn string, ca *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      dnSubject(dn),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, interface{}(key)
+	if ca == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.Leaf, ca.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// TestUserDN
+func TestUserDN(t *testing.T) {
+	dn := "/DC=ch/DC=cern/OU=Organic Units/OU=Users/CN=das/CN=123/CN=DAS User"
+	ca := issueCert(t, "/DC=ch/DC=cern/CN=DAS CA", nil)
+	admin := issueCert(t, dn, &ca)
+	// helper function to create request with client certificate, verified or not
+	request := func(method string, cert tls.Certificate, verified bool) *http.Request {
+		r := httptest.NewRequest(method, "/das/admin/queries", nil)
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}
+		if verified {
+			r.TLS.VerifiedChains = [][]*x509.Certificate{{cert.Leaf, ca.Leaf}}
+		}
+		return r
+	}
+	if v := web.UserDN(request("GET", admin, true)); v != dn {
+		t.Errorf("Fail TestUserDN, wrong DN %s\n", v)
+	}
+	// DNs of robot or service certificates are shorter
+	robot := "/DC=ch/DC=cern/OU=computers/CN=das.cern.ch"
+	if v := web.UserDN(request("GET", issueCert(t, robot, &ca), true)); v != robot {
+		t.Errorf("Fail TestUserDN, wrong DN %s\n", v)
+	}
+	if v := web.UserDN(httptest.NewRequest("GET", "/das/admin/queries", nil)); v != web.NoDN {
+		t.Errorf("Fail TestUserDN, wrong DN %s\n", v)
+	}
+
+	adminDNs := config.Config.AdminDNs
+	config.Config.AdminDNs = []string{dn}
+	defer func() { config.Config.AdminDNs = adminDNs }()
+	// admin passes authorization and gets error of wrong method
+	w := httptest.NewRecorder()
+	web.AdminHandler(w, request("POST", admin, true))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Fail TestUserDN, admin API status %d\n", w.Code)
+	}
+	// unverified certificate and plain HTTP request are refused
+	w = httptest.NewRecorder()
+	web.AdminHandler(w, request("POST", admin, false))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Fail TestUserDN, admin API status %d for unverified certificate\n", w.Code)
+	}
+	w = httptest.NewRecorder()
+	web.AdminHandler(w, httptest.NewRequest("POST", "/das/admin/queries", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Fail TestUserDN, admin API status %d for plain HTTP request\n", w.Code)
+	}
+
+	// DAS server verifies client certificates against CAs of X509_CERT_DIR
+	dir := t.TempDir()
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Leaf.Raw})
+	if err := os.WriteFile(filepath.Join(dir, "ca.pem"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("X509_CERT_DIR", dir)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(web.AdminHandler))
+	server.TLS = web.TLSConfig()
+	server.StartTLS()
+	defer server.Close()
+	post := func(cert tls.Certificate) (*http.Response, error) {
+		tr := server.Client().Transport.(*http.Transport).Clone()
+		// present certificate even if it is not signed by CAs server asks for
+		tr.TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}
+		client := &http.Client{Transport: tr}
+		return client.Post(server.URL+"/das/admin/queries", "text/plain", nil)
+	}
+	resp, err := post(admin)
+	if err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Fail TestUserDN, admin request response %v, error %v\n", resp, err)
+	}
+	// self-signed certificate with admin DN is refused
+	resp, err = post(issueCert(t, dn, nil))
+	if err == nil {
+		t.Errorf("Fail TestUserDN, self-signed certificate is accepted, response %v\n", resp)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmwm/das2go/dasmaps"
+	"github.com/dmwm/das2go/mock"
+	"github.com/dmwm/das2go/services"
+	"github.com/dmwm/das2go/utils"
+)
+
+// TestMockDBS
+func TestMockDBS(t *testing.T) {
+	server := httptest.NewServer(mock.Handler(mock.NewCatalog()))
+	defer server.Close()
+	dbs := server.URL + "/dbs/prod/global/DBSReader"
+	raw := "/MockPrimary1/MockEra2024-v1/RAW"
+	aod := "/MockPrimary1/MockEra2024-PromptReco-v1/AOD"
+
+	// dataset pattern
+	resp := utils.FetchResponse(server.Client(), dbs+"/datasets?detail=True&dataset=/MockPrimary1/*/*", "")
+	records := services.DBSUnmarshal("datasets", resp.Data)
+	if resp.Error != nil || len(records) != 2 || records[0]["name"] != raw || records[0]["data_tier_name"] != "RAW" {
+		t.Errorf("Fail TestMockDBS, datasets %v, error %v\n", records, resp.Error)
+	}
+
+	// files of a dataset and run
+	resp = utils.FetchResponse(server.Client(), fmt.Sprintf("%s/files?dataset=%s&run_num=370100-370100", dbs, raw), "")
+	records = services.DBSUnmarshal("files", resp.Data)
+	if len(records) != 3 {
+		t.Errorf("Fail TestMockDBS, files %v\n", records)
+	}
+	lfn := records[0]["logical_file_name"]
+
+	// POST request with lumi list
+	args := fmt.Sprintf(`{"logical_file_name": ["%s"], "lumi_list": "[1,2,3]"}`, lfn)
+	resp = utils.FetchResponse(server.Client(), dbs+"/filelumis", args)
+	records = services.DBSUnmarshal("filelumis", resp.Data)
+	if len(records) != 3 || records[0]["logical_file_name"] != lfn {
+		t.Errorf("Fail TestMockDBS, filelumis %v\n", records)
+	}
+
+	// dataset relations
+	resp = utils.FetchResponse(server.Client(), fmt.Sprintf("%s/datasetchildren?dataset=%s", dbs, raw), "")
+	records = services.DBSUnmarshal("datasetchildren", resp.Data)
+	if len(records) != 1 || records[0]["child_dataset"] != aod {
+		t.Errorf("Fail TestMockDBS, datasetchildren %v\n", records)
+	}
+	resp = utils.FetchResponse(server.Client(), fmt.Sprintf("%s/datasetparents?dataset=%s", dbs, raw), "")
+	records = services.DBSUnmarshal("datasetparents", resp.Data)
+	if len(records) != 0 {
+		t.Errorf("Fail TestMockDBS, datasetparents of RAW dataset %v\n", records)
+	}
+}
+
+// TestMockServices
+func TestMockServices(t *testing.T) {
+	catalog := mock.NewCatalog()
+	server := httptest.NewServer(mock.Handler(catalog))
+	defer server.Close()
+	aod := "/MockPrimary1/MockEra2024-PromptReco-v1/AOD"
+
+	// Rucio calls are not made without Rucio token
+	utils.RucioAuth.ChangeUrl("https://cms-rucio-auth.cern.ch", server.URL+"/rucio")
+	defer utils.RucioAuth.ChangeUrl(server.URL+"/rucio", "https://cms-rucio-auth.cern.ch")
+	utils.RucioAuthMethod = utils.RucioAuthUserpass
+	utils.RucioUsername = "das"
+	defer func() { utils.RucioAuthMethod, utils.RucioUsername, utils.RucioPassword = "", "", "" }()
+	resp := utils.FetchResponse(server.Client(), fmt.Sprintf("%s/rucio/replicas/cms%s/datasets", server.URL, aod), "")
+	if utils.ErrorKind(resp.Error) != "auth" || resp.StatusCode != 0 {
+		t.Errorf("Fail TestMockServices, unauthenticated rucio call %s\n", resp.Details())
+	}
+	utils.RucioPassword = "secret"
+
+	// block replicas of a dataset are streamed one record per line
+	resp = utils.FetchResponse(server.Client(), fmt.Sprintf("%s/rucio/replicas/cms%s/datasets", server.URL, aod), "")
+	lines := strings.Split(strings.TrimSpace(string(resp.Data)), "\n")
+	if resp.Error != nil || resp.Header.Get("Content-Type") != "application/x-json-stream" || len(lines) != 3 {
+		t.Errorf("Fail TestMockServices, block replicas %s, error %v\n", resp.Data, resp.Error)
+	}
+
+	// file replicas of a block are consistent with block replicas
+	blk := catalog.Blocks[2].Name
+	resp = utils.FetchResponse(server.Client(), fmt.Sprintf("%s/rucio/replicas/cms/%s", server.URL, url.QueryEscape(blk)), "")
+	lines = strings.Split(strings.TrimSpace(string(resp.Data)), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], `"T2_CH_CERN":"AVAILABLE"`) {
+		t.Errorf("Fail TestMockServices, file replicas of %s: %s\n", blk, resp.Data)
+	}
+
+	// runs of RunRegistry with filter
+	rurl := server.URL + "/runregistry/api/GLOBAL/runsummary/json/number%2CstartTime/none/data"
+	resp = utils.FetchResponse(server.Client(), rurl, `{"filter": {"number": ">= 370101 and <= 370200"}}`)
+	records := services.RunRegistryUnmarshal("rr_xmlrpc2", resp.Data)
+	if len(records) != 2 || records[0]["run_number"] != int64(370101) {
+		t.Errorf("Fail TestMockServices, runregistry records %v\n", records)
+	}
+}
+
+// TestChangeUrl
+func TestChangeUrl(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "maps.js")
+	maps := `{"hash": "1", "type": "service", "system": "dbs3", "urn": "datasets", "url": "https://cmsweb.cern.ch:8443/dbs/prod/global/DBSReader/datasets/"}
+{"hash": "2", "type": "service", "system": "combined", "urn": "site4dataset", "url": "combined plugin", "services": {"dbs3": "https://cmsweb.cern.ch:8443/dbs"}}
+{"hash": "3", "type": "notation", "system": "dbs3", "notations": []}
+`
+	if err := os.WriteFile(fname, []byte(maps), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var dmaps dasmaps.DASMaps
+	dmaps.ReadMapFile(fname)
+	dmaps.ChangeUrl("https://cmsweb.cern.ch:8443", "http://localhost:8300")
+	records := dmaps.Maps()
+	if len(records) != 2 {
+		t.Errorf("Fail TestChangeUrl, records %v\n", records)
+	}
+	if records[0]["url"] != "http://localhost:8300/dbs/prod/global/DBSReader/datasets/" {
+		t.Errorf("Fail TestChangeUrl, url %v\n", records[0]["url"])
+	}
+	if srvs := records[1]["services"].(map[string]interface{}); srvs["dbs3"] != "http://localhost:8300/dbs" {
+		t.Errorf("Fail TestChangeUrl, services %v\n", srvs)
+	}
+}
+
+// TestRucioAuth
+func TestRucioAuth(t *testing.T) {
+	server := httptest.NewServer(mock.Handler(mock.NewCatalog()))
+	defer server.Close()
+	defer func() { utils.RucioAuthMethod = "" }()
+
+	// userpass authentication with password file
+	fname := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(fname, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	utils.RucioAuthMethod = utils.RucioAuthUserpass
+	utils.RucioUsername = "das"
+	utils.RucioPassword = fname
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	utils.VERBOSE = 2
+	token, expire, err := utils.FetchRucioToken(server.URL + "/rucio/auth/userpass")
+	utils.VERBOSE = 0
+	log.SetOutput(os.Stderr)
+	if err != nil || token != mock.RucioToken || expire < time.Now().Add(50*time.Minute).Unix() {
+		t.Errorf("Fail TestRucioAuth, userpass token %s, expire %d, error %v\n", token, expire, err)
+	}
+	// password and token are hidden in dumps of auth request and response
+	if dump := buf.String(); strings.Contains(dump, "secret") || strings.Contains(dump, mock.RucioToken) || strings.Count(dump, "***") != 2 {
+		t.Errorf("Fail TestRucioAuth, secrets are not hidden in %s\n", dump)
+	}
+
+	// oidc token is validated by Rucio auth server
+	utils.RucioAuthMethod = utils.RucioAuthOIDC
+	utils.RucioTokenFile = "oidc-token"
+	token, _, err = utils.FetchRucioToken(server.URL + "/rucio/auth/validate")
+	if err != nil || token != "oidc-token" {
+		t.Errorf("Fail TestRucioAuth, oidc token %s, error %v\n", token, err)
+	}
+
+	// errors of Rucio auth server are reported with their exception
+	_, _, err = utils.FetchRucioToken(server.URL + "/rucio/auth/userpass")
+	var e *utils.FetchError
+	if !errors.As(err, &e) || e.Kind != utils.FetchAuth || !strings.Contains(err.Error(), "CannotAuthenticate") {
+		t.Errorf("Fail TestRucioAuth, error %v\n", err)
+	}
+	utils.RucioAuthMethod = "curl"
+	if _, _, err = utils.FetchRucioToken(server.URL + "/rucio/auth/x509"); err == nil {
+		t.Errorf("Fail TestRucioAuth, no error of unsupported auth method\n")
+	}
+}
+
+// TestRucioAuthTLS
+func TestRucioAuthTLS(t *testing.T) {
+	server := httptest.NewTLSServer(mock.Handler(mock.NewCatalog()))
+	defer server.Close()
+	utils.RucioAuthMethod = utils.RucioAuthUserpass
+	utils.RucioUsername = "das"
+	utils.RucioPassword = "secret"
+	defer func() { utils.RucioAuthMethod, utils.RucioUsername, utils.RucioPassword = "", "", "" }()
+	rurl := server.URL + "/rucio/auth/userpass"
+
+	// certificate of Rucio auth server is verified
+	t.Setenv("X509_CERT_DIR", "")
+	if _, _, err := utils.FetchRucioToken(rurl); err == nil {
+		t.Errorf("Fail TestRucioAuthTLS, certificate of unknown authority is accepted\n")
+	}
+	utils.RucioAuthInsecure = true
+	_, _, err := utils.FetchRucioToken(rurl)
+	utils.RucioAuthInsecure = false
+	if err != nil {
+		t.Errorf("Fail TestRucioAuthTLS, insecure auth error %v\n", err)
+	}
+
+	// CA certificates are read from X509_CERT_DIR
+	dir := t.TempDir()
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(filepath.Join(dir, "mock.pem"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "mock.signing_policy"), []byte("access_id_CA X509 '/CN=mock'"), 0644)
+	t.Setenv("X509_CERT_DIR", dir)
+	if token, _, err := utils.FetchRucioToken(rurl); err != nil || token != mock.RucioToken {
+		t.Errorf("Fail TestRucioAuthTLS, token %s, error %v\n", token, err)
+	}
+}
+
+// helper function to write self-signed X509 certificate and its key to given directory
+func writeX509(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "das mock user"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := filepath.Join(dir, "usercert.pem")
+	ckey := filepath.Join(dir, "userkey.pem")
+	os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(ckey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+	return cert, ckey
+}
+
+// TestRucioAuthX509
+func TestRucioAuthX509(t *testing.T) {
+	server := httptest.NewUnstartedServer(mock.Handler(mock.NewCatalog()))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	// x509 authentication requires client certificate
+	for _, method := range []string{utils.RucioAuthX509, utils.RucioAuthX509Proxy} {
+		resp, err := server.Client().Get(server.URL + "/rucio/auth/" + method)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("ExceptionClass") != "CannotAuthenticate" {
+			t.Errorf("Fail TestRucioAuthX509, %s auth without certificate, response %v, error %v\n", method, resp, err)
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+
+	// Rucio auth client presents user certificate and verifies mock server
+	dir := t.TempDir()
+	cert, ckey := writeX509(t, dir)
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(filepath.Join(dir, "mock.pem"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// credentials of environment are restored once environment is restored
+	t.Cleanup(utils.Credentials.Reload)
+	t.Setenv("X509_CERT_DIR", dir)
+	t.Setenv("X509_USER_PROXY", "")
+	t.Setenv("X509_USER_CERT", cert)
+	t.Setenv("X509_USER_KEY", ckey)
+	utils.Credentials.Reload()
+	if certs, err := utils.Credentials.Certs(); err != nil || len(certs) != 1 {
+		t.Fatalf("Fail TestRucioAuthX509, user certificate is not loaded, error %v\n", err)
+	}
+	defer func() { utils.RucioAuthMethod = "" }()
+	for _, method := range []string{utils.RucioAuthX509, utils.RucioAuthX509Proxy} {
+		utils.RucioAuthMethod = method
+		token, _, err := utils.FetchRucioToken(server.URL + "/rucio/auth/" + method)
+		if err != nil || token != mock.RucioToken {
+			t.Errorf("Fail TestRucioAuthX509, %s token %s, error %v\n", method, token, err)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/storage"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// helper function to create embedded stores with few DAS records
+func stores(t *testing.T) map[string]storage.Store {
+	bstore, err := storage.NewBoltStore(filepath.Join(t.TempDir(), "das.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bstore.Close() })
+	out := map[string]storage.Store{"memory": storage.NewMemoryStore(), "bolt": bstore}
+	for _, store := range out {
+		fillStore(store)
+	}
+	return out
+}
+
+// helper function to fill given store with few DAS records
+func fillStore(store storage.Store) {
+	var records []mongo.DASRecord
+	for idx, name := range []string{"/c.root", "/a.root", "/b.root"} {
+		rec := mongo.DASRecord{
+			"qhash": "123",
+			"file":  []mongo.DASRecord{{"name": name, "size": int64(idx * 10)}},
+			"das":   mongo.DASRecord{"record": 1, "expire": int64(100 + idx), "services": []string{"dbs3:files"}},
+		}
+		records = append(records, rec)
+	}
+	records = append(records, mongo.DASRecord{"qhash": "123", "query": "file dataset=/a/b/c", "das": mongo.DASRecord{"record": 0, "status": "ok"}})
+	store.Insert(storage.Cache, records)
+}
+
+// helper function to count records in given store
+func count(t *testing.T, store storage.Store, spec bson.M) int {
+	n, err := store.Count(storage.Cache, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// TestStoreGet
+func TestStoreGet(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) { testStoreGet(t, store) })
+	}
+}
+
+func testStoreGet(t *testing.T, store storage.Store) {
+	if n := count(t, store, bson.M{"qhash": "123", "das.record": 1}); n != 3 {
+		t.Errorf("Fail TestStoreGet, wrong number of data records %d\n", n)
+	}
+	if n := count(t, store, bson.M{"file.name": "/a.root"}); n != 1 {
+		t.Errorf("Fail TestStoreGet, wrong look-up through list of records %d\n", n)
+	}
+	if n := count(t, store, bson.M{"das.expire": bson.M{"$lt": int64(102)}}); n != 2 {
+		t.Errorf("Fail TestStoreGet, wrong $lt look-up %d\n", n)
+	}
+	if n := count(t, store, bson.M{"das.services": bson.RegEx{Pattern: "^dbs3:"}}); n != 3 {
+		t.Errorf("Fail TestStoreGet, wrong regex look-up %d\n", n)
+	}
+	recs, err := store.Get(storage.Cache, bson.M{"das.record": 0}, 0, 1)
+	if err != nil || len(recs) != 1 || recs[0]["query"] != "file dataset=/a/b/c" {
+		t.Errorf("Fail TestStoreGet, wrong DAS record %v\n", recs)
+	}
+	// records should have the same data types as records fetched from MongoDB
+	if _, ok := recs[0]["das"].(mongo.DASRecord); !ok {
+		t.Errorf("Fail TestStoreGet, wrong type of das part %T\n", recs[0]["das"])
+	}
+	// modifications of fetched records should not change the store
+	recs[0]["query"] = "bla"
+	recs, _ = store.Get(storage.Cache, bson.M{"das.record": 0}, 0, 1)
+	if recs[0]["query"] != "file dataset=/a/b/c" {
+		t.Errorf("Fail TestStoreGet, store record is modified %v\n", recs)
+	}
+}
+
+// TestStoreSorted
+func TestStoreSorted(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) { testStoreSorted(t, store) })
+	}
+}
+
+func testStoreSorted(t *testing.T, store storage.Store) {
+	spec := bson.M{"das.record": 1}
+	recs, err := store.GetSorted(storage.Cache, spec, []string{"file.name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []interface{}
+	for _, rec := range recs {
+		names = append(names, mongo.GetValue(rec, "file.name"))
+	}
+	if len(names) != 3 || names[0] != "/a.root" || names[2] != "/c.root" {
+		t.Errorf("Fail TestStoreSorted, wrong order %v\n", names)
+	}
+	recs, err = store.GetFilteredSorted(storage.Cache, spec, []string{"file.size"}, []string{"-file.size"}, 0, 2)
+	if err != nil || len(recs) != 2 {
+		t.Errorf("Fail TestStoreSorted, wrong number of records %v\n", recs)
+		return
+	}
+	files := recs[0]["file"].([]interface{})
+	file := files[0].(mongo.DASRecord)
+	if _, ok := file["name"]; ok || file["size"] != int64(20) {
+		t.Errorf("Fail TestStoreSorted, wrong projection %v\n", recs[0])
+	}
+}
+
+// TestStoreUpdate
+func TestStoreUpdate(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) { testStoreUpdate(t, store) })
+	}
+}
+
+func testStoreUpdate(t *testing.T, store storage.Store) {
+	spec := bson.M{"qhash": "123", "das.record": 0}
+	if err := store.Update(storage.Cache, spec, bson.M{"$set": bson.M{"das.status": "processing"}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, store, bson.M{"das.status": "processing"}); n != 1 {
+		t.Errorf("Fail TestStoreUpdate, record is not updated %d\n", n)
+	}
+	store.Update(storage.Cache, spec, bson.M{"qhash": "123", "das": mongo.DASRecord{"record": 0, "status": "ok"}})
+	if n := count(t, store, bson.M{"das.status": "ok"}); n != 1 {
+		t.Errorf("Fail TestStoreUpdate, record is not replaced %d\n", n)
+	}
+	// like MongoDB backends report update of missing record and do not insert it
+	err := store.Update(storage.Cache, bson.M{"qhash": "456"}, bson.M{"$set": bson.M{"das.status": "ok"}})
+	if err != mgo.ErrNotFound || err != storage.ErrNotFound {
+		t.Errorf("Fail TestStoreUpdate, wrong error of missing record %v\n", err)
+	}
+	if n := count(t, store, bson.M{"qhash": "456"}); n != 0 {
+		t.Errorf("Fail TestStoreUpdate, missing record is inserted %d\n", n)
+	}
+	if err := store.Remove(storage.Cache, bson.M{"das.expire": bson.M{"$lt": int64(101)}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(t, store, bson.M{}); n != 3 {
+		t.Errorf("Fail TestStoreUpdate, wrong number of records after remove %d\n", n)
+	}
+	// like MongoDB backends refuse records with existing _id and insert others
+	records := []mongo.DASRecord{{"_id": "1", "qhash": "789"}, {"_id": "2", "qhash": "789"}}
+	if err := store.Insert(storage.Cache, records[:1]); err != nil {
+		t.Fatal(err)
+	}
+	records[0]["qhash"] = "456"
+	if err := store.Insert(storage.Cache, records); !storage.IsDup(err) {
+		t.Errorf("Fail TestStoreUpdate, wrong error of duplicate record %v\n", err)
+	}
+	if n := count(t, store, bson.M{"qhash": "789"}); n != 2 {
+		t.Errorf("Fail TestStoreUpdate, wrong number of records after duplicate insert %d\n", n)
+	}
+}
+
+// TestStoreTTL
+func TestStoreTTL(t *testing.T) {
+	store := storage.NewMemoryStore()
+	now := time.Now()
+	var records []mongo.DASRecord
+	for _, expire := range []time.Time{now.Add(-time.Hour), now.Add(time.Hour)} {
+		records = append(records, mongo.DASRecord{"qhash": "123", "das": mongo.DASRecord{"expire_at": expire}})
+	}
+	store.Insert(storage.Cache, records)
+	if n := count(t, store, bson.M{"das.expire_at": bson.M{"$lt": now}}); n != 1 {
+		t.Errorf("Fail TestStoreTTL, wrong date look-up %d\n", n)
+	}
+	storage.ReapInterval = 10 * time.Millisecond
+	store.CreateTTLIndex(storage.Cache, "das.expire_at", 0)
+	time.Sleep(100 * time.Millisecond)
+	if n := count(t, store, bson.M{}); n != 1 {
+		t.Errorf("Fail TestStoreTTL, expired records are not removed %d\n", n)
+	}
+}
+
+// TestStoreCursor
+func TestStoreCursor(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) { testStoreCursor(t, store) })
+	}
+}
+
+func testStoreCursor(t *testing.T, store storage.Store) {
+	// add record without file size which should be placed last in descending order
+	store.Insert(storage.Cache, []mongo.DASRecord{{"qhash": "123", "file": []mongo.DASRecord{{"name": "/d.root"}}, "das": mongo.DASRecord{"record": 1}}})
+	for _, skeys := range [][]string{nil, {"file.size"}, {"-file.size"}} {
+		spec := bson.M{"das.record": 1}
+		var all, paged []interface{}
+		store.Iterate(storage.Cache, spec, nil, skeys, 0, -1, func(rec mongo.DASRecord) error {
+			all = append(all, mongo.GetValue(rec, "file.name"))
+			return nil
+		})
+		token := ""
+		for i := 0; i < 4; i++ {
+			pspec := spec
+			if token != "" {
+				c, err := storage.DecodeCursor(token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cspec, err := c.Spec(skeys)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pspec = bson.M{"$and": []interface{}{spec, cspec}}
+			}
+			var last mongo.DASRecord
+			err := store.Iterate(storage.Cache, pspec, nil, skeys, 0, 2, func(rec mongo.DASRecord) error {
+				paged = append(paged, mongo.GetValue(rec, "file.name"))
+				last = rec
+				return nil
+			})
+			if err != nil || last == nil {
+				break
+			}
+			token = storage.NewCursor(last, skeys).Encode()
+		}
+		if len(all) != 4 || fmt.Sprint(all) != fmt.Sprint(paged) {
+			t.Errorf("Fail TestStoreCursor, sort keys %v, records %v, pages %v\n", skeys, all, paged)
+		}
+		if skeys != nil && skeys[0] == "-file.size" && all[3] != "/d.root" {
+			t.Errorf("Fail TestStoreCursor, wrong order of records without sort key %v\n", all)
+		}
+		// previous pages are read in reversed order starting from the end of the set
+		var back []interface{}
+		rkeys := storage.ReverseKeys(skeys)
+		token = storage.EndCursor().Encode()
+		for i := 0; i < 4; i++ {
+			c, err := storage.DecodeCursor(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cspec, err := c.Spec(skeys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var page []interface{}
+			var first mongo.DASRecord
+			err = store.Iterate(storage.Cache, bson.M{"$and": []interface{}{spec, cspec}}, nil, rkeys, 0, 2, func(rec mongo.DASRecord) error {
+				page = append([]interface{}{mongo.GetValue(rec, "file.name")}, page...)
+				first = rec
+				return nil
+			})
+			if err != nil || first == nil {
+				break
+			}
+			back = append(page, back...)
+			c = storage.NewCursor(first, rkeys[:len(rkeys)-1])
+			c.Prev = true
+			token = c.Encode()
+		}
+		if fmt.Sprint(all) != fmt.Sprint(back) {
+			t.Errorf("Fail TestStoreCursor, sort keys %v, records %v, previous pages %v\n", skeys, all, back)
+		}
+	}
+	if _, err := storage.DecodeCursor("bla"); err == nil {
+		t.Errorf("Fail TestStoreCursor, invalid cursor is accepted\n")
+	}
+}
+
+// TestStoreCursorLists
+func TestStoreCursorLists(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) { testStoreCursorLists(t, store) })
+	}
+}
+
+func testStoreCursorLists(t *testing.T, store storage.Store) {
+	// records with multiple files are ordered by smallest (largest) file size
+	sizes := map[string][]int64{"r1": {1, 10}, "r2": {5}, "r3": {3, 7}, "r4": {2, 2}, "r5": nil, "r6": {11}, "r7": {4, 6, 8}, "r8": {2, 9}}
+	var records []mongo.DASRecord
+	for name, vals := range sizes {
+		var files []mongo.DASRecord
+		for _, size := range vals {
+			files = append(files, mongo.DASRecord{"size": size})
+		}
+		rec := mongo.DASRecord{"qhash": "456", "name": name, "das": mongo.DASRecord{"record": 1}}
+		if files != nil {
+			rec["file"] = files
+		}
+		records = append(records, rec)
+	}
+	store.Insert(storage.Cache, records)
+	// records with equal sort values are ordered by _id unless name is given
+	expect := map[string]string{
+		"file.size,name":  "[r5 r1 r4 r8 r3 r7 r2 r6]",
+		"file.size,-name": "[r5 r1 r8 r4 r3 r7 r2 r6]",
+		"-file.size,name": "[r6 r1 r8 r7 r3 r2 r4 r5]",
+	}
+	for _, skeys := range [][]string{{"file.size"}, {"-file.size"}, {"file.size", "name"}, {"file.size", "-name"}, {"-file.size", "name"}} {
+		spec := bson.M{"qhash": "456"}
+		var all []interface{}
+		store.Iterate(storage.Cache, spec, nil, skeys, 0, -1, func(rec mongo.DASRecord) error {
+			all = append(all, rec["name"])
+			return nil
+		})
+		// walk all pages of two records
+		var paged []interface{}
+		token := ""
+		for i := 0; i < 10; i++ {
+			pspec := spec
+			if token != "" {
+				c, err := storage.DecodeCursor(token)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cspec, err := c.Spec(skeys)
+				if err != nil {
+					t.Fatal(err)
+				}
+				pspec = bson.M{"$and": []interface{}{spec, cspec}}
+			}
+			var last mongo.DASRecord
+			store.Iterate(storage.Cache, pspec, nil, skeys, 0, 2, func(rec mongo.DASRecord) error {
+				paged = append(paged, rec["name"])
+				last = rec
+				return nil
+			})
+			if last == nil {
+				break
+			}
+			token = storage.NewCursor(last, skeys).Encode()
+		}
+		if order, ok := expect[strings.Join(skeys, ",")]; ok && fmt.Sprint(all) != order {
+			t.Errorf("Fail TestStoreCursorLists, sort keys %v, wrong order %v\n", skeys, all)
+		}
+		if len(all) != len(sizes) || fmt.Sprint(paged) != fmt.Sprint(all) {
+			t.Errorf("Fail TestStoreCursorLists, sort keys %v, records %v, pages %v\n", skeys, all, paged)
+		}
+	}
+}
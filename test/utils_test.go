@@ -1,9 +1,18 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -164,8 +173,7 @@ func TestCerts(t *testing.T) {
 		// nothing to test
 		return
 	}
-	var tlsManager utils.TLSCertsManager
-	certs, err := tlsManager.GetCerts()
+	certs, err := utils.Credentials.Certs()
 	if err != nil {
 		t.Errorf("Fail TestCerts %v\n", err)
 	}
@@ -176,3 +184,497 @@ func TestCerts(t *testing.T) {
 		t.Errorf("Fail TestCerts: current certificate expired in 600 seconds\n")
 	}
 }
+
+// TestHTTPError
+func TestHTTPError(t *testing.T) {
+	header := http.Header{"Retry-After": []string{"2"}}
+	kinds := map[int]utils.FetchErrorKind{401: utils.FetchAuth, 404: utils.FetchNotFound, 429: utils.FetchThrottled, 500: utils.FetchServer, 400: utils.FetchClient, 302: utils.FetchRedirect}
+	for code, kind := range kinds {
+		e := utils.HTTPError(code, header, []byte("<html>error</html>"))
+		if e == nil || e.Kind != kind || e.StatusCode != code {
+			t.Errorf("Fail TestHTTPError, code %d, error %+v\n", code, e)
+			continue
+		}
+		if retry := kind == utils.FetchThrottled || kind == utils.FetchServer; e.Retryable() != retry {
+			t.Errorf("Fail TestHTTPError, code %d, retryable %v\n", code, e.Retryable())
+		}
+	}
+	if e := utils.HTTPError(503, header, nil); e.RetryAfter != 2*time.Second {
+		t.Errorf("Fail TestHTTPError, wrong Retry-After %v\n", e.RetryAfter)
+	}
+	if e := utils.HTTPError(200, header, nil); e != nil {
+		t.Errorf("Fail TestHTTPError, successful response is error %v\n", e)
+	}
+}
+
+// TestFetchRetry
+func TestFetchRetry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`[{"name": "bla"}]`))
+		}
+	}))
+	defer server.Close()
+	utils.UrlRetry = 2
+	out := make(chan utils.ResponseType, 1)
+	utils.Fetch(server.Client(), server.URL+"/data", "", out)
+	resp := <-out
+	if resp.Error != nil || resp.Retries != 1 || resp.StatusCode != 200 {
+		t.Errorf("Fail TestFetchRetry, response %s\n", resp.Details())
+	}
+
+	// authentication failures should not be retried
+	calls = 0
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+	}))
+	defer auth.Close()
+	utils.Fetch(auth.Client(), auth.URL+"/data", "", out)
+	resp = <-out
+	if utils.ErrorKind(resp.Error) != "auth" || calls != 1 {
+		t.Errorf("Fail TestFetchRetry, calls %d, response %s\n", calls, resp.Details())
+	}
+}
+
+// TestCircuitBreaker
+func TestCircuitBreaker(t *testing.T) {
+	var calls int32
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`[{"name": "bla"}]`))
+	}))
+	defer server.Close()
+	utils.BreakerThreshold = 2
+	utils.BreakerCooldown = 100 * time.Millisecond
+	defer func() { utils.BreakerThreshold = 0 }()
+	rurl := server.URL + "/dbs/data"
+	for i := 0; i < 2; i++ {
+		resp := utils.FetchResponse(server.Client(), rurl, "")
+		if utils.ErrorKind(resp.Error) != "server" {
+			t.Errorf("Fail TestCircuitBreaker, response %s\n", resp.Details())
+		}
+	}
+	// open breaker should short-circuit the call
+	resp := utils.FetchResponse(server.Client(), rurl, "")
+	if utils.ErrorKind(resp.Error) != "unavailable" || calls != 2 {
+		t.Errorf("Fail TestCircuitBreaker, calls %d, response %s\n", calls, resp.Details())
+	}
+	var state utils.BreakerState
+	for _, s := range utils.BreakerStates() {
+		if s.Service == "dbs" {
+			state = s
+		}
+	}
+	if state.State != utils.BreakerOpen || state.Failures != 2 {
+		t.Errorf("Fail TestCircuitBreaker, wrong state %+v\n", state)
+	}
+	// after cool-down period probe call closes the breaker
+	time.Sleep(150 * time.Millisecond)
+	atomic.StoreInt32(&healthy, 1)
+	resp = utils.FetchResponse(server.Client(), rurl, "")
+	if resp.Error != nil || calls != 3 {
+		t.Errorf("Fail TestCircuitBreaker, calls %d, response %s\n", calls, resp.Details())
+	}
+	for _, s := range utils.BreakerStates() {
+		if s.Service == "dbs" && s.State != utils.BreakerClosed {
+			t.Errorf("Fail TestCircuitBreaker, wrong state %+v\n", s)
+		}
+	}
+	// failures of CRIC calls open breaker of CRIC only
+	atomic.StoreInt32(&healthy, 0)
+	for i := 0; i < 2; i++ {
+		utils.FetchResponse(server.Client(), server.URL+"/cric/api", "")
+	}
+	for _, s := range utils.BreakerStates() {
+		if (s.Service == "cric") != (s.State == utils.BreakerOpen) {
+			t.Errorf("Fail TestCircuitBreaker, wrong state %+v\n", s)
+		}
+	}
+}
+
+// TestFetchScheduler
+func TestFetchScheduler(t *testing.T) {
+	var mutex sync.Mutex
+	var order []string
+	started := make(chan bool)
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			started <- true
+			<-release
+		} else {
+			mutex.Lock()
+			order = append(order, r.URL.Path)
+			mutex.Unlock()
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+	utils.Scheduler = utils.NewFetchScheduler(1)
+	defer func() { utils.Scheduler = nil }()
+	go utils.Scheduler.Run()
+
+	// the only slot is taken by blocking call, therefore other calls are pending
+	out := make(chan utils.ResponseType, 10)
+	utils.FetchQuery(server.Client(), server.URL+"/block", "", out, "block", utils.FetchInteractive)
+	<-started
+	utils.FetchQuery(server.Client(), server.URL+"/bg/1", "", out, "bg", utils.FetchBackground)
+	for _, path := range []string{"/q1/1", "/q1/2", "/q1/3"} {
+		utils.FetchQuery(server.Client(), server.URL+path, "", out, "q1", utils.FetchInteractive)
+	}
+	utils.FetchQuery(server.Client(), server.URL+"/q2/1", "", out, "q2", utils.FetchInteractive)
+	if utils.Scheduler.Pending() != 5 || utils.Scheduler.Running() != 1 {
+		t.Errorf("Fail TestFetchScheduler, pending %d, running %d\n", utils.Scheduler.Pending(), utils.Scheduler.Running())
+	}
+	close(release)
+	for i := 0; i < 6; i++ {
+		<-out
+	}
+	expect := []string{"/q1/1", "/q2/1", "/q1/2", "/q1/3", "/bg/1"}
+	if strings.Join(order, ",") != strings.Join(expect, ",") {
+		t.Errorf("Fail TestFetchScheduler, order %v, expect %v\n", order, expect)
+	}
+}
+
+// TestSchedulerSlots
+func TestSchedulerSlots(t *testing.T) {
+	var calls int32
+	started := make(chan bool, 10)
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/dashboard"):
+			started <- true
+			<-release
+		case r.URL.Path == "/conddb/retry" && atomic.AddInt32(&calls, 1) == 1:
+			started <- true
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+	utils.ServiceLimits = map[string]int{"dashboard": 1}
+	defer func() { utils.ServiceLimits = nil }()
+	utils.Scheduler = utils.NewFetchScheduler(2)
+	defer func() { utils.Scheduler = nil }()
+	go utils.Scheduler.Run()
+
+	// calls of saturated service wait for its slot without holding global slots
+	out := make(chan utils.ResponseType, 10)
+	for i := 0; i < 3; i++ {
+		utils.FetchQuery(server.Client(), fmt.Sprintf("%s/dashboard/%d", server.URL, i), "", out, "dashboard", utils.FetchInteractive)
+	}
+	<-started
+	utils.FetchQuery(server.Client(), server.URL+"/phedex/1", "", out, "phedex", utils.FetchInteractive)
+	select {
+	case resp := <-out:
+		if !strings.HasSuffix(resp.Url, "/phedex/1") {
+			t.Errorf("Fail TestSchedulerSlots, unexpected response %s\n", resp.Details())
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Fail TestSchedulerSlots, call of other service is starved by saturated service\n")
+	}
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-out
+	}
+
+	// failed call does not hold slots while it waits before retry
+	utils.Scheduler = utils.NewFetchScheduler(1)
+	go utils.Scheduler.Run()
+	utils.UrlRetry = 1
+	utils.FetchQuery(server.Client(), server.URL+"/conddb/retry", "", out, "retry", utils.FetchInteractive)
+	<-started
+	utils.FetchQuery(server.Client(), server.URL+"/mcm/1", "", out, "mcm", utils.FetchInteractive)
+	first, second := <-out, <-out
+	if !strings.HasSuffix(first.Url, "/mcm/1") || second.Error != nil || second.Retries != 1 {
+		t.Errorf("Fail TestSchedulerSlots, responses %s and %s\n", first.Details(), second.Details())
+	}
+}
+
+// TestMaxResponseSize
+func TestMaxResponseSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"name": "bla"}]`))
+	}))
+	defer server.Close()
+	utils.MaxResponseSize = 10
+	defer func() { utils.MaxResponseSize = 0 }()
+	resp := utils.FetchResponse(server.Client(), server.URL+"/data", "")
+	if utils.ErrorKind(resp.Error) != "too-large" || resp.StatusCode != 200 {
+		t.Errorf("Fail TestMaxResponseSize, response %s\n", resp.Details())
+	}
+	utils.MaxResponseSize = 100
+	resp = utils.FetchResponse(server.Client(), server.URL+"/data", "")
+	if resp.Error != nil || string(resp.Data) != `[{"name": "bla"}]` {
+		t.Errorf("Fail TestMaxResponseSize, response %s\n", resp.Details())
+	}
+}
+
+// TestResponseCache
+func TestResponseCache(t *testing.T) {
+	var calls, revalidations int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/fresh" {
+			w.Header().Set("Cache-Control", "max-age=60")
+		} else if r.URL.Path == "/nostore" {
+			w.Header().Set("Cache-Control", "no-store")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt32(&revalidations, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		w.Write([]byte(`[{"name": "bla"}]`))
+	}))
+	defer server.Close()
+	utils.Cache.MaxSize = 1024
+	defer func() { utils.Cache.MaxSize = 0 }()
+
+	// fresh response is served from the cache
+	for i := 0; i < 2; i++ {
+		resp := utils.FetchResponse(server.Client(), server.URL+"/fresh", "")
+		if resp.Error != nil || string(resp.Data) != `[{"name": "bla"}]` || resp.Cached != (i == 1) {
+			t.Errorf("Fail TestResponseCache, response %s\n", resp.Details())
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Fail TestResponseCache, fresh response is fetched %d times\n", calls)
+	}
+	// stale response is revalidated with conditional request
+	for i := 0; i < 2; i++ {
+		resp := utils.FetchResponse(server.Client(), server.URL+"/etag", "")
+		if resp.Error != nil || resp.StatusCode != 200 || string(resp.Data) != `[{"name": "bla"}]` {
+			t.Errorf("Fail TestResponseCache, response %s\n", resp.Details())
+		}
+	}
+	if calls != 3 || revalidations != 1 {
+		t.Errorf("Fail TestResponseCache, calls %d, revalidations %d\n", calls, revalidations)
+	}
+	// POST requests with different bodies are cached separately
+	utils.FetchResponse(server.Client(), server.URL+"/fresh", `{"a": 1}`)
+	resp := utils.FetchResponse(server.Client(), server.URL+"/fresh", `{"a": 2}`)
+	if resp.Cached || calls != 5 {
+		t.Errorf("Fail TestResponseCache, calls %d, response %s\n", calls, resp.Details())
+	}
+	// cache size is limited
+	utils.Cache.MaxSize = 10
+	utils.FetchResponse(server.Client(), server.URL+"/fresh?large", "")
+	if stats := utils.Cache.Stats(); stats.Size > 10 {
+		t.Errorf("Fail TestResponseCache, cache size %+v\n", stats)
+	}
+	// service TTL does not override no-cache and no-store directives
+	utils.Cache.MaxSize = 1024
+	utils.ResponseCacheTTL = map[string]int{"default": 60}
+	defer func() { utils.ResponseCacheTTL = nil }()
+	ncalls := atomic.LoadInt32(&calls)
+	for _, path := range []string{"/etag", "/etag", "/nostore", "/nostore"} {
+		utils.FetchResponse(server.Client(), server.URL+path, "")
+	}
+	if n := atomic.LoadInt32(&calls) - ncalls; n != 4 {
+		t.Errorf("Fail TestResponseCache, %d upstream calls of responses which should not be reused\n", n)
+	}
+}
+
+// TestFixtures
+func TestFixtures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Set-Cookie", "secret")
+		w.Write([]byte(fmt.Sprintf(`[{"method": "%s", "body": "%s"}]`, r.Method, body)))
+	}))
+	utils.FixtureDir = t.TempDir()
+	defer func() { utils.FixtureMode = "" }()
+	calls := [][]string{{"/data", ""}, {"/data", "a"}, {"/data", "b"}, {"/missing", ""}}
+
+	// record upstream calls
+	utils.FixtureMode = utils.FixtureRecord
+	var recorded []utils.ResponseType
+	for _, call := range calls {
+		recorded = append(recorded, utils.FetchResponse(server.Client(), server.URL+call[0], call[1]))
+	}
+	server.Close()
+
+	// replay them without the server
+	utils.FixtureMode = utils.FixtureReplay
+	for i, call := range calls {
+		resp := utils.FetchResponse(server.Client(), server.URL+call[0], call[1])
+		expect := recorded[i]
+		if string(resp.Data) != string(expect.Data) || resp.StatusCode != expect.StatusCode || utils.ErrorKind(resp.Error) != utils.ErrorKind(expect.Error) {
+			t.Errorf("Fail TestFixtures, replayed %s, recorded %s\n", resp.Details(), expect.Details())
+		}
+		if resp.Header.Get("Set-Cookie") != "" {
+			t.Errorf("Fail TestFixtures, sensitive header is recorded\n")
+		}
+	}
+	resp := utils.FetchResponse(server.Client(), server.URL+"/other", "")
+	if utils.ErrorKind(resp.Error) != "unavailable" {
+		t.Errorf("Fail TestFixtures, call without fixture %s\n", resp.Details())
+	}
+}
+
+// TestRetryPolicy
+func TestRetryPolicy(t *testing.T) {
+	utils.RetryPolicies = map[string]utils.RetryPolicy{
+		"default": {BaseDelay: 100, MaxDelay: 400},
+		"dbs":     {MaxAttempts: 5, Jitter: 1, StatusCodes: []int{404}},
+	}
+	defer func() { utils.RetryPolicies = nil }()
+	policy := utils.GetRetryPolicy("dbs")
+	if policy.MaxAttempts != 5 || policy.BaseDelay != 100 || policy.MaxDelay != 400 {
+		t.Errorf("Fail TestRetryPolicy, wrong policy %+v\n", policy)
+	}
+	if !policy.Retryable(utils.HTTPError(404, nil, nil)) || policy.Retryable(utils.HTTPError(401, nil, nil)) {
+		t.Errorf("Fail TestRetryPolicy, wrong retryable errors %+v\n", policy)
+	}
+	if utils.GetRetryPolicy("rucio").Retryable(utils.HTTPError(404, nil, nil)) {
+		t.Errorf("Fail TestRetryPolicy, policy of other service is used\n")
+	}
+	policy = utils.GetRetryPolicy("rucio")
+	policy.Jitter = 0
+	for attempt, delay := range map[int]time.Duration{1: 100, 2: 200, 3: 400, 5: 400} {
+		if d := policy.Delay(attempt); d != delay*time.Millisecond {
+			t.Errorf("Fail TestRetryPolicy, attempt %d, delay %v\n", attempt, d)
+		}
+	}
+	// default policy retries errors which are FetchError.Retryable
+	for _, code := range []int{302, 400, 404, 429, 500, 503} {
+		e := utils.HTTPError(code, nil, nil)
+		if utils.DefaultRetryPolicy().Retryable(e) != e.Retryable() {
+			t.Errorf("Fail TestRetryPolicy, default policy of status %d differs from error %+v\n", code, e)
+		}
+	}
+
+	// zero values of configured policy override defaults
+	config := `{"default": {"baseDelay": 100}, "dbs": {"maxAttempts": 0, "jitter": 0}}`
+	if err := json.Unmarshal([]byte(config), &utils.RetryPolicies); err != nil {
+		t.Fatal(err)
+	}
+	utils.UrlRetry = 3
+	policy = utils.GetRetryPolicy("dbs")
+	if policy.MaxAttempts != 0 || policy.Jitter != 0 || policy.BaseDelay != 100 || policy.MaxDelay != 30000 {
+		t.Errorf("Fail TestRetryPolicy, zero values are not used %+v\n", policy)
+	}
+	if policy = utils.GetRetryPolicy("rucio"); policy.MaxAttempts != 3 || policy.Jitter != 0.5 {
+		t.Errorf("Fail TestRetryPolicy, wrong default policy %+v\n", policy)
+	}
+	budget := &utils.RetryBudget{Rate: 1, Burst: 2}
+	if !budget.Take() || !budget.Take() || budget.Take() {
+		t.Errorf("Fail TestRetryPolicy, retry budget is not limited\n")
+	}
+}
+
+// TestRetryBudget
+func TestRetryBudget(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	utils.RetryPolicies = map[string]utils.RetryPolicy{"default": {MaxAttempts: 5, BaseDelay: 1, MaxDelay: 1}}
+	defer func() { utils.RetryPolicies = nil }()
+	if utils.Budget.Rate <= 0 {
+		t.Errorf("Fail TestRetryBudget, retries are not limited by default %+v\n", utils.Budget)
+	}
+	budget := utils.Budget
+	utils.Budget = &utils.RetryBudget{Rate: 0.001, Burst: 2}
+	defer func() { utils.Budget = budget }()
+
+	// failed calls are retried until budget is exhausted
+	for i := 0; i < 3; i++ {
+		ch := make(chan utils.ResponseType)
+		go utils.Fetch(server.Client(), server.URL, "", ch)
+		if resp := <-ch; resp.Error == nil {
+			t.Errorf("Fail TestRetryBudget, response %s\n", resp.Details())
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 5 {
+		t.Errorf("Fail TestRetryBudget, %d upstream calls, expect 3 calls and 2 retries\n", n)
+	}
+}
+
+// TestCredentials
+func TestCredentials(t *testing.T) {
+	// bearer token is re-read once its file has changed
+	jwt := func(exp int64) string {
+		claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp": %d}`, exp)))
+		return "header." + claims + ".signature"
+	}
+	fname := filepath.Join(t.TempDir(), "token")
+	token := jwt(time.Now().Add(30 * time.Second).Unix())
+	if err := os.WriteFile(fname, []byte(token+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	utils.Token = fname
+	defer func() { utils.Token = "" }()
+	if v := utils.Credentials.BearerToken(); v != token {
+		t.Errorf("Fail TestCredentials, bearer token %s\n", v)
+	}
+	for _, s := range utils.Credentials.States() {
+		if s.Name == "bearer" && s.Warning == "" {
+			t.Errorf("Fail TestCredentials, no warning about expiring token %+v\n", s)
+		}
+	}
+	token = jwt(time.Now().Add(time.Hour).Unix())
+	if err := os.WriteFile(fname, []byte(token+"\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	utils.Credentials.Reload()
+	if v := utils.Credentials.BearerToken(); v != token {
+		t.Errorf("Fail TestCredentials, reloaded bearer token %s\n", v)
+	}
+
+	// concurrent callers share single Rucio token
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("X-Rucio-Auth-Token", fmt.Sprintf("token-%d", n))
+		w.Header().Set("X-Rucio-Auth-Token-Expires", time.Now().Add(time.Hour).UTC().Format(time.RFC1123))
+	}))
+	defer server.Close()
+	utils.RucioAuthMethod = utils.RucioAuthUserpass
+	utils.RucioUsername = "das"
+	utils.RucioPassword = "secret"
+	defer func() { utils.RucioAuthMethod = "" }()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := utils.Credentials.RucioToken(server.URL + "/auth/userpass"); v != "token-1" || err != nil {
+				t.Errorf("Fail TestCredentials, rucio token %s, error %v\n", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("Fail TestCredentials, %d calls of rucio auth server\n", calls)
+	}
+	for _, s := range utils.Credentials.States() {
+		if s.Name == "rucio" && (s.Expire == "" || s.Warning != "") {
+			t.Errorf("Fail TestCredentials, rucio token state %+v\n", s)
+		}
+	}
+}
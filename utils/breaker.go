@@ -0,0 +1,208 @@
+package utils
+
+// DAS utils module, per-service concurrency limits and circuit breakers
+// Every service (system) has its own limit of concurrent calls, such that slow
+// service does not starve calls of other services, and its own circuit breaker.
+// After BreakerThreshold consecutive failures the breaker opens and calls of
+// the service fail immediately during BreakerCooldown period, afterwards single
+// probe call is allowed which either closes the breaker or opens it again.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ServiceLimits keeps max number of concurrent calls of services (systems), e.g.
+// dbs or rucio, the default key defines limit of all other services, 0 means no limit
+var ServiceLimits map[string]int
+
+// BreakerThreshold defines number of consecutive failures which opens circuit breaker, 0 disables breakers
+var BreakerThreshold int
+
+// BreakerCooldown defines period during which calls of service with open breaker fail immediately
+var BreakerCooldown = 60 * time.Second
+
+// BreakerClosed and others represent states of circuit breaker
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// CircuitBreaker keeps track of consecutive failures of the service
+type CircuitBreaker struct {
+	sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// Allow checks if call of the service is allowed, it returns an error if breaker is open
+func (b *CircuitBreaker) Allow() error {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < BreakerCooldown {
+			return errors.New("circuit breaker is open")
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return errors.New("circuit breaker is half-open, waiting for probe call")
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// Record records outcome of the service call, only failures which indicate
+// that service is unhealthy (retryable failures, see FetchError.Retryable) count
+func (b *CircuitBreaker) Record(err error) {
+	b.Lock()
+	defer b.Unlock()
+	var e *FetchError
+	failed := errors.As(err, &e) && e.Retryable()
+	b.probing = false
+	if !failed {
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == BreakerHalfOpen || (BreakerThreshold > 0 && b.failures >= BreakerThreshold) {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// serviceState keeps concurrency limit and circuit breaker of the service
+type serviceState struct {
+	sem     chan struct{}
+	running int32
+	breaker CircuitBreaker
+}
+
+// global map of service states
+var _serviceStates = struct {
+	sync.Mutex
+	states map[string]*serviceState
+}{states: make(map[string]*serviceState)}
+
+// helper function to get state of given service (system)
+func getServiceState(srv string) *serviceState {
+	_serviceStates.Lock()
+	defer _serviceStates.Unlock()
+	if s, ok := _serviceStates.states[srv]; ok {
+		return s
+	}
+	s := &serviceState{breaker: CircuitBreaker{state: BreakerClosed}}
+	limit, ok := ServiceLimits[srv]
+	if !ok {
+		limit = ServiceLimits["default"]
+	}
+	if limit > 0 {
+		s.sem = make(chan struct{}, limit)
+	}
+	_serviceStates.states[srv] = s
+	return s
+}
+
+// helper function to acquire slot of the service
+func (s *serviceState) acquire() {
+	if s.sem != nil {
+		s.sem <- struct{}{}
+	}
+	s.breaker.Lock()
+	s.running++
+	s.breaker.Unlock()
+}
+
+// helper function to acquire slot of the service without waiting, it returns
+// false if all slots of the service are taken
+func (s *serviceState) tryAcquire() bool {
+	if s.sem != nil {
+		select {
+		case s.sem <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	s.breaker.Lock()
+	s.running++
+	s.breaker.Unlock()
+	return true
+}
+
+// helper function to release slot of the service, the scheduler is notified
+// since it may wait for free slot of the service
+func (s *serviceState) release() {
+	s.breaker.Lock()
+	s.running--
+	s.breaker.Unlock()
+	if s.sem != nil {
+		<-s.sem
+	}
+	if sched := Scheduler; sched != nil {
+		sched.wake()
+	}
+}
+
+// BreakerState represents state of service circuit breaker and its concurrency
+type BreakerState struct {
+	Service  string `json:"service"`
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	Running  int32  `json:"running"`
+	Limit    int    `json:"limit"`
+	Until    string `json:"until"` // end of cool-down period of open breaker
+}
+
+// BreakerStates returns states of all services called so far
+func BreakerStates() []BreakerState {
+	_serviceStates.Lock()
+	var srvs []string
+	for srv := range _serviceStates.states {
+		srvs = append(srvs, srv)
+	}
+	_serviceStates.Unlock()
+	sort.Strings(srvs)
+	var out []BreakerState
+	for _, srv := range srvs {
+		s := getServiceState(srv)
+		s.breaker.Lock()
+		state := BreakerState{Service: srv, State: s.breaker.state, Failures: s.breaker.failures, Running: s.running, Limit: cap(s.sem)}
+		if s.breaker.state == BreakerOpen {
+			state.Until = s.breaker.openedAt.Add(BreakerCooldown).Format(time.RFC3339)
+		}
+		s.breaker.Unlock()
+		out = append(out, state)
+	}
+	return out
+}
+
+// helper function to check circuit breaker of the service and acquire its slot
+// unless it is already acquired (by the scheduler), returned function records
+// outcome of the call and releases the slot
+func startCall(srv string, acquired bool) (func(err error), error) {
+	s := getServiceState(srv)
+	if err := s.breaker.Allow(); err != nil {
+		if acquired {
+			s.release()
+		}
+		return nil, &FetchError{Kind: FetchUnavailable, Err: fmt.Errorf("%s service is unavailable, %v", srv, err)}
+	}
+	if !acquired {
+		s.acquire()
+	}
+	return func(err error) {
+		s.release()
+		s.breaker.Record(err)
+	}, nil
+}
@@ -0,0 +1,395 @@
+package utils
+
+// DAS utils module, credential manager
+// The manager owns credentials used in upstream calls: X509 proxy or user
+// cert/key pair, bearer token (see Token) and Rucio token. It is safe for
+// concurrent use, reloads X509 credentials and bearer token when their files
+// change and refreshes Rucio token ahead of its expiration.
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CredentialsRefreshAhead defines how long before expiration tokens are refreshed
+var CredentialsRefreshAhead = 60 * time.Second
+
+// CredentialsWarnPeriod defines how long before expiration X509 credentials are reported as expiring
+var CredentialsWarnPeriod = 24 * time.Hour
+
+// Credentials represents instance of credential manager
+var Credentials CredentialManager
+
+// fileStamp represents modification time and size of credential file
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+// helper function to get stamps of given files, empty names are skipped
+func fileStamps(files ...string) map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	for _, fname := range files {
+		if fname == "" {
+			continue
+		}
+		var stamp fileStamp
+		if fi, err := os.Stat(fname); err == nil {
+			stamp = fileStamp{mod: fi.ModTime(), size: fi.Size()}
+		}
+		stamps[fname] = stamp
+	}
+	return stamps
+}
+
+// helper function to compare file stamps
+func sameStamps(s1, s2 map[string]fileStamp) bool {
+	if len(s1) != len(s2) {
+		return false
+	}
+	for fname, stamp := range s1 {
+		if v, ok := s2[fname]; !ok || !v.mod.Equal(stamp.mod) || v.size != stamp.size {
+			return false
+		}
+	}
+	return true
+}
+
+// CredentialManager holds credentials used in upstream calls
+type CredentialManager struct {
+	sync.RWMutex
+	certs       []tls.Certificate    // X509 proxy or user certificate
+	certStamps  map[string]fileStamp // stamps of X509 files
+	certLoaded  time.Time
+	certError   error
+	token       string // bearer token
+	tokenSource string // value of Token it is obtained from
+	tokenStamps map[string]fileStamp
+	tokenLoaded time.Time
+	tokenError  error
+	rucioToken  string
+	rucioUrl    string
+	rucioExpire time.Time
+	rucioLoaded time.Time
+	rucioError  error
+	rucioStamps map[string]fileStamp // stamps of OIDC token file
+	rucioLock   sync.Mutex           // serializes requests of Rucio tokens
+	warned      map[string]bool      // credentials we already warned about
+}
+
+// helper function to get X509 files, the proxy takes precedence over cert/key pair
+func x509Files() []string {
+	uproxy := os.Getenv("X509_USER_PROXY")
+	uckey := os.Getenv("X509_USER_KEY")
+	ucert := os.Getenv("X509_USER_CERT")
+
+	// check if /tmp/x509up_u$UID exists, if so setup X509_USER_PROXY env
+	if u, err := user.Current(); err == nil {
+		fname := fmt.Sprintf("/tmp/x509up_u%s", u.Uid)
+		if _, err := os.Stat(fname); err == nil {
+			uproxy = fname
+		}
+	}
+	if uproxy != "" {
+		return []string{uproxy}
+	}
+	if uckey != "" {
+		return []string{ucert, uckey}
+	}
+	return nil
+}
+
+// helper function to (re-)load X509 credentials, it should be called under lock.
+// On failure we keep existing credentials to avoid collision between cron
+// obtaining the proxy and this code base.
+func (m *CredentialManager) loadCerts() error {
+	files := x509Files()
+	stamps := fileStamps(files...)
+	if WEBSERVER > 0 {
+		log.Printf("read new certs %v renewal_interval=%v\n", files, TLSCertsRenewInterval)
+	}
+	certs, err := tlsCerts(files)
+	m.certLoaded = time.Now()
+	m.certError = err
+	if err != nil {
+		log.Printf("ERROR: unable to load X509 credentials %v, error %v\n", files, err)
+		return err
+	}
+	m.certs = certs
+	m.certStamps = stamps
+	delete(m.warned, "x509")
+	return nil
+}
+
+// Certs returns X509 credentials, they are loaded on first call
+func (m *CredentialManager) Certs() ([]tls.Certificate, error) {
+	m.RLock()
+	if !m.certLoaded.IsZero() {
+		defer m.RUnlock()
+		if m.certs == nil {
+			return nil, m.certError
+		}
+		return m.certs, nil
+	}
+	m.RUnlock()
+	m.Lock()
+	defer m.Unlock()
+	if m.certLoaded.IsZero() {
+		m.loadCerts()
+	}
+	if m.certs == nil {
+		return nil, m.certError
+	}
+	return m.certs, nil
+}
+
+// ClientCertificate provides X509 certificate for TLS handshakes, it allows to
+// use reloaded credentials without re-creating HTTP clients
+func (m *CredentialManager) ClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	certs, err := m.Certs()
+	if len(certs) == 0 {
+		// empty certificate means that client does not provide any
+		return &tls.Certificate{}, err
+	}
+	return &certs[0], nil
+}
+
+// helper function to (re-)load bearer token, it should be called under lock
+func (m *CredentialManager) loadToken() error {
+	m.tokenSource = Token
+	m.tokenStamps = nil
+	m.tokenLoaded = time.Now()
+	m.tokenError = nil
+	if _, err := os.Stat(Token); err != nil {
+		// token is provided as a string
+		m.token = Token
+		delete(m.warned, "bearer")
+		return nil
+	}
+	stamps := fileStamps(Token)
+	data, err := os.ReadFile(Token)
+	if err != nil {
+		m.tokenError = err
+		log.Printf("ERROR: unable to read token from file %s, error %v\n", Token, err)
+		return err
+	}
+	m.token = strings.Replace(string(data), "\n", "", -1)
+	m.tokenStamps = stamps
+	delete(m.warned, "bearer")
+	return nil
+}
+
+// BearerToken returns bearer token defined by Token, either the token itself or
+// content of the file it points to
+func (m *CredentialManager) BearerToken() string {
+	m.RLock()
+	if m.tokenSource == Token && !m.tokenLoaded.IsZero() {
+		defer m.RUnlock()
+		return m.token
+	}
+	m.RUnlock()
+	m.Lock()
+	defer m.Unlock()
+	if m.tokenSource != Token || m.tokenLoaded.IsZero() {
+		m.loadToken()
+	}
+	return m.token
+}
+
+// helper function to get expiration time of JWT token, zero time is returned
+// if token is not JWT one or does not have exp claim
+func tokenExpire(token string) time.Time {
+	arr := strings.Split(token, ".")
+	if len(arr) != 3 {
+		return time.Time{}
+	}
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(arr[1], "="))
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(data, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+// RucioToken returns Rucio token obtained from given auth url. The token is
+// renewed CredentialsRefreshAhead before its expiration, concurrent callers
+// wait for single request of new token.
+func (m *CredentialManager) RucioToken(rurl string) (string, error) {
+	m.RLock()
+	if m.rucioFresh(rurl) {
+		defer m.RUnlock()
+		return m.rucioToken, nil
+	}
+	m.RUnlock()
+
+	m.rucioLock.Lock()
+	defer m.rucioLock.Unlock()
+	// token could be obtained by another caller while we were waiting
+	m.RLock()
+	if m.rucioFresh(rurl) {
+		defer m.RUnlock()
+		return m.rucioToken, nil
+	}
+	m.RUnlock()
+	if VERBOSE > 1 {
+		log.Println("get new rucio token", rurl)
+	}
+	stamps := fileStamps(rucioTokenFiles()...)
+	token, expire, err := FetchRucioToken(rurl)
+	m.Lock()
+	defer m.Unlock()
+	m.rucioError = err
+	if err != nil {
+		log.Printf("ERROR: unable to get rucio token from %s, error %v\n", rurl, err)
+		// keep using existing token until it expires
+		if m.rucioToken != "" && m.rucioUrl == rurl && time.Now().Before(m.rucioExpire) {
+			return m.rucioToken, nil
+		}
+		m.rucioToken = ""
+		m.rucioUrl = rurl
+		return "", err
+	}
+	m.rucioToken = token
+	m.rucioUrl = rurl
+	m.rucioExpire = time.Unix(expire, 0)
+	m.rucioLoaded = time.Now()
+	m.rucioStamps = stamps
+	delete(m.warned, "rucio")
+	return m.rucioToken, nil
+}
+
+// helper function to check if Rucio token is valid and does not need refresh
+func (m *CredentialManager) rucioFresh(rurl string) bool {
+	return m.rucioToken != "" && m.rucioUrl == rurl && time.Until(m.rucioExpire) > CredentialsRefreshAhead
+}
+
+// Reload reloads X509 credentials and bearer token if their files have
+// changed or TLSCertsRenewInterval has passed since last load, Rucio token is
+// marked for refresh if its OIDC token file has changed
+func (m *CredentialManager) Reload() {
+	m.Lock()
+	defer m.Unlock()
+	if !m.certLoaded.IsZero() {
+		files := x509Files()
+		if !sameStamps(m.certStamps, fileStamps(files...)) {
+			log.Printf("X509 credentials %v have changed\n", files)
+			m.loadCerts()
+		} else if TLSCertsRenewInterval > 0 && time.Since(m.certLoaded) > TLSCertsRenewInterval {
+			m.loadCerts()
+		}
+	}
+	if m.tokenStamps != nil && !sameStamps(m.tokenStamps, fileStamps(m.tokenSource)) {
+		log.Printf("token file %s has changed\n", m.tokenSource)
+		m.loadToken()
+	}
+	if len(m.rucioStamps) > 0 && !sameStamps(m.rucioStamps, fileStamps(rucioTokenFiles()...)) {
+		log.Printf("rucio token file %v has changed\n", rucioTokenFiles())
+		m.rucioExpire = time.Time{}
+	}
+}
+
+// Watch periodically reloads changed credentials, refreshes Rucio token ahead
+// of its expiration and warns about credentials which expire soon
+func (m *CredentialManager) Watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		m.Reload()
+		m.RLock()
+		rurl, refresh := m.rucioUrl, m.rucioToken != "" && !m.rucioFresh(m.rucioUrl)
+		m.RUnlock()
+		if refresh {
+			m.RucioToken(rurl)
+		}
+		for _, s := range m.States() {
+			if s.Warning == "" {
+				continue
+			}
+			m.Lock()
+			if m.warned == nil {
+				m.warned = make(map[string]bool)
+			}
+			warned := m.warned[s.Name]
+			m.warned[s.Name] = true
+			m.Unlock()
+			if !warned {
+				log.Printf("WARNING: %s credentials %s %s\n", s.Name, s.Source, s.Warning)
+			}
+		}
+	}
+}
+
+// CredentialState represents state of credential used in upstream calls
+type CredentialState struct {
+	Name    string `json:"name"`    // x509, bearer or rucio
+	Source  string `json:"source"`  // file or url credential is obtained from
+	Loaded  string `json:"loaded"`  // time credential was (re-)loaded
+	Expire  string `json:"expire"`  // expiration time, empty if unknown
+	Error   string `json:"error"`   // error of last load
+	Warning string `json:"warning"` // warning about expiring credential
+}
+
+// helper function to build credential state
+func credentialState(name, source string, loaded, expire time.Time, warn time.Duration, err error) CredentialState {
+	s := CredentialState{Name: name, Source: source}
+	if !loaded.IsZero() {
+		s.Loaded = loaded.Format(time.RFC3339)
+	}
+	if !expire.IsZero() {
+		s.Expire = expire.Format(time.RFC3339)
+		if d := time.Until(expire); d <= 0 {
+			s.Warning = "expired"
+		} else if d < warn {
+			s.Warning = fmt.Sprintf("expires in %v", d.Round(time.Second))
+		}
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	return s
+}
+
+// States returns states of credentials loaded so far
+func (m *CredentialManager) States() []CredentialState {
+	m.RLock()
+	defer m.RUnlock()
+	var out []CredentialState
+	if !m.certLoaded.IsZero() {
+		var files []string
+		for fname := range m.certStamps {
+			files = append(files, fname)
+		}
+		sort.Strings(files)
+		var expire time.Time
+		if m.certs != nil {
+			expire = CertExpire(m.certs)
+		}
+		out = append(out, credentialState("x509", strings.Join(files, ","), m.certLoaded, expire, CredentialsWarnPeriod, m.certError))
+	}
+	if !m.tokenLoaded.IsZero() && m.token != "" {
+		source := "config"
+		if m.tokenStamps != nil {
+			source = m.tokenSource
+		}
+		// tokens are short-lived and renewed either by DAS or by external
+		// tools, we warn only if token was not renewed in time
+		out = append(out, credentialState("bearer", source, m.tokenLoaded, tokenExpire(m.token), CredentialsRefreshAhead, m.tokenError))
+	}
+	if !m.rucioLoaded.IsZero() || m.rucioError != nil {
+		out = append(out, credentialState("rucio", m.rucioUrl, m.rucioLoaded, m.rucioExpire, CredentialsRefreshAhead/2, m.rucioError))
+	}
+	return out
+}
@@ -1,5 +1,14 @@
 package utils
 
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // DASServerError and others are represent different types of errors in DAS
 const (
 	_ = iota
@@ -44,3 +53,180 @@ const (
 	DASParserErrorName     = "DAS parser error"
 	DASValidationErrorName = "DAS validation error"
 )
+
+// SystemError returns DAS error code and its name for given CMS data-service
+func SystemError(system string) (int, string) {
+	switch system {
+	case "dbs", "dbs3":
+		return DBSError, DBSErrorName
+	case "phedex":
+		return PhedexError, PhedexErrorName
+	case "rucio":
+		return RucioError, RucioErrorName
+	case "dynamo":
+		return DynamoError, DynamoErrorName
+	case "reqmgr", "reqmgr2":
+		return ReqMgrError, ReqMgrErrorName
+	case "runregistry":
+		return RunRegistryError, RunRegistryErrorName
+	case "mcm":
+		return McMError, McMErrorName
+	case "dashboard":
+		return DashboardError, DashboardErrorName
+	case "sitedb2":
+		return SiteDBError, SiteDBErrorName
+	case "cric":
+		return CRICError, CRICErrorName
+	case "conddb":
+		return CondDBError, CondDBErrorName
+	case "combined":
+		return CombinedError, CombinedErrorName
+	}
+	return DASServerError, DASServerErrorName
+}
+
+// Truncate returns given message truncated to given size, e.g. to keep
+// upstream error messages (HTML pages, etc.) within reasonable limits
+func Truncate(msg string, size int) string {
+	if size <= 0 || len(msg) <= size {
+		return msg
+	}
+	return msg[:size] + "..."
+}
+
+// FetchErrorKind classifies failures of upstream calls
+type FetchErrorKind int
+
+// FetchTransport and others represent kinds of upstream failures
+const (
+	_                FetchErrorKind = iota
+	FetchTransport                  // network failure, e.g. connection refused or timeout
+	FetchAuth                       // HTTP 401 and 403, e.g. expired token or proxy
+	FetchNotFound                   // HTTP 404 and 410
+	FetchThrottled                  // HTTP 429, client should slow down
+	FetchServer                     // HTTP 5xx
+	FetchClient                     // other HTTP 4xx, e.g. bad request
+	FetchMalformed                  // payload which can not be decoded
+	FetchUnavailable                // service is short-circuited by its circuit breaker
+	FetchTooLarge                   // response exceeds MaxResponseSize
+	FetchRedirect                   // HTTP 3xx which is not followed by HTTP client
+)
+
+// String returns name of the failure kind
+func (k FetchErrorKind) String() string {
+	switch k {
+	case FetchTransport:
+		return "transport"
+	case FetchAuth:
+		return "auth"
+	case FetchNotFound:
+		return "not-found"
+	case FetchThrottled:
+		return "throttled"
+	case FetchServer:
+		return "server"
+	case FetchClient:
+		return "client"
+	case FetchMalformed:
+		return "malformed"
+	case FetchUnavailable:
+		return "unavailable"
+	case FetchTooLarge:
+		return "too-large"
+	case FetchRedirect:
+		return "redirect"
+	}
+	return "unknown"
+}
+
+// MaxErrorBody defines max size of upstream response body we keep in error message
+const MaxErrorBody = 256
+
+// FetchError represents failure of upstream call
+type FetchError struct {
+	Kind       FetchErrorKind
+	StatusCode int           // HTTP status code, 0 for transport failures
+	RetryAfter time.Duration // delay requested by upstream via Retry-After header
+	Message    string        // truncated response body
+	Err        error         // underlying transport error
+}
+
+// Error implements error interface
+func (e *FetchError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("HTTP status %d (%s), %s", e.StatusCode, e.Kind, e.Message)
+}
+
+// Unwrap returns underlying transport error
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable checks if upstream call may succeed when it is repeated, such
+// failures also indicate that service is unhealthy, see CircuitBreaker
+func (e *FetchError) Retryable() bool {
+	switch e.Kind {
+	case FetchTransport, FetchThrottled, FetchServer:
+		return true
+	}
+	return false
+}
+
+// HTTPError classifies HTTP response with given status code, header and body,
+// it returns nil for successful (2xx) responses
+func HTTPError(code int, header http.Header, body []byte) *FetchError {
+	if code >= 200 && code < 300 {
+		return nil
+	}
+	e := &FetchError{StatusCode: code, Message: Truncate(strings.TrimSpace(string(body)), MaxErrorBody)}
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		e.Kind = FetchAuth
+	case code == http.StatusNotFound || code == http.StatusGone:
+		e.Kind = FetchNotFound
+	case code == http.StatusTooManyRequests:
+		e.Kind = FetchThrottled
+	case code >= 300 && code < 400:
+		e.Kind = FetchRedirect
+		if loc := header.Get("Location"); loc != "" {
+			e.Message = fmt.Sprintf("redirect to %s, %s", loc, e.Message)
+		}
+	case code >= 500:
+		e.Kind = FetchServer
+	default:
+		e.Kind = FetchClient
+	}
+	if header != nil {
+		e.RetryAfter = parseRetryAfter(header.Get("Retry-After"))
+	}
+	return e
+}
+
+// helper function to parse Retry-After header, it contains either number of
+// seconds or HTTP date
+func parseRetryAfter(val string) time.Duration {
+	if val == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(val); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// ErrorKind returns kind of failure of upstream call, or empty string if
+// given error is not a FetchError
+func ErrorKind(err error) string {
+	var e *FetchError
+	if errors.As(err, &e) {
+		return e.Kind.String()
+	}
+	return ""
+}
@@ -12,18 +12,16 @@ package utils
 import (
 	"bytes"
 	"compress/gzip"
-	"container/heap"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
-	"os/user"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -61,42 +59,6 @@ var UseDNSCache bool
 // TLSCertsRenewInterval controls interval to re-read TLS certs (in seconds)
 var TLSCertsRenewInterval time.Duration
 
-// TLSCerts holds TLS certificates for the server
-type TLSCertsManager struct {
-	Certs  []tls.Certificate
-	Expire time.Time
-}
-
-// GetCerts return fresh copy of certificates
-func (t *TLSCertsManager) GetCerts() ([]tls.Certificate, error) {
-	var lock = sync.Mutex{}
-	lock.Lock()
-	defer lock.Unlock()
-	// we'll use existing certs if our window is not expired
-	if t.Certs == nil || time.Since(t.Expire) > TLSCertsRenewInterval {
-		t.Expire = time.Now()
-		if WEBSERVER > 0 {
-			log.Printf("read new certs expire=\"%v\" renewal_interval=%v\n", t.Expire, TLSCertsRenewInterval)
-		}
-		certs, err := tlsCerts()
-		if err == nil {
-			t.Certs = certs
-		} else {
-			// to avoid collision between cron obtaining the proxy and
-			// this code base if we have error we'll increase interval instead of failure
-			if t.Certs != nil {
-				ts := time.Now().Add(time.Duration(600 * time.Second))
-				if CertExpire(t.Certs).After(ts) {
-					t.Expire = ts
-				}
-			} else {
-				log.Fatal("ERROR ", err.Error())
-			}
-		}
-	}
-	return t.Certs, nil
-}
-
 // CertExpire gets minimum certificate expire from list of certificates
 func CertExpire(certs []tls.Certificate) time.Time {
 	var notAfter time.Time
@@ -110,31 +72,16 @@ func CertExpire(certs []tls.Certificate) time.Time {
 	return notAfter
 }
 
-// global TLSCerts manager
-var tlsManager TLSCertsManager
-
-// client X509 certificates
-func tlsCerts() ([]tls.Certificate, error) {
-	uproxy := os.Getenv("X509_USER_PROXY")
-	uckey := os.Getenv("X509_USER_KEY")
-	ucert := os.Getenv("X509_USER_CERT")
-
-	// check if /tmp/x509up_u$UID exists, if so setup X509_USER_PROXY env
-	u, err := user.Current()
-	if err == nil {
-		fname := fmt.Sprintf("/tmp/x509up_u%s", u.Uid)
-		if _, err := os.Stat(fname); err == nil {
-			uproxy = fname
-		}
-	}
+// client X509 certificates from either proxy or user cert/key files
+func tlsCerts(files []string) ([]tls.Certificate, error) {
 	if WEBSERVER == 1 {
-		log.Printf("tls certs, X509_USER_PROXY=%v, X509_USER_KEY=%v, X509_USER_CERT=%v\n", uproxy, uckey, ucert)
+		log.Printf("tls certs, files %v\n", files)
 	}
-
-	if uproxy == "" && uckey == "" { // user doesn't have neither proxy or user certs
+	if len(files) == 0 { // user doesn't have neither proxy or user certs
 		return nil, nil
 	}
-	if uproxy != "" {
+	if len(files) == 1 {
+		uproxy := files[0]
 		// use local implementation of LoadX409KeyPair instead of tls one
 		x509cert, err := x509proxy.LoadX509Proxy(uproxy)
 		if err != nil {
@@ -146,6 +93,7 @@ func tlsCerts() ([]tls.Certificate, error) {
 		certs := []tls.Certificate{x509cert}
 		return certs, nil
 	}
+	ucert, uckey := files[0], files[1]
 	x509cert, err := tls.LoadX509KeyPair(ucert, uckey)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse user X509 certificate: %v", err)
@@ -157,25 +105,13 @@ func tlsCerts() ([]tls.Certificate, error) {
 	return certs, nil
 }
 
-// helper function to either read file content or return given string
-func readToken(r string) string {
-	if _, err := os.Stat(r); err == nil {
-		b, e := os.ReadFile(r)
-		if e != nil {
-			log.Fatalf("Unable to read data from file: %s, error: %s", r, e)
-		}
-		return strings.Replace(string(b), "\n", "", -1)
-	}
-	return r
-}
-
 // HttpClient is HTTP client for urlfetch server
 func HttpClient() *http.Client {
 	var certs []tls.Certificate
 	var err error
 	if Token == "" { // if there is no token back auth we fall back to x509
 		// get X509 certs
-		certs, err = tlsManager.GetCerts()
+		certs, err = Credentials.Certs()
 		if err != nil {
 			log.Fatal("ERROR ", err.Error())
 		}
@@ -187,8 +123,10 @@ func HttpClient() *http.Client {
 		}
 		return &http.Client{}
 	}
+	// certificates are provided by credential manager at handshake time
+	// such that reloaded credentials are used by existing clients
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{Certificates: certs,
+		TLSClientConfig: &tls.Config{GetClientCertificate: Credentials.ClientCertificate,
 			InsecureSkipVerify: true},
 	}
 	if TIMEOUT > 0 {
@@ -200,14 +138,19 @@ func HttpClient() *http.Client {
 // ResponseType structure is what we expect to get for our URL call.
 // It contains a request URL, the data chunk and possible error from remote
 type ResponseType struct {
-	Url       string
-	Data      []byte
-	Error     error
-	Time      time.Duration
-	Params    string
-	Method    string
-	SendBytes int
-	RecvBytes int
+	Url        string
+	Data       []byte
+	Error      error
+	Time       time.Duration
+	Params     string
+	Method     string
+	SendBytes  int
+	RecvBytes  int
+	StatusCode int
+	Retries    int
+	Header     http.Header   // response headers
+	Cached     bool          // response is served from cache of upstream responses
+	Body       *ResponseBody // unread body of streamed response, see FetchStream
 }
 
 // String returns ResponseType representation
@@ -218,46 +161,10 @@ func (r *ResponseType) String() string {
 
 // Details returns ResponseType details
 func (r *ResponseType) Details() string {
-	s := fmt.Sprintf("system=%s method=%s url=\"%s\" params=\"%v\" time=%v sendBytes=%v recvBytes=%v error=%v", system(r.Url), r.Method, r.Url, r.Params, r.Time, r.SendBytes, r.RecvBytes, r.Error)
+	s := fmt.Sprintf("system=%s method=%s url=\"%s\" params=\"%v\" time=%v sendBytes=%v recvBytes=%v status=%v retries=%v error=%v", system(r.Url), r.Method, r.Url, r.Params, r.Time, r.SendBytes, r.RecvBytes, r.StatusCode, r.Retries, r.Error)
 	return s
 }
 
-// UrlRequest structure holds details about url request's attributes
-type UrlRequest struct {
-	rurl   string
-	args   string
-	out    chan<- ResponseType
-	ts     int64
-	client *http.Client
-}
-
-// A UrlFetchQueue implements heap.Interface and holds UrlRequests
-type UrlFetchQueue []*UrlRequest
-
-// Len provides len implemenation for UrlFetchQueue
-func (q UrlFetchQueue) Len() int { return len(q) }
-
-// Less provides Less implemenation for UrlFetchQueue
-func (q UrlFetchQueue) Less(i, j int) bool { return q[i].ts < q[j].ts }
-
-// Swap provides swap implemenation for UrlFetchQueue
-func (q UrlFetchQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
-
-// Push provides push implemenation for UrlFetchQueue
-func (q *UrlFetchQueue) Push(x interface{}) {
-	item := x.(*UrlRequest)
-	*q = append(*q, item)
-}
-
-// Pop provides Pop implemenation for UrlFetchQueue
-func (q *UrlFetchQueue) Pop() interface{} {
-	old := *q
-	n := len(old)
-	item := old[n-1]
-	*q = old[0 : n-1]
-	return item
-}
-
 var (
 	// UrlQueueSize keeps track of running URL requests
 	UrlQueueSize int32
@@ -265,57 +172,172 @@ var (
 	UrlQueueLimit int32
 	// UrlRetry knows  how many times we'll retry given url call
 	UrlRetry int
-	// UrlRequestChannel is a UrlRequest channel
-	UrlRequestChannel = make(chan UrlRequest)
 )
 
-func Init() {
-	if WEBSERVER > 0 {
-		log.Println("DAS URLFetchWorker")
+// ReadBody reads body of streamed response into its data and closes it
+func (r *ResponseType) ReadBody() {
+	if r.Body == nil {
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	r.Body = nil
+	r.Data = data
+	r.RecvBytes = len(data)
+	if err != nil && r.Error == nil {
+		r.Error = err
+	}
+}
+
+// ResponseBody represents unread body of streamed upstream response. Its size
+// is limited by MaxResponseSize and the slot of the service is held until the
+// body is closed.
+type ResponseBody struct {
+	reader     io.Reader
+	closers    []io.Closer
+	statusCode int
+	size       int64
+	err        error
+	done       func(error)
+	once       sync.Once
+}
+
+// helper function to create body of streamed response, gzipped content is decoded
+func newResponseBody(resp *http.Response) (*ResponseBody, error) {
+	body := &ResponseBody{reader: resp.Body, closers: []io.Closer{resp.Body}, statusCode: resp.StatusCode}
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		body.reader = gz
+		body.closers = append([]io.Closer{gz}, body.closers...)
+	}
+	if MaxResponseSize > 0 {
+		body.reader = io.LimitReader(body.reader, MaxResponseSize+1)
 	}
-	go URLFetchWorker(UrlRequestChannel)
+	return body, nil
 }
 
-// URLFetchWorker has three channels: in channel for incoming requests
-// (in a form of URL strings), out channel for outgoing responses in a form of
-// ResponseType structure and quit channel
-func URLFetchWorker(in <-chan UrlRequest) {
-	urlRequests := &UrlFetchQueue{}
-	heap.Init(urlRequests)
-	//     log.Println("URLFetchWorker queue size", UrlQueueSize, "queue limit", UrlQueueLimit)
-	// loop forever to accept url requests
-	// a given request will be placed in internal Queue and we'll process it
-	// only in a limited queueSize. Every request is processed via fetch
-	// function which will decrement queueSize once it's done with request.
-	for {
-		select {
-		case request := <-in:
-			// put new request to urlRequests queue and increment queueSize
-			heap.Push(urlRequests, &request)
-			//             log.Println("URLFetchWorker push new request", request, "queue size", urlRequests.Len())
-		default:
-			time.Sleep(time.Duration(10) * time.Millisecond)
-			if urlRequests.Len() > 0 && UrlQueueSize < UrlQueueLimit {
-				r := heap.Pop(urlRequests)
-				request := r.(*UrlRequest)
-				//                 log.Println("URLFetchWorker process request", request, "queue size", urlRequests.Len(), "current", UrlQueueSize)
-				go fetch(request.client, request.rurl, request.args, request.out)
+// Read reads body of the response, it fails once body exceeds MaxResponseSize
+func (b *ResponseBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.reader.Read(p)
+	b.size += int64(n)
+	if excess := b.size - MaxResponseSize; MaxResponseSize > 0 && excess > 0 {
+		n -= int(excess)
+		b.size = MaxResponseSize
+		err = &FetchError{Kind: FetchTooLarge, StatusCode: b.statusCode, Err: fmt.Errorf("response exceeds max size of %d bytes", MaxResponseSize)}
+	} else if err != nil && err != io.EOF {
+		err = &FetchError{Kind: FetchTransport, StatusCode: b.statusCode, Err: err}
+	}
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// Err returns error which occurred while reading the body
+func (b *ResponseBody) Err() error {
+	return b.err
+}
+
+// Close closes the body and releases the slot of the service
+func (b *ResponseBody) Close() error {
+	var err error
+	b.once.Do(func() {
+		for _, c := range b.closers {
+			if e := c.Close(); e != nil && err == nil {
+				err = e
 			}
 		}
+		if b.done != nil {
+			b.done(b.err)
+		}
+	})
+	return err
+}
+
+// Init creates and starts scheduler of upstream calls if UrlQueueLimit is set
+func Init() {
+	if UrlQueueLimit <= 0 {
+		return
 	}
+	if WEBSERVER > 0 {
+		log.Println("DAS fetch scheduler, limit", UrlQueueLimit)
+	}
+	Scheduler = NewFetchScheduler(int(UrlQueueLimit))
+	go Scheduler.Run()
 }
 
 // Problem with too many open files
 // http://craigwickesser.com/2015/01/golang-http-to-many-open-files/
 
 // FetchResponse fetches data for provided URL, args is a json dump of arguments
+// The call is limited by concurrency limit and circuit breaker of the service
+// and its responses are kept in cache of upstream responses, see ResponseCache.
+// In replay mode responses are served from fixtures, see FixtureMode
 func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
+	return fetchCall(httpClient, rurl, args, false, false)
+}
+
+// helper function to make upstream call, see FetchResponse, the slot of the
+// service is either acquired here or it is already acquired by the scheduler.
+// If stream is set the body of successful response which is neither cached
+// nor recorded is left unread, see FetchStream.
+func fetchCall(httpClient *http.Client, rurl, args string, acquired, stream bool) ResponseType {
+	srv := system(rurl)
+	method := "GET"
+	if len(args) > 0 {
+		method = "POST"
+	}
+	// calls which do not reach upstream service do not need its slot
+	if FixtureMode == FixtureReplay {
+		if acquired {
+			getServiceState(srv).release()
+		}
+		return replayFixture(method, rurl, args)
+	}
+	key := cacheKey(method, rurl, args)
+	entry := Cache.get(key)
+	if entry != nil && entry.fresh() {
+		if acquired {
+			getServiceState(srv).release()
+		}
+		return ResponseType{Url: rurl, Data: entry.data, Header: entry.header, Params: args, Method: method, StatusCode: http.StatusOK, RecvBytes: len(entry.data), Cached: true}
+	}
+	done, err := startCall(srv, acquired)
+	if err != nil {
+		return ResponseType{Url: rurl, Error: err}
+	}
+	response := fetchResponse(httpClient, rurl, args, conditionalHeader(entry), stream && FixtureMode != FixtureRecord)
+	if response.Body != nil {
+		// the call is done once the body is read and closed
+		response.Body.done = done
+		return response
+	}
+	Cache.update(key, srv, entry, &response)
+	done(response.Error)
+	if FixtureMode == FixtureRecord {
+		if err := recordFixture(method, rurl, args, response); err != nil {
+			log.Printf("ERROR: unable to record fixture of %s %s, error %v\n", method, rurl, err)
+		}
+	}
+	return response
+}
+
+// helper function to fetch data for provided URL, given header is added to the request.
+// If stream is set the body of successful response which is not kept in the
+// cache is left unread, see ResponseBody.
+func fetchResponse(httpClient *http.Client, rurl, args string, header http.Header, stream bool) ResponseType {
 	startTime := time.Now()
 	// increment UrlQueueSize since we'll process request
 	atomic.AddInt32(&UrlQueueSize, 1)
 	defer atomic.AddInt32(&UrlQueueSize, -1) // decrement UrlQueueSize since we done with this request
 	if VERBOSE > 1 {
-		log.Printf("http request, UrlQueueSize %v, UrlQueueLimit %v\n", UrlQueueSize, UrlQueueLimit)
+		log.Printf("http request, UrlQueueSize %v, UrlQueueLimit %v\n", atomic.LoadInt32(&UrlQueueSize), UrlQueueLimit)
 	}
 	var response ResponseType
 	if strings.Contains(rurl, "#") {
@@ -362,20 +384,33 @@ func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
 	if strings.Contains(rurl, "dbs") {
 		req.Header.Add("Accept-Encoding", "gzip")
 	}
+	var secrets []string // values of auth headers which are hidden in request dump
 	if Token != "" {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", readToken(Token)))
+		bearer := Credentials.BearerToken()
+		secrets = append(secrets, bearer)
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", bearer))
 	}
 	if strings.Contains(rurl, "rucio") { // we need to fetch auth token
 		token, err := RucioAuth.Token()
-		if err == nil {
-			req.Header.Add("X-Rucio-Auth-Token", token)
+		if err != nil {
+			// Rucio rejects unauthenticated requests, there is no reason to send it
+			response.Error = &FetchError{Kind: FetchAuth, Err: fmt.Errorf("unable to get rucio token, %w", err)}
+			response.Time = time.Now().Sub(startTime)
+			return response
 		}
+		secrets = append(secrets, token)
+		req.Header.Add("X-Rucio-Auth-Token", token)
 		req.Header.Add("Accept", "application/x-json-stream")
 		req.Header.Add("Connection", "Keep-Alive")
 		if WEBSERVER > 0 {
 			req.Header.Add("X-Rucio-Account", RucioAuth.Account())
 		}
 	}
+	for k, vals := range header {
+		for _, v := range vals {
+			req.Header.Add(k, v)
+		}
+	}
 	if CLIENT_VERSION != "" {
 		req.Header.Set("User-Agent", fmt.Sprintf("dasgoclient/%s", CLIENT_VERSION))
 	} else {
@@ -383,7 +418,7 @@ func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
 	}
 	if VERBOSE > 2 {
 		dump, err := httputil.DumpRequestOut(req, true)
-		log.Printf("http request %+v, rurl %v, dump %v, error %v\n", req, rurl, string(dump), err)
+		log.Printf("http request rurl %v, dump %v, error %v\n", rurl, redact(dump, secrets...), err)
 	}
 	if httpClient == nil {
 		httpClient = HttpClient()
@@ -392,16 +427,26 @@ func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
 	//     client := HttpClient()
 	resp, err := client.Do(req)
 	if err != nil {
-		response.Error = err
+		response.Error = &FetchError{Kind: FetchTransport, Err: err}
+		response.Time = time.Now().Sub(startTime)
 		return response
 	}
-	defer resp.Body.Close()
+	response.StatusCode = resp.StatusCode
+	response.Header = resp.Header
 	if VERBOSE > 2 {
 		if resp != nil {
 			dump, err := httputil.DumpResponse(resp, true)
 			log.Printf("http response rurl %v, dump %v, error %v\n", rurl, string(dump), err)
 		}
 	}
+	if stream && resp.StatusCode == http.StatusOK && !Cache.storable(system(response.Url), resp.Header) && (MaxResponseSize <= 0 || resp.ContentLength <= MaxResponseSize) {
+		if body, err := newResponseBody(resp); err == nil {
+			response.Body = body
+			response.Time = time.Now().Sub(startTime)
+			return response
+		}
+	}
+	defer resp.Body.Close()
 	// check if we got gzipped content
 	if resp.Header.Get("Content-Encoding") == "gzip" {
 		var gz *gzip.Reader
@@ -410,18 +455,24 @@ func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
 			response.Data = []byte("Unable to read gzipped content")
 		} else {
 			defer gz.Close()
-			response.Data, err = ioutil.ReadAll(gz)
+			response.Data, err = readBody(gz, resp.ContentLength)
 		}
 	} else {
-		response.Data, err = ioutil.ReadAll(resp.Body)
+		response.Data, err = readBody(resp.Body, resp.ContentLength)
 	}
 
-	//     response.Data, err = ioutil.ReadAll(resp.Body)
-	response.Time = time.Now().Sub(startTime)
 	response.RecvBytes = len(response.Data)
-	if err != nil {
-		response.Error = err
+	var e *FetchError
+	if errors.As(err, &e) {
+		e.StatusCode = resp.StatusCode
+		response.Error = e
+	} else if err != nil {
+		response.Error = &FetchError{Kind: FetchTransport, StatusCode: resp.StatusCode, Err: err}
+	} else if e := HTTPError(resp.StatusCode, resp.Header, response.Data); e != nil {
+		// non-2xx response body is an error page rather than data
+		response.Error = e
 	}
+	response.Time = time.Now().Sub(startTime)
 	if VERBOSE > 0 {
 		if args == "" {
 			if WEBSERVER == 0 {
@@ -450,6 +501,26 @@ func FetchResponse(httpClient *http.Client, rurl, args string) ResponseType {
 	return response
 }
 
+// MaxResponseSize defines max size of upstream response in bytes, 0 means no limit
+var MaxResponseSize int64
+
+// helper function to read response body up to MaxResponseSize bytes, the
+// size is checked against Content-Length header (if known) before reading
+func readBody(r io.Reader, size int64) ([]byte, error) {
+	if MaxResponseSize <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	tooLarge := &FetchError{Kind: FetchTooLarge, Err: fmt.Errorf("response exceeds max size of %d bytes", MaxResponseSize)}
+	if size > MaxResponseSize {
+		return nil, tooLarge
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, MaxResponseSize+1))
+	if err == nil && int64(len(data)) > MaxResponseSize {
+		return nil, tooLarge
+	}
+	return data, err
+}
+
 // helper function to extract cmsweb system
 func system(rurl string) string {
 	if strings.Contains(rurl, "dbs") {
@@ -468,27 +539,53 @@ func system(rurl string) string {
 		return "runregistry"
 	} else if strings.Contains(rurl, "dashboard") {
 		return "dashboard"
+	} else if strings.Contains(rurl, "cric") {
+		return "cric"
 	}
 	return "combined"
 }
 
 // Fetch data for provided URL and redirect results to given channel
-// This wrapper function look-up UrlQueueLimit and either redirect to
-// URULFetchWorker go-routine or pass the call to local fetch function
+// The call is made as interactive call of its own group, see FetchQuery
 func Fetch(httpClient *http.Client, rurl string, args string, out chan<- ResponseType) {
-	if UrlQueueLimit > 0 {
-		request := UrlRequest{rurl: rurl, args: args, out: out, ts: time.Now().Unix(), client: httpClient}
-		UrlRequestChannel <- request
+	FetchQuery(httpClient, rurl, args, out, rurl, FetchInteractive)
+}
+
+// FetchQuery fetches data for provided URL on behalf of given group (e.g.
+// hash of DAS query) with given priority and redirects results to given
+// channel. If Scheduler is running the call is submitted to it, otherwise
+// it is made right away.
+func FetchQuery(httpClient *http.Client, rurl, args string, out chan<- ResponseType, group string, priority FetchPriority) {
+	fetchQuery(httpClient, rurl, args, out, group, priority, false)
+}
+
+// FetchStream works as FetchQuery but body of successful response which is
+// not kept in the cache of upstream responses is not read in advance. Such
+// response has Body which should be read and must be closed by the receiver.
+func FetchStream(httpClient *http.Client, rurl, args string, out chan<- ResponseType, group string, priority FetchPriority) {
+	fetchQuery(httpClient, rurl, args, out, group, priority, true)
+}
+
+// helper function to fetch data for provided URL, see FetchQuery and FetchStream
+func fetchQuery(httpClient *http.Client, rurl, args string, out chan<- ResponseType, group string, priority FetchPriority, stream bool) {
+	if Scheduler != nil {
+		Scheduler.Submit(UrlRequest{rurl: rurl, args: args, out: out, client: httpClient, group: group, priority: priority, stream: stream})
 	} else {
-		fetch(httpClient, rurl, args, out)
+		fetch(httpClient, rurl, args, out, stream)
 	}
 }
 
+// MaxRetryAfter defines max delay requested by upstream via Retry-After header
+// we're willing to wait before retrying the call
+var MaxRetryAfter = 30 * time.Second
+
 // local function which fetch response for given url/args and place it into response channel
-// By defat
-func fetch(httpClient *http.Client, rurl string, args string, ch chan<- ResponseType) {
+// The failed call is retried according to retry policy of the service, see RetryPolicy.
+// The slot of the service is released while we wait before the retry, calls
+// dispatched by the scheduler are retried by the scheduler, see FetchScheduler
+func fetch(httpClient *http.Client, rurl string, args string, ch chan<- ResponseType, stream bool) {
 	var resp ResponseType
-	resp = FetchResponse(httpClient, rurl, args)
+	resp = fetchCall(httpClient, rurl, args, false, stream)
 	if resp.Error == nil {
 		ch <- resp
 		return
@@ -500,25 +597,35 @@ func fetch(httpClient *http.Client, rurl string, args string, ch chan<- Response
 			fmt.Printf("fail to fetch data %s, error %v\n", rurl, resp.Error)
 		}
 	}
-	for i := 1; i <= UrlRetry; i++ {
-		sleep := time.Duration(i) * time.Second
+	policy := GetRetryPolicy(system(rurl))
+	for i := 1; ; i++ {
+		sleep, ok := retryDelay(policy, resp.Error, i)
+		if !ok {
+			break
+		}
 		time.Sleep(sleep)
-		resp = FetchResponse(httpClient, rurl, args)
+		resp = fetchCall(httpClient, rurl, args, false, stream)
+		resp.Retries = i
 		if resp.Error == nil {
 			ch <- resp
 			return
 		}
 	}
+	fetchFailed(resp)
+	ch <- resp
+}
+
+// helper function to report failed call once all its retries are exhausted
+func fetchFailed(resp ResponseType) {
 	if resp.Error != nil {
 		if VERBOSE > 0 {
 			if WEBSERVER == 1 {
-				log.Printf("ERROR: fail to fetch %s, retries %v, error %v\n", rurl, UrlRetry, resp.Error)
+				log.Printf("ERROR: fail to fetch %s, retries %v, error %v\n", resp.Url, resp.Retries, resp.Error)
 			} else {
-				fmt.Printf("ERROR: fail to fetch %s, retries %v, error %v\n", rurl, UrlRetry, resp.Error)
+				fmt.Printf("ERROR: fail to fetch %s, retries %v, error %v\n", resp.Url, resp.Retries, resp.Error)
 			}
 		}
 	}
-	ch <- resp
 }
 
 // Helper function which validates given URL
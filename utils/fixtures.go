@@ -0,0 +1,125 @@
+package utils
+
+// DAS utils module, record and replay of upstream calls
+// In record mode every upstream call (including POST body) and its response
+// is stored as JSON fixture in FixtureDir. In replay mode FetchResponse serves
+// responses from these fixtures without any network access, which allows to
+// reproduce DAS results once upstream data has changed.
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+	"unicode/utf8"
+)
+
+// FixtureRecord and FixtureReplay represent modes of fixtures of upstream calls
+const (
+	FixtureRecord = "record"
+	FixtureReplay = "replay"
+)
+
+// FixtureMode defines fixture mode of upstream calls: record, replay or empty (no fixtures)
+var FixtureMode string
+
+// FixtureDir defines location of fixtures of upstream calls
+var FixtureDir = "fixtures"
+
+// sensitive response headers which are not stored in fixtures
+var fixtureSkipHeaders = []string{"Set-Cookie", "X-Rucio-Auth-Token"}
+
+// Fixture represents recorded upstream call and its response
+type Fixture struct {
+	Method     string      `json:"method"`
+	Url        string      `json:"url"`
+	Args       string      `json:"args,omitempty"` // POST body
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body"`
+	Encoding   string      `json:"encoding,omitempty"` // base64 for binary body
+	Error      string      `json:"error,omitempty"`    // transport error
+	ErrorKind  string      `json:"error_kind,omitempty"`
+	Time       float64     `json:"time"` // duration of the call in seconds
+	Timestamp  int64       `json:"ts"`
+}
+
+// FixtureFile returns name of fixture file of given upstream call
+func FixtureFile(method, rurl, args string) string {
+	arr := md5.Sum([]byte(cacheKey(method, rurl, args)))
+	return filepath.Join(FixtureDir, hex.EncodeToString(arr[:])+".json")
+}
+
+// helper function to store fixture of given upstream call and its response
+func recordFixture(method, rurl, args string, response ResponseType) error {
+	fixture := Fixture{Method: method, Url: rurl, Args: args, StatusCode: response.StatusCode, Time: response.Time.Seconds(), Timestamp: time.Now().Unix()}
+	if len(response.Header) > 0 {
+		fixture.Header = response.Header.Clone()
+		for _, key := range fixtureSkipHeaders {
+			fixture.Header.Del(key)
+		}
+	}
+	if utf8.Valid(response.Data) {
+		fixture.Body = string(response.Data)
+	} else {
+		fixture.Body = base64.StdEncoding.EncodeToString(response.Data)
+		fixture.Encoding = "base64"
+	}
+	var e *FetchError
+	if errors.As(response.Error, &e) && e.StatusCode == 0 {
+		// transport error, HTTP errors are recovered from status code and body
+		fixture.Error = e.Error()
+		fixture.ErrorKind = e.Kind.String()
+	}
+	data, err := json.MarshalIndent(fixture, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(FixtureDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(FixtureFile(method, rurl, args), data, 0644)
+}
+
+// helper function to load response of given upstream call from its fixture
+func replayFixture(method, rurl, args string) ResponseType {
+	response := ResponseType{Url: rurl, Method: method, Params: args}
+	data, err := os.ReadFile(FixtureFile(method, rurl, args))
+	if err != nil {
+		response.Error = &FetchError{Kind: FetchUnavailable, Err: fmt.Errorf("no fixture of %s %s", method, rurl)}
+		return response
+	}
+	var fixture Fixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		response.Error = &FetchError{Kind: FetchUnavailable, Err: fmt.Errorf("invalid fixture of %s %s, %v", method, rurl, err)}
+		return response
+	}
+	response.Data = []byte(fixture.Body)
+	if fixture.Encoding == "base64" {
+		if response.Data, err = base64.StdEncoding.DecodeString(fixture.Body); err != nil {
+			response.Error = &FetchError{Kind: FetchUnavailable, Err: fmt.Errorf("invalid fixture body of %s %s, %v", method, rurl, err)}
+			return response
+		}
+	}
+	response.StatusCode = fixture.StatusCode
+	response.Header = fixture.Header
+	response.RecvBytes = len(response.Data)
+	response.SendBytes = len(args)
+	response.Time = time.Duration(fixture.Time * float64(time.Second))
+	if fixture.Error != "" {
+		response.Error = &FetchError{Kind: FetchTransport, Err: errors.New(fixture.Error)}
+	} else if e := HTTPError(fixture.StatusCode, fixture.Header, response.Data); e != nil {
+		response.Error = e
+	}
+	if VERBOSE > 0 {
+		log.Printf("DAS replay %s url=\"%s\" fixture=%s\n", method, rurl, FixtureFile(method, rurl, args))
+	}
+	return response
+}
@@ -0,0 +1,224 @@
+package utils
+
+// DAS utils module, cache of upstream responses
+// Different DAS queries often issue identical upstream calls, e.g. DBS blocks
+// of a dataset or CRIC dumps. Successful responses are kept in LRU cache with
+// limited size and served while they are fresh according to Cache-Control
+// (or Expires) headers or per-service TTL. Stale responses with ETag or
+// Last-Modified headers are revalidated with conditional requests.
+
+import (
+	"container/list"
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCacheTTL keeps TTL (in seconds) of cached responses of services, the
+// key is service (system) name or default, it overrides Cache-Control headers
+var ResponseCacheTTL map[string]int
+
+// cacheEntry represents cached upstream response
+type cacheEntry struct {
+	key          string
+	data         []byte
+	header       http.Header
+	etag         string
+	lastModified string
+	expire       time.Time
+	size         int64
+}
+
+// helper function to check if entry can be served without revalidation
+func (e *cacheEntry) fresh() bool {
+	return time.Now().Before(e.expire)
+}
+
+// ResponseCache implements LRU cache of upstream responses with limited size
+type ResponseCache struct {
+	sync.Mutex
+	MaxSize int64 // max size of cached responses in bytes, 0 disables the cache
+	size    int64
+	hits    uint64
+	misses  uint64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// Cache represents global cache of upstream responses
+var Cache = &ResponseCache{}
+
+// helper function to create cache key of given method, url and request body
+func cacheKey(method, rurl, args string) string {
+	if args == "" {
+		return method + " " + rurl
+	}
+	arr := md5.Sum([]byte(args))
+	return method + " " + rurl + " " + hex.EncodeToString(arr[:])
+}
+
+// helper function to look-up cache entry, it is marked as recently used
+func (c *ResponseCache) get(key string) *cacheEntry {
+	c.Lock()
+	defer c.Unlock()
+	if c.MaxSize <= 0 || c.entries == nil {
+		return nil
+	}
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*cacheEntry)
+	if entry.fresh() {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return entry
+}
+
+// helper function to add entry to the cache, least recently used entries are
+// evicted to keep size of the cache within its limit (which may be changed)
+func (c *ResponseCache) put(entry *cacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+		c.lru = list.New()
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	if entry.size <= c.MaxSize {
+		c.entries[entry.key] = c.lru.PushFront(entry)
+		c.size += entry.size
+	}
+	for c.size > c.MaxSize && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// helper function to remove entry from the cache, the cache must be locked
+func (c *ResponseCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// ResponseCacheStats represents statistics of the cache of upstream responses
+type ResponseCacheStats struct {
+	Entries int    `json:"entries"`
+	Size    int64  `json:"size"`
+	MaxSize int64  `json:"maxSize"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// Stats returns statistics of the cache
+func (c *ResponseCache) Stats() ResponseCacheStats {
+	c.Lock()
+	defer c.Unlock()
+	return ResponseCacheStats{Entries: len(c.entries), Size: c.size, MaxSize: c.MaxSize, Hits: c.hits, Misses: c.misses}
+}
+
+// helper function to get freshness lifetime of response of given service, it
+// is given by service TTL or by Cache-Control max-age and Expires headers.
+// The no-store and no-cache directives take precedence over service TTL.
+// It returns false if response should not be cached.
+func freshness(srv string, header http.Header) (time.Duration, bool) {
+	var maxAge, sMaxAge = -1, -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store":
+			return 0, false
+		case directive == "no-cache":
+			// response should be revalidated every time it is used
+			return 0, true
+		case strings.HasPrefix(directive, "max-age="):
+			if v, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				maxAge = v
+			}
+		case strings.HasPrefix(directive, "s-maxage="):
+			if v, err := strconv.Atoi(strings.TrimPrefix(directive, "s-maxage=")); err == nil {
+				sMaxAge = v
+			}
+		}
+	}
+	ttl, ok := ResponseCacheTTL[srv]
+	if !ok {
+		ttl = ResponseCacheTTL["default"]
+	}
+	switch {
+	case ttl > 0:
+		return time.Duration(ttl) * time.Second, true
+	case sMaxAge >= 0:
+		return time.Duration(sMaxAge) * time.Second, true
+	case maxAge >= 0:
+		return time.Duration(maxAge) * time.Second, true
+	}
+	if t, err := http.ParseTime(header.Get("Expires")); err == nil {
+		return time.Until(t), true
+	}
+	return 0, true
+}
+
+// helper function to add conditional headers of stale cache entry to request headers
+func conditionalHeader(entry *cacheEntry) http.Header {
+	header := make(http.Header)
+	if entry == nil {
+		return header
+	}
+	if entry.etag != "" {
+		header.Set("If-None-Match", entry.etag)
+	}
+	if entry.lastModified != "" {
+		header.Set("If-Modified-Since", entry.lastModified)
+	}
+	return header
+}
+
+// helper function to update cache with response of given call. Stale entry
+// which is confirmed by upstream (304 response) is used as response data.
+func (c *ResponseCache) update(key, srv string, entry *cacheEntry, response *ResponseType) {
+	if response.StatusCode == http.StatusNotModified && entry != nil {
+		// caching headers of 304 response update headers of cached response
+		header := entry.header.Clone()
+		for _, key := range []string{"Cache-Control", "Expires", "ETag", "Last-Modified"} {
+			if vals := response.Header.Values(key); len(vals) > 0 {
+				header[key] = vals
+			}
+		}
+		response.Data = entry.data
+		response.Header = header
+		response.StatusCode = http.StatusOK
+		response.Error = nil
+	}
+	if response.Error != nil || response.StatusCode != http.StatusOK || !c.storable(srv, response.Header) {
+		return
+	}
+	ttl, _ := freshness(srv, response.Header)
+	etag := response.Header.Get("ETag")
+	lastModified := response.Header.Get("Last-Modified")
+	size := int64(len(key) + len(response.Data))
+	c.put(&cacheEntry{key: key, data: response.Data, header: response.Header, etag: etag, lastModified: lastModified, expire: time.Now().Add(ttl), size: size})
+}
+
+// helper function to check if successful response of given service with given
+// headers is kept in the cache, i.e. it is fresh for a while or can be revalidated
+func (c *ResponseCache) storable(srv string, header http.Header) bool {
+	c.Lock()
+	maxSize := c.MaxSize
+	c.Unlock()
+	if maxSize <= 0 {
+		return false
+	}
+	ttl, ok := freshness(srv, header)
+	return ok && (ttl > 0 || header.Get("ETag") != "" || header.Get("Last-Modified") != "")
+}
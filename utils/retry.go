@@ -0,0 +1,198 @@
+package utils
+
+// DAS utils module, retry policies of upstream calls
+// Failed calls are retried with exponential backoff and jitter according to
+// retry policy of the service. All retries are also limited by global retry
+// budget (token bucket) such that struggling upstream service is not hit by
+// retry storm from our fan-out queries.
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetryPolicy defines how failed calls of upstream service are retried
+type RetryPolicy struct {
+	MaxAttempts int      `json:"maxAttempts"` // max number of retries
+	BaseDelay   int      `json:"baseDelay"`   // delay before first retry in milliseconds, it is doubled with every retry
+	MaxDelay    int      `json:"maxDelay"`    // max delay between retries in milliseconds
+	Jitter      float64  `json:"jitter"`      // fraction of delay which is randomized, from 0 to 1
+	StatusCodes []int    `json:"statusCodes"` // retryable HTTP status codes
+	ErrorKinds  []string `json:"errorKinds"`  // retryable error kinds, see FetchErrorKind, if not set FetchError.Retryable is used
+
+	set map[string]bool // attributes set in configuration, e.g. maxattempts
+}
+
+// UnmarshalJSON decodes retry policy and keeps track of attributes which are
+// set explicitly, such that zero values (e.g. maxAttempts 0) override defaults
+func (p *RetryPolicy) UnmarshalJSON(data []byte) error {
+	type policy RetryPolicy
+	var v policy
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	var attrs map[string]json.RawMessage
+	if err := json.Unmarshal(data, &attrs); err != nil {
+		return err
+	}
+	*p = RetryPolicy(v)
+	p.set = make(map[string]bool)
+	for key := range attrs {
+		// JSON keys are matched case-insensitively to struct fields
+		p.set[strings.ToLower(key)] = true
+	}
+	return nil
+}
+
+// helper function to check if attribute of the policy is set, policies which
+// are not decoded from JSON have only their non-zero attributes set
+func (p RetryPolicy) isSet(attr string, nonZero bool) bool {
+	if p.set == nil {
+		return nonZero
+	}
+	return p.set[strings.ToLower(attr)]
+}
+
+// DefaultRetryPolicy returns retry policy used by services without their own policy
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: UrlRetry,
+		BaseDelay:   1000,
+		MaxDelay:    30000,
+		Jitter:      0.5,
+	}
+}
+
+// RetryPolicies keeps retry policies of services, the key is service (system)
+// name, e.g. dbs or rucio, and default key defines policy of all other services
+var RetryPolicies map[string]RetryPolicy
+
+// GetRetryPolicy returns retry policy of given service (system), the unset
+// attributes of the policy are taken from default policy, see UnmarshalJSON
+func GetRetryPolicy(system string) RetryPolicy {
+	policy := DefaultRetryPolicy()
+	for _, key := range []string{"default", system} {
+		p, ok := RetryPolicies[key]
+		if !ok {
+			continue
+		}
+		if p.isSet("maxAttempts", p.MaxAttempts != 0) {
+			policy.MaxAttempts = p.MaxAttempts
+		}
+		if p.isSet("baseDelay", p.BaseDelay != 0) {
+			policy.BaseDelay = p.BaseDelay
+		}
+		if p.isSet("maxDelay", p.MaxDelay != 0) {
+			policy.MaxDelay = p.MaxDelay
+		}
+		if p.isSet("jitter", p.Jitter != 0) {
+			policy.Jitter = p.Jitter
+		}
+		if p.isSet("statusCodes", len(p.StatusCodes) > 0) {
+			policy.StatusCodes = p.StatusCodes
+		}
+		if p.isSet("errorKinds", len(p.ErrorKinds) > 0) {
+			policy.ErrorKinds = p.ErrorKinds
+		}
+	}
+	return policy
+}
+
+// Retryable checks if call which failed with given error should be retried
+func (p RetryPolicy) Retryable(err error) bool {
+	var e *FetchError
+	if !errors.As(err, &e) {
+		return false
+	}
+	for _, code := range p.StatusCodes {
+		if e.StatusCode == code {
+			return true
+		}
+	}
+	if p.ErrorKinds == nil {
+		return e.Retryable()
+	}
+	return InList(e.Kind.String(), p.ErrorKinds)
+}
+
+// Delay returns delay before given retry attempt (starting from 1), it is
+// exponential backoff capped by max delay where jitter part is randomized
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	jitter := math.Min(math.Max(p.Jitter, 0), 1)
+	delay = delay * (1 - jitter*rand.Float64())
+	return time.Duration(delay) * time.Millisecond
+}
+
+// RetryBudget implements token bucket which limits total number of retries
+// of all upstream calls, it is refilled with given rate up to given burst
+type RetryBudget struct {
+	sync.Mutex
+	Rate   float64 // number of retries per second, zero or negative value means no limit
+	Burst  float64 // max number of retries at once
+	tokens float64
+	last   time.Time
+}
+
+// Take takes a token from the budget, it returns false if budget is exhausted
+func (b *RetryBudget) Take() bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.Rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = b.Burst
+	} else {
+		b.tokens = math.Min(b.Burst, b.tokens+now.Sub(b.last).Seconds()*b.Rate)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Budget represents global retry budget of upstream calls, by default it allows
+// 5 retries per second with bursts up to 10 retries
+var Budget = &RetryBudget{Rate: 5, Burst: 10}
+
+// helper function to get delay before next retry of upstream call which failed
+// with given error, it returns false if call should not be retried
+func retryDelay(policy RetryPolicy, err error, attempt int) (time.Duration, bool) {
+	// replayed responses do not change, therefore there is no point to retry
+	if FixtureMode == FixtureReplay {
+		return 0, false
+	}
+	if attempt > policy.MaxAttempts || !policy.Retryable(err) {
+		return 0, false
+	}
+	delay := policy.Delay(attempt)
+	var e *FetchError
+	if errors.As(err, &e) {
+		if e.RetryAfter > MaxRetryAfter {
+			return 0, false
+		}
+		if e.RetryAfter > delay {
+			delay = e.RetryAfter
+		}
+	}
+	if !Budget.Take() {
+		if VERBOSE > 0 {
+			log.Println("retry budget is exhausted")
+		}
+		return 0, false
+	}
+	return delay, true
+}
@@ -5,71 +5,78 @@ package utils
 // Copyright (c) 2018 - Valentin Kuznetsov <vkuznet AT gmail dot com>
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
-// RucioValidity
-var RucioValidity int64
+// RucioValidity defines validity of Rucio token in seconds if auth server does not provide it
+var RucioValidity int64 = 300
 
-// RucioTokenCurl
-var RucioTokenCurl bool
+// RucioAuthX509 and others represent Rucio authentication methods
+const (
+	RucioAuthX509      = "x509"       // X509 user certificate or proxy
+	RucioAuthX509Proxy = "x509_proxy" // X509 proxy via dedicated Rucio endpoint
+	RucioAuthUserpass  = "userpass"   // Rucio username and password
+	RucioAuthOIDC      = "oidc"       // OIDC (JWT) token issued by identity provider
+)
+
+// RucioAuthMethods lists supported Rucio authentication methods
+var RucioAuthMethods = []string{RucioAuthX509, RucioAuthX509Proxy, RucioAuthUserpass, RucioAuthOIDC}
+
+// RucioAuthMethod defines Rucio authentication method, x509 if not set
+var RucioAuthMethod string
+
+// RucioUsername defines Rucio username of userpass authentication
+var RucioUsername string
+
+// RucioPassword defines Rucio password (or file with it) of userpass authentication
+var RucioPassword string
+
+// RucioTokenFile defines OIDC token (or file with it) of oidc authentication, Token is used if not set
+var RucioTokenFile string
+
+// RucioAuthInsecure disables verification of Rucio auth server certificate, it should be used for testing only
+var RucioAuthInsecure bool
 
 // RucioAuth represents instance of rucio authentication module
 var RucioAuth RucioAuthModule
 
-// RucioAuthModule structure holds all information about Rucio authentication
+// RucioAuthModule structure holds all information about Rucio authentication,
+// Rucio tokens are kept by credential manager, see Credentials
 type RucioAuthModule struct {
+	sync.Mutex
 	account string
 	agent   string
-	token   string
 	url     string
-	ts      int64
 }
 
 // String provides string representation of RucioAuthModule
 func (r *RucioAuthModule) String() string {
-	s := fmt.Sprintf("<RucioAuth account=%s agent=%s url=%s token=%s expire=%v>", r.account, r.agent, r.url, r.token, r.ts)
+	s := fmt.Sprintf("<RucioAuth account=%s agent=%s url=%s>", r.Account(), r.Agent(), r.Url())
 	return s
 }
 
 // Token returns Rucio authentication token
 func (r *RucioAuthModule) Token() (string, error) {
-	t := time.Now().Unix()
-	if r.token != "" && t < r.ts {
-		if VERBOSE > 1 {
-			log.Println("use cached token", r.String(), "current time", t)
-		}
-		return r.token, nil
-	}
-	if VERBOSE > 1 {
-		log.Println("get new token", r.String())
-	}
-	var token string
-	var expire int64
-	var err error
-	if RucioTokenCurl {
-		token, expire, err = FetchRucioTokenViaCurl(r.Url())
-	} else {
-		token, expire, err = FetchRucioToken(r.Url())
-	}
-	if err != nil {
-		return "", err
-	}
-	r.ts = expire
-	r.token = token
-	return r.token, nil
+	return Credentials.RucioToken(r.Url())
 }
 
 // Account returns Rucio authentication account
 func (r *RucioAuthModule) Account() string {
+	r.Lock()
+	defer r.Unlock()
 	if r.account == "" {
 		r.account = "das"
 		v := GetEnv("RUCIO_ACCOUNT")
@@ -82,30 +89,190 @@ func (r *RucioAuthModule) Account() string {
 
 // Agent returns Rucio authentication agent
 func (r *RucioAuthModule) Agent() string {
+	r.Lock()
+	defer r.Unlock()
 	if r.agent == "" {
 		r.agent = "dasgoserver"
 	}
 	return r.agent
 }
 
-// Url returns Rucio authentication url
+// Url returns Rucio authentication url of RucioAuthMethod, the oidc tokens
+// are issued by identity provider and Rucio auth server only validates them
 func (r *RucioAuthModule) Url() string {
+	r.Lock()
+	defer r.Unlock()
+	switch method := rucioAuthMethod(); method {
+	case RucioAuthOIDC:
+		return r.authUrl() + "/auth/validate"
+	default:
+		return fmt.Sprintf("%s/auth/%s", r.authUrl(), method)
+	}
+}
+
+// helper function to get Rucio authentication server url, it should be called under lock
+func (r *RucioAuthModule) authUrl() string {
 	if r.url == "" {
 		v := GetEnv("RUCIO_AUTH_URL")
 		if v != "" {
-			r.url = fmt.Sprintf("%s/auth/x509", v)
+			r.url = strings.TrimSuffix(v, "/")
 		} else {
-			r.url = "https://cms-rucio-auth.cern.ch/auth/x509"
+			r.url = "https://cms-rucio-auth.cern.ch"
 		}
 	}
 	return r.url
 }
 
-// run go-routine to periodically obtain rucio token
-// FetchRucioToken request new Rucio token
+// helper function to get Rucio authentication method
+func rucioAuthMethod() string {
+	if RucioAuthMethod == "" {
+		return RucioAuthX509
+	}
+	return RucioAuthMethod
+}
+
+// helper function to either read content of a file or return given string
+func readSecret(v string) (string, error) {
+	if _, err := os.Stat(v); err != nil {
+		return v, nil
+	}
+	data, err := os.ReadFile(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// helper function to get OIDC token of oidc authentication
+func rucioOIDCToken() string {
+	if RucioTokenFile != "" {
+		return RucioTokenFile
+	}
+	return Token
+}
+
+// helper function to get files of Rucio credentials, i.e. OIDC token file,
+// which should be watched for changes
+func rucioTokenFiles() []string {
+	if rucioAuthMethod() != RucioAuthOIDC {
+		return nil
+	}
+	if _, err := os.Stat(rucioOIDCToken()); err != nil {
+		return nil
+	}
+	return []string{rucioOIDCToken()}
+}
+
+// CertDirCAs adds CA certificates of X509_CERT_DIR directory (if set) to
+// given pool, an empty pool is created if pool is nil
+func CertDirCAs(pool *x509.CertPool) (*x509.CertPool, error) {
+	if pool == nil {
+		pool = x509.NewCertPool()
+	}
+	dir := GetEnv("X509_CERT_DIR")
+	if dir == "" {
+		return pool, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read X509_CERT_DIR, %v", err)
+	}
+	for _, entry := range entries {
+		// the directory also contains CRLs, signing policies, etc. which are not PEM certificates
+		if data, err := os.ReadFile(filepath.Join(dir, entry.Name())); err == nil {
+			pool.AppendCertsFromPEM(data)
+		}
+	}
+	return pool, nil
+}
+
+// helper function to get pool of CA certificates which verify Rucio auth
+// server, i.e. system CAs and CAs of X509_CERT_DIR directory (if set)
+func rucioRootCAs() (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	return CertDirCAs(pool)
+}
+
+// helper function to get HTTP client of Rucio authentication, the X509 methods
+// always present X509 credentials (loaded via x509proxy for proxies such that
+// full chain is sent) regardless of bearer token. Certificate of Rucio auth
+// server is verified unless RucioAuthInsecure is set.
+func rucioAuthClient(method string) (*http.Client, error) {
+	timeout := time.Duration(TIMEOUT) * time.Second
+	roots, err := rucioRootCAs()
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{RootCAs: roots, InsecureSkipVerify: RucioAuthInsecure}
+	if method == RucioAuthX509 || method == RucioAuthX509Proxy {
+		certs, err := Credentials.Certs()
+		if err != nil {
+			return nil, err
+		}
+		if len(certs) == 0 {
+			return nil, errors.New("no X509 credentials, set X509_USER_PROXY or X509_USER_CERT and X509_USER_KEY")
+		}
+		conf.GetClientCertificate = Credentials.ClientCertificate
+	}
+	tr := &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: conf}
+	return &http.Client{Transport: tr, Timeout: timeout}, nil
+}
+
+// helper function to get message of Rucio exception from response headers
+// or body, e.g. {"ExceptionClass": "CannotAuthenticate", "ExceptionMessage": "..."}
+func rucioException(header http.Header, body []byte) string {
+	var rec struct {
+		ExceptionClass   string
+		ExceptionMessage string
+	}
+	if err := json.Unmarshal(body, &rec); err != nil || rec.ExceptionClass == "" {
+		rec.ExceptionClass = header.Get("ExceptionClass")
+		rec.ExceptionMessage = header.Get("ExceptionMessage")
+	}
+	if rec.ExceptionClass == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s: %s", rec.ExceptionClass, rec.ExceptionMessage)
+}
+
+// helper function to hide given secrets, e.g. Rucio tokens, in dump of HTTP message
+func redact(dump []byte, secrets ...string) string {
+	out := string(dump)
+	for _, secret := range secrets {
+		if secret != "" {
+			out = strings.Replace(out, secret, "***", -1)
+		}
+	}
+	return out
+}
+
+// ChangeUrl changes Rucio authentication url from old to new pattern
+func (r *RucioAuthModule) ChangeUrl(old, pat string) {
+	r.Lock()
+	defer r.Unlock()
+	r.url = strings.Replace(r.authUrl(), old, pat, -1)
+}
+
+// helper function to get expiration time of Rucio token from value of
+// X-Rucio-Auth-Token-Expires header, e.g. Tue, 24 Oct 2023 12:00:00 UTC
+func rucioTokenExpire(value string) int64 {
+	if ts, err := time.Parse(time.RFC1123, strings.TrimSpace(value)); err == nil {
+		return ts.Unix()
+	}
+	return time.Now().Add(time.Duration(RucioValidity) * time.Second).Unix()
+}
+
+// FetchRucioToken requests new Rucio token from given auth url using
+// RucioAuthMethod, for oidc method the token is read from RucioTokenFile
+// and validated by Rucio auth server
 func FetchRucioToken(rurl string) (string, int64, error) {
-	// I need to replace expire with time provided by Rucio auth server
-	expire := time.Now().Add(time.Minute * 5).Unix()
+	method := rucioAuthMethod()
+	if !InList(method, RucioAuthMethods) {
+		return "", 0, fmt.Errorf("unsupported rucio auth method %s, supported methods %v", method, RucioAuthMethods)
+	}
 	req, _ := http.NewRequest("GET", rurl, nil)
 	req.Header.Add("Accept-Encoding", "identity")
 	racc := GetEnv("RUCIO_ACCOUNT")
@@ -123,64 +290,67 @@ func FetchRucioToken(rurl string) (string, int64, error) {
 		req.Header.Add("User-Agent", "dasgoclient")
 	}
 	req.Header.Add("Connection", "keep-alive")
+	var secret, token string
+	switch method {
+	case RucioAuthUserpass:
+		password, err := readSecret(RucioPassword)
+		if err != nil || RucioUsername == "" || password == "" {
+			return "", 0, fmt.Errorf("rucio userpass auth requires username and password, error %v", err)
+		}
+		req.Header.Add("X-Rucio-Username", RucioUsername)
+		req.Header.Add("X-Rucio-Password", password)
+		secret = password
+	case RucioAuthOIDC:
+		var err error
+		token, err = readSecret(rucioOIDCToken())
+		if err != nil || token == "" {
+			return "", 0, fmt.Errorf("rucio oidc auth requires token, error %v", err)
+		}
+		req.Header.Add("X-Rucio-Auth-Token", token)
+		secret = token
+	}
 	if VERBOSE > 1 {
 		dump, err := httputil.DumpRequestOut(req, true)
-		log.Printf("http request %+v, rurl %v, dump %v, error %v\n", req, rurl, string(dump), err)
+		log.Printf("http request rurl %v, dump %v, error %v\n", rurl, redact(dump, secret), err)
+	}
+	client, err := rucioAuthClient(method)
+	if err != nil {
+		return "", 0, fmt.Errorf("rucio %s auth, %v", method, err)
 	}
-	client := HttpClient()
 	resp, err := client.Do(req)
 	if err != nil {
 		if VERBOSE > 0 {
 			log.Println("ERROR: unable to perform request", err)
 		}
-		return "", 0, err
+		return "", 0, fmt.Errorf("rucio %s auth at %s, %v", method, rurl, err)
 	}
 	defer resp.Body.Close()
 	if VERBOSE > 1 {
 		dump, err := httputil.DumpResponse(resp, true)
-		log.Printf("http response rurl %v, dump %v, error %v\n", rurl, string(dump), err)
+		log.Printf("http response rurl %v, dump %v, error %v\n", rurl, redact(dump, resp.Header.Get("X-Rucio-Auth-Token")), err)
 	}
-	_, err = io.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		if VERBOSE > 0 {
 			log.Println("ERROR: unable to read response body", err)
 		}
 		return "", 0, err
 	}
-	if v, ok := resp.Header["X-Rucio-Auth-Token"]; ok {
-		return v[0], expire, nil
-	}
-	return "", 0, err
-}
-
-// FetchRucioTokenViaCurl is a helper function to get Rucio token by using curl command
-func FetchRucioTokenViaCurl(rurl string) (string, int64, error) {
-	// I need to replace expire with time provided by Rucio auth server
-	expire := time.Now().Add(time.Minute * 5).Unix()
-	proxy := os.Getenv("X509_USER_PROXY")
-	account := GetEnv("RUCIO_ACCOUNT")
-	if account == "" {
-		account = fmt.Sprintf("X-Rucio-Account: %s", RucioAuth.Account())
-	}
-	agent := RucioAuth.Agent()
-	cmd := fmt.Sprintf("curl -q -I --key %s --cert %s -H \"%s\" -A %s %s", proxy, proxy, account, agent, rurl)
-	if WEBSERVER == 0 {
-		cmd = fmt.Sprintf("curl -q -I --key %s --cert %s -A %s %s", proxy, proxy, agent, rurl)
-	}
-	fmt.Println(cmd)
-	out, err := exec.Command("sh", "-c", cmd).CombinedOutput()
-	if err != nil {
-		log.Println("ERROR: unable to execute command", cmd, "error", err)
-		return "", 0, err
+	if e := HTTPError(resp.StatusCode, resp.Header, body); e != nil {
+		if msg := rucioException(resp.Header, body); msg != "" {
+			e.Message = msg
+		}
+		return "", 0, fmt.Errorf("rucio %s auth at %s failed, %w", method, rurl, e)
 	}
-	var token string
-	for _, v := range strings.Split(string(out), "\n") {
-		if strings.Contains(strings.ToLower(v), "x-rucio-auth-token:") {
-			arr := strings.Split(v, "X-Rucio-Auth-Token: ")
-			token = strings.Replace(arr[len(arr)-1], "\n", "", -1)
-			token = strings.Replace(token, "\r", "", -1)
-			return token, expire, nil
+	if method == RucioAuthOIDC {
+		// token is accepted by Rucio and valid until its exp claim
+		if ts := tokenExpire(token); !ts.IsZero() {
+			return token, ts.Unix(), nil
 		}
+		return token, rucioTokenExpire(""), nil
+	}
+	if v := resp.Header.Get("X-Rucio-Auth-Token"); v != "" {
+		return v, rucioTokenExpire(resp.Header.Get("X-Rucio-Auth-Token-Expires")), nil
 	}
-	return token, expire, nil
+	return "", 0, fmt.Errorf("rucio %s auth at %s, no X-Rucio-Auth-Token in response", method, rurl)
 }
@@ -0,0 +1,183 @@
+package utils
+
+// DAS utils module, scheduler of upstream calls
+// Scheduler limits number of concurrently running upstream calls to
+// UrlQueueLimit. Pending calls are grouped by DAS query and dispatched in
+// round-robin order among groups, such that query with many URLs does not
+// delay other queries. Interactive calls are always dispatched before
+// background ones (e.g. calls of background refresh of popular queries).
+// A call is dispatched only when its service has a free slot (see
+// ServiceLimits), such that saturated service never holds global slots, and
+// failed calls release all slots while they wait before their retries.
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FetchPriority represents priority class of upstream calls
+type FetchPriority int
+
+// FetchInteractive and others represent priority classes of upstream calls
+const (
+	FetchInteractive FetchPriority = iota // calls of user queries
+	FetchBackground                       // calls of background refresh
+	nPriorities
+)
+
+// UrlRequest structure holds details about url request's attributes
+type UrlRequest struct {
+	rurl     string
+	args     string
+	out      chan<- ResponseType
+	client   *http.Client
+	group    string        // group of the request, e.g. hash of DAS query
+	priority FetchPriority // priority class of the request
+	attempt  int           // number of retries made so far
+	stream   bool          // leave body of the response unread, see FetchStream
+}
+
+// fetchQueue keeps pending requests of one priority class grouped by their group
+type fetchQueue struct {
+	groups map[string][]UrlRequest
+	order  []string // round-robin order of groups
+}
+
+// helper function to add request to the queue
+func (q *fetchQueue) push(r UrlRequest) {
+	if _, ok := q.groups[r.group]; !ok {
+		q.order = append(q.order, r.group)
+	}
+	q.groups[r.group] = append(q.groups[r.group], r)
+}
+
+// helper function to pop first request accepted by given function, groups are
+// looked up in round-robin order and the group of the request is moved to the
+// end of the order if it has more requests
+func (q *fetchQueue) pop(accept func(UrlRequest) bool) (UrlRequest, bool) {
+	for i, group := range q.order {
+		requests := q.groups[group]
+		for j, r := range requests {
+			if !accept(r) {
+				continue
+			}
+			q.order = append(q.order[:i:i], q.order[i+1:]...)
+			if len(requests) > 1 {
+				q.groups[group] = append(requests[:j:j], requests[j+1:]...)
+				q.order = append(q.order, group)
+			} else {
+				delete(q.groups, group)
+			}
+			return r, true
+		}
+	}
+	return UrlRequest{}, false
+}
+
+// FetchScheduler dispatches upstream calls with limited concurrency
+type FetchScheduler struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	queues  [nPriorities]fetchQueue
+	slots   chan struct{} // semaphore of running calls
+	pending int32         // number of pending calls
+	running int32         // number of running calls
+}
+
+// NewFetchScheduler creates scheduler with given limit of concurrent calls
+func NewFetchScheduler(limit int) *FetchScheduler {
+	s := &FetchScheduler{slots: make(chan struct{}, limit)}
+	s.cond = sync.NewCond(&s.mutex)
+	for i := range s.queues {
+		s.queues[i].groups = make(map[string][]UrlRequest)
+	}
+	return s
+}
+
+// Submit adds request to the scheduler
+func (s *FetchScheduler) Submit(r UrlRequest) {
+	if r.priority < 0 || r.priority >= nPriorities {
+		r.priority = FetchInteractive
+	}
+	s.mutex.Lock()
+	s.queues[r.priority].push(r)
+	atomic.AddInt32(&s.pending, 1)
+	s.mutex.Unlock()
+	s.cond.Signal()
+}
+
+// helper function to acquire slot of the service of given request
+func acquireSlot(r UrlRequest) bool {
+	return getServiceState(system(r.rurl)).tryAcquire()
+}
+
+// helper function to wait for next request according to priority and group
+// order whose service has a free slot, the slot is acquired for the request
+func (s *FetchScheduler) next() UrlRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for {
+		for i := range s.queues {
+			if r, ok := s.queues[i].pop(acquireSlot); ok {
+				atomic.AddInt32(&s.pending, -1)
+				return r
+			}
+		}
+		s.cond.Wait()
+	}
+}
+
+// helper function to wake up the scheduler once slot of a service is released
+func (s *FetchScheduler) wake() {
+	// taking the mutex guarantees that next is either waiting or not yet
+	// looking for requests, therefore the wake-up is not lost
+	s.mutex.Lock()
+	s.mutex.Unlock()
+	s.cond.Broadcast()
+}
+
+// Run dispatches submitted requests, it blocks until a slot is available and
+// then until a request is submitted, therefore it never polls
+func (s *FetchScheduler) Run() {
+	for {
+		s.slots <- struct{}{}
+		r := s.next()
+		atomic.AddInt32(&s.running, 1)
+		go s.dispatch(r)
+	}
+}
+
+// helper function to make the call of dispatched request, the failed call is
+// submitted again after backoff delay of its retry policy, such that we do not
+// hold any slots while we wait
+func (s *FetchScheduler) dispatch(r UrlRequest) {
+	resp := fetchCall(r.client, r.rurl, r.args, true, r.stream)
+	resp.Retries = r.attempt
+	atomic.AddInt32(&s.running, -1)
+	<-s.slots
+	if resp.Error != nil {
+		if delay, ok := retryDelay(GetRetryPolicy(system(r.rurl)), resp.Error, r.attempt+1); ok {
+			time.Sleep(delay)
+			r.attempt++
+			s.Submit(r)
+			return
+		}
+		fetchFailed(resp)
+	}
+	r.out <- resp
+}
+
+// Pending returns number of pending requests
+func (s *FetchScheduler) Pending() int32 {
+	return atomic.LoadInt32(&s.pending)
+}
+
+// Running returns number of running requests
+func (s *FetchScheduler) Running() int32 {
+	return atomic.LoadInt32(&s.running)
+}
+
+// Scheduler is a scheduler of upstream calls, it is created by Init if UrlQueueLimit is set
+var Scheduler *FetchScheduler
@@ -5,12 +5,15 @@ package web
 // Copyright (c) 2015-2017 - Valentin Kuznetsov <vkuznet AT gmail dot com>
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -22,6 +25,7 @@ import (
 	"github.com/dmwm/das2go/dasmaps"
 	"github.com/dmwm/das2go/dasql"
 	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/services"
 	"github.com/dmwm/das2go/utils"
 	"github.com/prometheus/procfs"
 	"github.com/shirou/gopsutil/cpu"
@@ -38,9 +42,8 @@ var TotalPostRequests uint64
 
 // ServerSettings controls server parameters
 type ServerSettings struct {
-	Level          int    `json:"level"`          // verbosity level
-	RucioTokenCurl bool   `json:"rucioTokenCurl"` // use curl method to obtain Rucio Token
-	ProfileFile    string `json:"profileFile"`    // send profile data to a given file
+	Level       int    `json:"level"`       // verbosity level
+	ProfileFile string `json:"profileFile"` // send profile data to a given file
 }
 
 // DASKeys provides information about DAS keys used by ServiceHandler
@@ -144,7 +147,27 @@ func dasZero(base string) string {
 	return page
 }
 
-func processRequest(dasquery dasql.DASQuery, pid string, idx, limit int) map[string]interface{} {
+// dataRequest defines which records of DAS query are returned to the client
+type dataRequest struct {
+	idx     int    // index of first record
+	limit   int    // number of records, all records if not positive
+	cursor  string // cursor token of previous page, it is used instead of idx
+	partial bool   // return records from services which already finished while other services are running
+	stream  bool   // records are streamed to the client by the caller, see streamJSON and streamPlain
+}
+
+// helper function to get records of DAS query from merge collection, the
+// records are not fetched when they are streamed by the caller
+func getData(dasquery dasql.DASQuery, req dataRequest) (string, []mongo.DASRecord) {
+	if req.stream {
+		return das.GetStatus(dasquery), nil
+	}
+	return das.GetData(dasquery, "merge", req.cursor, req.idx, req.limit)
+}
+
+// helper function to process DAS query request, see dataRequest for details
+// of returned records
+func processRequest(dasquery dasql.DASQuery, pid string, req dataRequest) map[string]interface{} {
 	// defer function will propagate error message to higher level
 	defer utils.ErrPropagate("processRequest")
 
@@ -153,7 +176,7 @@ func processRequest(dasquery dasql.DASQuery, pid string, idx, limit int) map[str
 
 	response := make(map[string]interface{})
 	if das.CheckDataReadiness(pid) { // data exists in cache and ready for retrieval
-		status, data := das.GetData(dasquery, "merge", idx, limit)
+		status, data := getData(dasquery, req)
 		ts := das.TimeStamp(dasquery)
 		procTime := time.Now().Sub(time.Unix(ts, 0))
 		nrec := das.Count(pid)
@@ -164,42 +187,177 @@ func processRequest(dasquery dasql.DASQuery, pid string, idx, limit int) map[str
 		response["status"] = status
 		response["pid"] = pid
 		response["data"] = data
+		if cursor := das.NextCursor(dasquery, data, req.limit); cursor != "" {
+			response["cursor"] = cursor
+		}
 		response["procTime"] = procTime
-		log.Printf("%v pid=%v status=%v nrecords=%d idx=%v limit=%v bytes=%v processing_time=%v\n", dasquery, pid, status, nrec, idx, limit, size, procTime)
+		response["services"] = das.ServiceStates(pid)
+		das.Hit(dasquery) // keep track of query popularity
+		log.Printf("%v pid=%v status=%v nrecords=%d idx=%v limit=%v bytes=%v processing_time=%v\n", dasquery, pid, status, nrec, req.idx, req.limit, size, procTime)
+	} else if das.CheckStaleData(pid) { // expired data exists in cache, serve it while we refresh it
+		status, data := getData(dasquery, req)
+		nrec := das.Count(pid)
+		size := das.Bytes(pid)
+		age := das.DataAge(pid)
+		response["bytes"] = size
+		response["nresults"] = nrec
+		response["timestamp"] = das.GetTimestamp(pid)
+		response["status"] = status
+		response["pid"] = pid
+		response["data"] = data
+		if cursor := das.NextCursor(dasquery, data, req.limit); cursor != "" {
+			response["cursor"] = cursor
+		}
+		response["services"] = das.ServiceStates(pid)
+		response["stale"] = true
+		response["age"] = age
+		das.Hit(dasquery)
+		das.Revalidate(dasquery, _dasmaps)
+		log.Printf("%v pid=%v status=%v nrecords=%d idx=%v limit=%v bytes=%v stale=true age=%v\n", dasquery, pid, status, nrec, req.idx, req.limit, size, age)
 	} else if das.CheckData(pid) { // data exists in cache but still processing
 		response["status"] = "processing"
 		response["pid"] = pid
+		response["services"] = das.ServiceStates(pid)
+		if req.partial && !req.stream {
+			_, data := das.GetPartialData(dasquery, "", req.idx, req.limit)
+			response["data"] = data
+			response["nresults"] = das.CountPartial(pid)
+			response["partial"] = true
+		}
 	} else { // no data in cache (even client supplied the pid), process it
 		log.Printf("%v pid=%v\n", dasquery, pid)
+		// remove expired records which are not yet removed by TTL index
+		das.RemoveExpired(pid)
 		go das.Process(dasquery, _dasmaps)
 		response["status"] = "requested"
 		response["pid"] = pid
 	}
-	response["idx"] = idx
-	response["limit"] = limit
+	response["idx"] = req.idx
+	response["limit"] = req.limit
 	return response
 }
 
-// UserDN function parses user Distinguished Name (DN) from client's HTTP request
+// helper function to write DAS response in JSON format, data records are
+// streamed from DAS cache as they are read instead of being kept in memory.
+// If reading of records fails the response contains error attribute.
+func streamJSON(w http.ResponseWriter, dasquery dasql.DASQuery, response map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := StreamJSON(w, response, func(fn func(rec mongo.DASRecord) error) error {
+		return das.StreamData(dasquery, fn)
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to stream records of %v, error %v\n", dasquery, err)
+	}
+}
+
+// StreamJSON writes DAS response in JSON format, its data attribute holds
+// records which are passed by given iterate function as they are read.
+// If iteration fails the response contains error attribute.
+func StreamJSON(w io.Writer, response map[string]interface{}, iterate func(fn func(rec mongo.DASRecord) error) error) error {
+	// data attribute of the response is replaced by streamed records
+	delete(response, "data")
+	js, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	bw.Write(js[:len(js)-1]) // response without closing brace
+	if len(response) > 0 {
+		bw.WriteString(",")
+	}
+	bw.WriteString("\"data\":[")
+	nrec := 0
+	err = iterate(func(rec mongo.DASRecord) error {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		if nrec > 0 {
+			bw.WriteString(",")
+		}
+		nrec++
+		_, err = bw.Write(data)
+		return err
+	})
+	bw.WriteString("]")
+	if err != nil {
+		if msg, e := json.Marshal(err.Error()); e == nil {
+			bw.WriteString(",\"error\":")
+			bw.Write(msg)
+		}
+	}
+	bw.WriteString("}")
+	return err
+}
+
+// helper function to write DAS records in plain format, records are streamed
+// from DAS cache as they are read instead of being kept in memory
+func streamPlain(w http.ResponseWriter, dasquery dasql.DASQuery) {
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	nrec := 0
+	err := das.StreamData(dasquery, func(rec mongo.DASRecord) error {
+		val, ok := PresentRecordPlain(rec)
+		if !ok {
+			return nil
+		}
+		if nrec > 0 {
+			bw.WriteString("\n")
+		}
+		nrec++
+		_, err := bw.WriteString(val)
+		return err
+	})
+	if err != nil {
+		log.Printf("ERROR: unable to stream records of %v, error %v\n", dasquery, err)
+	}
+}
+
+// NoDN is returned by UserDN when client's HTTP request does not provide user DN
+const NoDN = "No DN is provided"
+
+// short names of DN attributes, other attributes are shown by their OID
+var dnAttributes = map[string]string{
+	"0.9.2342.19200300.100.1.25": "DC",
+	"0.9.2342.19200300.100.1.1":  "UID",
+	"1.2.840.113549.1.9.1":       "emailAddress",
+	"2.5.4.3":                    "CN",
+	"2.5.4.5":                    "serialNumber",
+	"2.5.4.6":                    "C",
+	"2.5.4.7":                    "L",
+	"2.5.4.8":                    "ST",
+	"2.5.4.10":                   "O",
+	"2.5.4.11":                   "OU",
+}
+
+// UserDN function parses user Distinguished Name (DN) from client's HTTP request,
+// the DN is taken from subject of client certificate, verified one if any
 func UserDN(r *http.Request) string {
-	var names []interface{}
-	ndn := "No DN is provided"
-	if r.TLS == nil {
+	ndn := NoDN
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
 		return ndn
 	}
-	for _, cert := range r.TLS.PeerCertificates {
-		for _, name := range cert.Subject.Names {
-			switch v := name.Value.(type) {
-			case string:
-				names = append(names, v)
-			}
+	cert := r.TLS.PeerCertificates[0]
+	if len(r.TLS.VerifiedChains) > 0 {
+		cert = r.TLS.VerifiedChains[0][0]
+	}
+	var dn string
+	for _, name := range cert.Subject.Names {
+		v, ok := name.Value.(string)
+		if !ok {
+			continue
+		}
+		oid := name.Type.String()
+		if attr, ok := dnAttributes[oid]; ok {
+			oid = attr
 		}
+		dn = fmt.Sprintf("%s/%s=%s", dn, oid, v)
 	}
-	if len(names) == 0 {
+	if dn == "" {
 		return ndn
 	}
-	parts := names[:7]
-	return fmt.Sprintf("/DC=%s/DC=%s/OU=%s/OU=%s/CN=%s/CN=%s/CN=%s", parts...)
+	return dn
 }
 
 // custom logic for CMS authentication, users may implement their own logic here
@@ -243,6 +401,10 @@ func AuthHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, msg, http.StatusForbidden)
 		return
 	}
+	if strings.HasPrefix(r.URL.Path, config.Config.Base+"/admin/") {
+		AdminHandler(w, r)
+		return
+	}
 	arr := strings.Split(r.URL.Path, "/")
 	path := arr[len(arr)-1]
 	switch path {
@@ -265,6 +427,113 @@ func AuthHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// helper function to check if user is allowed to use DAS admin API
+// the DN should come from verified client certificate, i.e. plain HTTP
+// requests and requests with unverified certificates are not allowed
+func adminAuth(r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	userDN := UserDN(r)
+	if len(config.Config.AdminDNs) == 0 || userDN == NoDN {
+		return false
+	}
+	return utils.InList(userDN, config.Config.AdminDNs)
+}
+
+// helper function to write JSON response
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// AdminHandler handles DAS cache administration requests:
+// GET admin/queries lists cached queries,
+// POST admin/invalidate invalidates queries for given qhash or pattern,
+// POST admin/purge removes all queries of given system
+func AdminHandler(w http.ResponseWriter, r *http.Request) {
+	user := UserDN(r)
+	if !adminAuth(r) {
+		log.Printf("ERROR: user DN %s is not allowed to use admin API\n", user)
+		http.Error(w, "You are not allowed to access this resource", http.StatusForbidden)
+		return
+	}
+	arr := strings.Split(r.URL.Path, "/")
+	path := arr[len(arr)-1]
+	switch path {
+	case "queries":
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		queries, err := das.CachedQueries()
+		if err != nil {
+			log.Printf("ERROR: unable to get cached queries, error %v\n", err)
+			http.Error(w, "unable to read DAS cache", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, queries)
+	case "invalidate":
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		qhash := r.FormValue("qhash")
+		pattern := r.FormValue("pattern")
+		var pids []string
+		var params map[string]string
+		var err error
+		if qhash != "" {
+			params = map[string]string{"qhash": qhash}
+			if err = das.InvalidateQuery(qhash); err == nil {
+				pids = []string{qhash}
+			}
+		} else if pattern != "" {
+			if _, e := regexp.Compile(pattern); e != nil {
+				http.Error(w, fmt.Sprintf("invalid pattern: %v", e), http.StatusBadRequest)
+				return
+			}
+			params = map[string]string{"pattern": pattern}
+			pids, err = das.InvalidatePattern(pattern)
+		} else {
+			http.Error(w, "either qhash or pattern parameter is required", http.StatusBadRequest)
+			return
+		}
+		das.Audit(user, "invalidate", params, pids)
+		if err != nil {
+			log.Printf("ERROR: unable to invalidate %v, error %v\n", params, err)
+			http.Error(w, "unable to invalidate DAS cache", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"status": "ok", "qhashes": pids})
+	case "purge":
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		system := r.FormValue("system")
+		if system == "" {
+			http.Error(w, "system parameter is required", http.StatusBadRequest)
+			return
+		}
+		pids, err := das.PurgeSystem(system)
+		das.Audit(user, "purge", map[string]string{"system": system}, pids)
+		if err != nil {
+			log.Printf("ERROR: unable to purge system %s, error %v\n", system, err)
+			http.Error(w, "unable to purge DAS cache", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"status": "ok", "qhashes": pids})
+	default:
+		http.Error(w, "Not implemented path", http.StatusNotFound)
+	}
+}
+
 // GET methods
 
 // CliHandler hadnlers cli requests
@@ -386,6 +655,12 @@ func StatusHandler(w http.ResponseWriter, r *http.Request) {
 	tmplData["NQueries"] = len(queries)
 	tmplData["Base"] = config.Config.Base
 	tmplData["NGo"] = runtime.NumGoroutine()
+	tmplData["Bytes"] = das.TotalBytes()
+	tmplData["ServiceBytes"] = das.ServiceBytes()
+	tmplData["Breakers"] = utils.BreakerStates()
+	tmplData["UncheckedRecords"] = atomic.LoadUint64(&services.UncheckedRecords)
+	tmplData["ResponseCache"] = utils.Cache.Stats()
+	tmplData["Credentials"] = utils.Credentials.States()
 	virt := Memory{Total: m.Total, Free: m.Free, Used: m.Used, UsedPercent: m.UsedPercent}
 	swap := Memory{Total: s.Total, Free: s.Free, Used: s.Used, UsedPercent: s.UsedPercent}
 	tmplData["Memory"] = Mem{Virtual: virt, Swap: swap}
@@ -514,6 +789,23 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		idx = 0
 	}
+	// cursor token of previous page, see storage.Cursor
+	cursor := template.HTMLEscapeString(r.FormValue("cursor"))
+	// JSON clients can request data either via view=json or JSON Accept header
+	jsonView := view == "json" || strings.Contains(strings.ToLower(r.Header.Get("Accept")), "application/json")
+	// plain view and JSON requests of all records are streamed to the client
+	stream := view == "plain" || (jsonView && limit <= 0 && cursor == "")
+	// results parameter controls if client wants results which are ready
+	// so far (results=ready) or wait for complete set (results=complete).
+	// By default web UI shows partial results while JSON clients wait for
+	// complete set of results.
+	results := template.HTMLEscapeString(r.FormValue("results"))
+	partial := !jsonView
+	if results == "ready" {
+		partial = true
+	} else if results == "complete" {
+		partial = false
+	}
 	path := r.URL.Path
 	tmplData := make(map[string]interface{})
 
@@ -565,11 +857,9 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "DAS query pid is not valid", http.StatusInternalServerError)
 		return
 	}
-	// Remove expire records from cache
-	//         das.RemoveExpired(dasquery.Qhash)
-	das.RemoveExpired(pid)
 	// process given query
-	response := processRequest(dasquery, pid, idx, limit)
+	req := dataRequest{idx: idx, limit: limit, cursor: cursor, partial: partial, stream: stream}
+	response := processRequest(dasquery, pid, req)
 	if path == base+"/cache" || path == base+"/cache/" {
 		//         status := response["status"]
 		//         if status != "ok" {
@@ -591,26 +881,56 @@ func RequestHandler(w http.ResponseWriter, r *http.Request) {
 		if response["procTime"] != nil {
 			procTime = response["procTime"].(time.Duration)
 		}
+		if jsonView {
+			if stream && status == "ok" {
+				streamJSON(w, dasquery, response)
+				return
+			}
+			js, err := json.Marshal(&response)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(js)
+			return
+		}
 		var page string
 		if status == "ok" {
-			data := response["data"].([]mongo.DASRecord)
 			if view == "plain" {
-				page = PresentDataPlain(path, dasquery, data)
-				w.Write([]byte(page))
+				streamPlain(w, dasquery)
 				return
 			}
+			data := response["data"].([]mongo.DASRecord)
 			nres := response["nresults"].(int)
+			if age, ok := response["age"].(int64); ok {
+				page = staleDataPanel(age)
+			}
+			if srvs, ok := response["services"].([]mongo.DASRecord); ok {
+				page += serviceErrorPanel(srvs)
+			}
 			if nres == 0 {
-				page = dasZero(config.Config.Base)
+				page += dasZero(config.Config.Base)
 			} else {
 				presentationMap := _dasmaps.PresentationMap()
-				page = PresentData(path, dasquery, data, presentationMap, nres, idx, limit, procTime)
+				page += PresentData(path, dasquery, data, presentationMap, nres, idx, limit, procTime)
 			}
 		} else {
 			tmplData["Base"] = config.Config.Base
 			tmplData["PID"] = pid
 			page = parseTmpl(config.Config.Templates, "check_pid.tmpl", tmplData)
 			page += fmt.Sprintf("<script>setTimeout('ajaxCheckPid(\"%s\", \"request\", \"%s\", \"%s\", \"%s\", \"%s\", \"%d\")', %d)</script>", config.Config.Base, query, inst, pid, view, 2500, 2500)
+			if srvs, ok := response["services"].([]mongo.DASRecord); ok && len(srvs) > 0 {
+				page += serviceStatusPanel(srvs)
+				page += serviceErrorPanel(srvs)
+			}
+			// show records from services which are already done
+			if data, ok := response["data"].([]mongo.DASRecord); ok && len(data) > 0 && view != "plain" {
+				nres := response["nresults"].(int)
+				presentationMap := _dasmaps.PresentationMap()
+				page += "<div><em>Partial results from finished services, final results will be merged once all services are done</em></div>"
+				page += PresentData(path, dasquery, data, presentationMap, nres, idx, limit, procTime)
+			}
 		}
 		if ajax == "" {
 			w.Write([]byte(_top + _search + _hiddenCards + page + _bottom))
@@ -645,9 +965,7 @@ func SettingsHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		utils.Profiler = nil
 	}
-	// change RucioTokenCurl with whatever is supplied in server settings POST request
-	utils.RucioTokenCurl = s.RucioTokenCurl
-	log.Printf("Set, verbose %v, rucio %v, profile %v\n", utils.VERBOSE, s.RucioTokenCurl, s.ProfileFile)
+	log.Printf("Set, verbose %v, profile %v\n", utils.VERBOSE, s.ProfileFile)
 	w.WriteHeader(http.StatusOK)
 	return
 }
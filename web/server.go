@@ -14,19 +14,23 @@ package web
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/dmwm/cmsauth"
 	"github.com/dmwm/das2go/config"
+	"github.com/dmwm/das2go/das"
 	"github.com/dmwm/das2go/dasmaps"
-	"github.com/dmwm/das2go/mongo"
 	"github.com/dmwm/das2go/services"
+	"github.com/dmwm/das2go/storage"
 	"github.com/dmwm/das2go/utils"
 
 	_ "expvar"         // to be used for monitoring, see https://github.com/divan/expvarmon
@@ -54,6 +58,17 @@ type UserDNs struct {
 // global variable which we initialize once
 var _userDNs UserDNs
 
+// helper function to get patterns of URL rewrites, longer patterns go first,
+// e.g. https://cmsweb.cern.ch:8443 is rewritten before https://cmsweb.cern.ch
+func urlRewrites(rewrites map[string]string) []string {
+	var patterns []string
+	for old := range rewrites {
+		patterns = append(patterns, old)
+	}
+	sort.Slice(patterns, func(i, j int) bool { return len(patterns[i]) > len(patterns[j]) })
+	return patterns
+}
+
 // helper function to get userDNs from Cric service
 func userDNs() []string {
 	var out []string
@@ -77,6 +92,20 @@ func userDNs() []string {
 	return out
 }
 
+// TLSConfig returns TLS configuration of DAS server, client certificates are
+// optional but given ones should be signed by CAs of X509_CERT_DIR
+func TLSConfig() *tls.Config {
+	if utils.GetEnv("X509_CERT_DIR") == "" {
+		log.Println("WARNING: X509_CERT_DIR is not set, client certificates will be refused")
+	}
+	pool, err := utils.CertDirCAs(nil)
+	if err != nil {
+		log.Printf("ERROR: unable to load CA certificates, error %v\n", err)
+		pool = x509.NewCertPool()
+	}
+	return &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+}
+
 // helper function to get DAS keys description
 func daskeysDescription() string {
 	tmplData := make(map[string]interface{})
@@ -134,13 +163,48 @@ func Server(configFile string) {
 	utils.VERBOSE = config.Config.Verbose
 	utils.UrlQueueLimit = config.Config.UrlQueueLimit
 	utils.UrlRetry = config.Config.UrlRetry
+	utils.RetryPolicies = config.Config.RetryPolicies
+	utils.Budget.Rate = config.Config.RetryBudgetRate
+	utils.Budget.Burst = float64(config.Config.RetryBudgetBurst)
+	utils.ServiceLimits = config.Config.ServiceLimits
+	utils.BreakerThreshold = config.Config.BreakerThreshold
+	utils.BreakerCooldown = time.Duration(config.Config.BreakerCooldown) * time.Second
+	utils.MaxResponseSize = config.Config.MaxResponseSize
+	utils.Cache.MaxSize = config.Config.ResponseCacheSize
+	utils.ResponseCacheTTL = config.Config.ResponseCacheTTL
+	utils.FixtureMode = config.Config.FixtureMode
+	utils.FixtureDir = config.Config.FixtureDir
+	if utils.FixtureMode != "" {
+		log.Printf("upstream calls fixtures, mode %s, dir %s\n", utils.FixtureMode, utils.FixtureDir)
+	}
 	utils.DASMAPS = config.Config.DasMaps
 	utils.TIMEOUT = config.Config.Timeout
 	services.FrontendURL = config.Config.Frontend
 	services.RucioURL = config.Config.RucioUrl
 	interval := time.Duration(config.Config.TLSCertsRenewInterval)
 	utils.TLSCertsRenewInterval = time.Duration(interval * time.Second)
-	utils.RucioTokenCurl = config.Config.RucioTokenCurl
+	utils.RucioAuthMethod = config.Config.RucioAuthMethod
+	utils.RucioUsername = config.Config.RucioUsername
+	utils.RucioPassword = config.Config.RucioPassword
+	utils.RucioTokenFile = config.Config.RucioTokenFile
+	utils.RucioAuthInsecure = config.Config.RucioAuthInsecure
+	if utils.RucioAuthInsecure {
+		log.Println("WARNING: certificate of Rucio auth server is not verified")
+	}
+	if !utils.InList(utils.RucioAuthMethod, utils.RucioAuthMethods) {
+		log.Fatalf("ERROR: unsupported rucioAuthMethod %s, supported methods %v\n", utils.RucioAuthMethod, utils.RucioAuthMethods)
+	}
+	utils.Token = config.Config.Token
+	utils.CredentialsRefreshAhead = time.Duration(config.Config.TokenRefreshAhead) * time.Second
+	utils.CredentialsWarnPeriod = time.Duration(config.Config.CredentialsWarnPeriod) * time.Second
+	for _, old := range urlRewrites(config.Config.UrlRewrites) {
+		pat := config.Config.UrlRewrites[old]
+		services.FrontendURL = strings.Replace(services.FrontendURL, old, pat, -1)
+		services.RucioURL = strings.Replace(services.RucioURL, old, pat, -1)
+		services.CricURL = strings.Replace(services.CricURL, old, pat, -1)
+		utils.RucioAuth.ChangeUrl(old, pat)
+		log.Printf("rewrite upstream urls %s to %s\n", old, pat)
+	}
 	log.Println(config.Config.String())
 
 	// acquire rucio token
@@ -148,6 +212,9 @@ func Server(configFile string) {
 	token, terr := utils.RucioAuth.Token()
 	log.Println("rucio token", token, terr)
 
+	// reload changed credentials and refresh tokens in background
+	go utils.Credentials.Watch(time.Duration(config.Config.CredentialsInterval) * time.Second)
+
 	// init CMS Authentication module
 	if config.Config.Hkey != "" {
 		_cmsAuth.Init(config.Config.Hkey)
@@ -165,16 +232,31 @@ func Server(configFile string) {
 	// call utils init
 	utils.Init()
 
+	// init DAS storage backend
+	if err := storage.Init(config.Config.Backend, config.Config.BoltFile); err != nil {
+		log.Fatal("ERROR ", err)
+	}
+	log.Printf("DAS storage backend %T\n", storage.DB)
+
 	// load DAS Maps if necessary
 	if len(_dasmaps.Services()) == 0 {
 		log.Println("Load DAS maps")
-		_dasmaps.LoadMaps("mapping", "db")
+		if err := _dasmaps.LoadMaps(); err != nil {
+			log.Println("ERROR: unable to load DAS maps from DAS storage", err)
+		}
+		if len(_dasmaps.Maps()) == 0 {
+			// storage does not contain DAS maps, e.g. in-memory storage, load them from file
+			_dasmaps.LoadMapsFromFile()
+		}
 		if len(config.Config.Services) > 0 {
 			_dasmaps.AssignServices(config.Config.Services)
 		}
 		log.Println("DAS services ", _dasmaps.Services())
 		log.Println("DAS keys ", _dasmaps.DASKeys())
 	}
+	for _, old := range urlRewrites(config.Config.UrlRewrites) {
+		_dasmaps.ChangeUrl(old, config.Config.UrlRewrites[old])
+	}
 	// set default urls for our services
 	services.UrlMap = make(map[string]string)
 	for _, srv := range _dasmaps.Services() {
@@ -211,9 +293,32 @@ func Server(configFile string) {
 	_hiddenCards = templates.Cards(config.Config.Templates, tmplData)
 
 	// create all required indexes in das.cache, das.merge collections
-	indexes := []string{"qhash", "das.expire", "das.record", "dataset.name", "file.name"}
-	mongo.CreateIndexes("das", "cache", indexes)
-	mongo.CreateIndexes("das", "merge", indexes)
+	indexes := []string{"qhash", "das.expire", "das.record", "das.primary_value", "dataset.name", "file.name"}
+	for _, coll := range []string{storage.Cache, storage.Merge} {
+		if err := storage.DB.CreateIndexes(coll, indexes); err != nil {
+			log.Printf("ERROR: unable to create indexes in %s collection, error %v\n", coll, err)
+		}
+	}
+
+	// serve stale records while they are refreshed
+	das.StaleWhileRevalidate = config.Config.StaleWhileRevalidate
+	das.MaxStaleness = time.Duration(config.Config.MaxStaleness) * time.Second
+	log.Println("stale while revalidate", das.StaleWhileRevalidate, "max staleness", das.MaxStaleness)
+
+	// expired records are removed from das.cache, das.merge collections by TTL index
+	for _, coll := range []string{storage.Cache, storage.Merge} {
+		if err := storage.DB.CreateTTLIndex(coll, "das.expire_at", das.Retention()); err != nil {
+			log.Fatalf("ERROR: unable to create TTL index in %s collection, error %v\n", coll, err)
+		}
+	}
+
+	// refresh popular queries in background before they expire
+	if config.Config.RefreshTopN > 0 {
+		lead := time.Duration(config.Config.RefreshLead) * time.Second
+		interval := time.Duration(config.Config.RefreshInterval) * time.Second
+		log.Printf("refresh top %d queries, concurrency %d, lead %v, interval %v\n", config.Config.RefreshTopN, config.Config.RefreshConcurrency, lead, interval)
+		go das.RefreshWorker(_dasmaps, config.Config.RefreshTopN, config.Config.RefreshConcurrency, lead, interval)
+	}
 
 	// assign handlers
 	base := config.Config.Base
@@ -250,10 +355,8 @@ func Server(configFile string) {
 	if e1 == nil && e2 == nil {
 		//start HTTPS server which require user certificates
 		server := &http.Server{
-			Addr: addr,
-			TLSConfig: &tls.Config{
-				ClientAuth: tls.RequestClientCert,
-			},
+			Addr:      addr,
+			TLSConfig: TLSConfig(),
 		}
 		log.Println("starting HTTPs server", addr)
 		err = server.ListenAndServeTLS(config.Config.ServerCrt, config.Config.ServerKey)
@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
+	"html"
 	"log"
 	"net/url"
 	"sort"
@@ -15,6 +16,7 @@ import (
 	"github.com/dmwm/das2go/das"
 	"github.com/dmwm/das2go/dasql"
 	"github.com/dmwm/das2go/mongo"
+	"github.com/dmwm/das2go/services"
 	"github.com/dmwm/das2go/utils"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -131,6 +133,120 @@ func colServices(services []string) string {
 	//     return "Sources: " + strings.Join(utils.MapKeys(out), "")
 }
 
+// helper function to show processing state of individual services
+func serviceStatusPanel(states []mongo.DASRecord) string {
+	var out []string
+	for _, rec := range states {
+		srv := fmt.Sprintf("%v", rec["service"])
+		status := fmt.Sprintf("%v", rec["status"])
+		system := strings.Split(srv, ":")[0]
+		bkg, col := genColor(system)
+		color := "black"
+		if status == "ok" {
+			color = "green"
+		} else if status == "error" {
+			color = "red"
+		}
+		row := fmt.Sprintf("<span style=\"background-color:%s;color:%s;padding:2px\">%s</span> <span style=\"color:%s\">%s</span>", bkg, col, srv, color, status)
+		out = append(out, row)
+	}
+	return fmt.Sprintf("<div class=\"services\">Services: %s</div>", strings.Join(out, ", "))
+}
+
+// helper function to show failed services along with their error details
+func serviceErrorPanel(states []mongo.DASRecord) string {
+	var out []string
+	for _, rec := range services.ServiceErrors(states) {
+		srv := fmt.Sprintf("%v", rec["service"])
+		msg := html.EscapeString(fmt.Sprintf("%v", rec["error"]))
+		row := fmt.Sprintf("<li><b>%s</b>: %v, HTTP status %v, latency %.3fs, retries %v<br/><span class=\"code\">%s</span></li>", srv, rec["error_class"], rec["http_status"], toFloat(rec["latency"]), rec["retries"], msg)
+		out = append(out, row)
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("<div class=\"daserror\">The following services failed, results may be incomplete:<ul>%s</ul></div>", strings.Join(out, ""))
+}
+
+// helper function to show warning about stale records
+func staleDataPanel(age int64) string {
+	since := time.Duration(age) * time.Second
+	return fmt.Sprintf("<div class=\"daserror\">These results are stale, they were fetched %v ago and are being refreshed now</div>", since)
+}
+
+// helper function to show discrepancies of values among services in DAS record
+func diffPanel(dasrec mongo.DASRecord) string {
+	var diffs []interface{}
+	switch v := dasrec["diff"].(type) {
+	case []interface{}:
+		diffs = v
+	case []mongo.DASRecord:
+		for _, r := range v {
+			diffs = append(diffs, r)
+		}
+	default:
+		return ""
+	}
+	// values come from upstream data and should be escaped
+	esc := func(v interface{}) string {
+		return html.EscapeString(fmt.Sprintf("%v", v))
+	}
+	var out []string
+	for _, item := range diffs {
+		rec, ok := item.(mongo.DASRecord)
+		if !ok {
+			continue
+		}
+		var vals []string
+		switch values := rec["values"].(type) {
+		case []interface{}:
+			for _, v := range values {
+				if r, ok := v.(mongo.DASRecord); ok {
+					vals = append(vals, fmt.Sprintf("%s=%s", esc(r["service"]), esc(r["value"])))
+				}
+			}
+		case []mongo.DASRecord:
+			for _, r := range values {
+				vals = append(vals, fmt.Sprintf("%s=%s", esc(r["service"]), esc(r["value"])))
+			}
+		}
+		out = append(out, fmt.Sprintf("<b>%s</b>: %s", esc(rec["key"]), strings.Join(vals, ", ")))
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("<div style=\"color:red\">Inconsistent values among services: %s</div>", strings.Join(out, "; "))
+}
+
+// helper function to add provenance information (which services supplied
+// given DAS key and when) as hover tooltip to web key
+func provenanceTooltip(dasrec mongo.DASRecord, daskey, webkey string) string {
+	var out []string
+	for _, rec := range services.FieldProvenance(dasrec, daskey) {
+		out = append(out, fmt.Sprintf("%v at %s", rec["service"], utils.TimeFormat(rec["ts"])))
+	}
+	if len(out) == 0 {
+		return webkey
+	}
+	title := fmt.Sprintf("%s is provided by %s", daskey, strings.Join(utils.List2Set(out), ", "))
+	return fmt.Sprintf("<span title=\"%s\">%s</span>", html.EscapeString(title), webkey)
+}
+
+// helper function to convert numeric value to float
+func toFloat(val interface{}) float64 {
+	switch v := val.(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return 0
+}
+
 // helper function to create links
 func dasLinks(path, inst, val string, links []interface{}) string {
 	var out []string
@@ -211,17 +327,19 @@ func showRecord(data mongo.DASRecord) string {
 	return wrap + val
 }
 
-// helper function to provide proper url
-func makeUrl(url, urlType string, startIdx, limit, nres int) string {
+// helper function to provide proper url, pages of given cursor token are
+// read from the cursor position and idx is only used to show their range
+func makeUrl(url, urlType string, startIdx, limit, nres int, cursor string) string {
 	var out string
 	var idx int
 	if urlType == "first" {
 		idx = 0
 	} else if urlType == "prev" {
-		if startIdx != 0 {
+		if startIdx > limit {
 			idx = startIdx - limit
 		} else {
 			idx = 0
+			cursor = ""
 		}
 	} else if urlType == "next" {
 		idx = startIdx + limit
@@ -234,15 +352,28 @@ func makeUrl(url, urlType string, startIdx, limit, nres int) string {
 			j = i
 		}
 		idx = j
+		// last page read from the end of the set holds last limit records
+		if cursor != "" {
+			idx = nres - limit
+		}
+		if idx <= 0 {
+			idx = 0
+			cursor = ""
+		}
 	}
 	out = fmt.Sprintf("%s&idx=%d&limit=%d", url, idx, limit)
+	if cursor != "" {
+		out = fmt.Sprintf("%s&cursor=%s", out, cursor)
+	}
 	return out
 }
 
-// helper function to provide pagination
-func pagination(base, query, inst string, nres, startIdx, limit int) string {
+// helper function to provide pagination, links to previous, next and last
+// pages carry cursor tokens of given page of records (see das.NextCursor),
+// such that records before these pages are not skipped
+func pagination(base string, dasquery dasql.DASQuery, data []mongo.DASRecord, nres, startIdx, limit int) string {
 	var templates DASTemplates
-	url := fmt.Sprintf("%s?input=%s&instance=%s", base, url.QueryEscape(query), inst)
+	url := fmt.Sprintf("%s?input=%s&instance=%s", base, url.QueryEscape(dasquery.Query), dasquery.Instance)
 	tmplData := make(map[string]interface{})
 	if nres > 0 {
 		tmplData["StartIndex"] = fmt.Sprintf("%d", startIdx+1)
@@ -255,10 +386,10 @@ func pagination(base, query, inst string, nres, startIdx, limit int) string {
 		tmplData["EndIndex"] = fmt.Sprintf("%d", nres)
 	}
 	tmplData["Total"] = fmt.Sprintf("%d", nres)
-	tmplData["FirstUrl"] = makeUrl(url, "first", startIdx, limit, nres)
-	tmplData["PrevUrl"] = makeUrl(url, "prev", startIdx, limit, nres)
-	tmplData["NextUrl"] = makeUrl(url, "next", startIdx, limit, nres)
-	tmplData["LastUrl"] = makeUrl(url, "last", startIdx, limit, nres)
+	tmplData["FirstUrl"] = makeUrl(url, "first", startIdx, limit, nres, "")
+	tmplData["PrevUrl"] = makeUrl(url, "prev", startIdx, limit, nres, das.PrevCursor(dasquery, data))
+	tmplData["NextUrl"] = makeUrl(url, "next", startIdx, limit, nres, das.NextCursor(dasquery, data, limit))
+	tmplData["LastUrl"] = makeUrl(url, "last", startIdx, limit, nres, das.LastCursor(dasquery))
 	page := templates.Pagination(config.Config.Templates, tmplData)
 	line := "<hr class=\"line\" />"
 	return fmt.Sprintf("%s%s<br/>", page, line)
@@ -356,25 +487,23 @@ func datasetPattern(q string) string {
 	return ""
 }
 
-// PresentDataPlain represents DAS records for web UI
-func PresentDataPlain(path string, dasquery dasql.DASQuery, data []mongo.DASRecord) string {
-	var pkey, out string
-	var dasrec mongo.DASRecord
-	for _, item := range data {
-		dasrec = item["das"].(mongo.DASRecord)
-		pkey = dasrec["primary_key"].(string)
-		val := ExtractValue(item, pkey)
-		vals := strings.Split(val, ",")
-		if len(vals) > 1 {
-			val = vals[0]
-		}
-		if out == "" {
-			out = fmt.Sprintf("%v", val)
-		} else {
-			out = fmt.Sprintf("%s\n%v", out, val)
-		}
-	}
-	return out
+// PresentRecordPlain represents DAS record for plain view, i.e. value of its
+// primary key. It returns false if record does not have primary key.
+func PresentRecordPlain(item mongo.DASRecord) (string, bool) {
+	dasrec, ok := item["das"].(mongo.DASRecord)
+	if !ok {
+		return "", false
+	}
+	pkey, ok := dasrec["primary_key"].(string)
+	if !ok {
+		return "", false
+	}
+	val := ExtractValue(item, pkey)
+	vals := strings.Split(val, ",")
+	if len(vals) > 1 {
+		val = vals[0]
+	}
+	return val, true
 }
 
 // helper function to parse DBSError struct
@@ -411,7 +540,7 @@ func PresentData(path string, dasquery dasql.DASQuery, data []mongo.DASRecord, p
 	if len(dasquery.Aggregators) > 0 {
 		total = len(dasquery.Aggregators)
 	}
-	out = append(out, pagination(path, dasquery.Query, dasquery.Instance, total, startIdx, limit))
+	out = append(out, pagination(path, dasquery, data, total, startIdx, limit))
 	patMsg := datasetPattern(dasquery.Query)
 	if patMsg != "" {
 		out = append(out, patMsg)
@@ -585,6 +714,9 @@ func PresentData(path string, dasquery dasql.DASQuery, data []mongo.DASRecord, p
 							value = fmt.Sprintf("<b><span %s>%s</span></b>", color, value)
 							webkey = tooltip(webkey)
 						}
+						if webkey == uirow["ui"].(string) { // web key does not have its own tooltip
+							webkey = provenanceTooltip(dasrec, daskey, webkey)
+						}
 						if daskey == pkey {
 							row = fmt.Sprintf("%s: %v\n<br/>\n", webkey, href(path, pkey, value, inst, dasquery.Query))
 						} else {
@@ -614,6 +746,9 @@ func PresentData(path string, dasquery dasql.DASQuery, data []mongo.DASRecord, p
 			values[0] = strings.Replace(values[0], "<br/>", "", 1)
 		}
 		out = append(out, strings.Join(utils.List2Set(values), " "))
+		if diff := diffPanel(dasrec); diff != "" {
+			out = append(out, diff)
+		}
 		// add lumis/events pairs for queries which contains events
 		if utils.InList("events", fields) {
 			out = append(out, lumiEvents(item))
@@ -639,7 +774,7 @@ func PresentData(path string, dasquery dasql.DASQuery, data []mongo.DASRecord, p
 			out = append(out, line)
 		}
 	}
-	out = append(out, pagination(path, dasquery.Query, dasquery.Instance, total, startIdx, limit))
+	out = append(out, pagination(path, dasquery, data, total, startIdx, limit))
 	if procTime.Seconds() == 0 { // look-up processing time if it is not provided
 		ts := das.TimeStamp(dasquery)
 		procTime = time.Now().Sub(time.Unix(ts, 0))